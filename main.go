@@ -1,7 +1,10 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
+	"os"
 
 	"github.com/hajimehoshi/ebiten/v2"
 
@@ -9,15 +12,207 @@ import (
 )
 
 func main() {
-	r := &pkg.Renderer{}
+	opts := pkg.Options{}
+
+	flag.StringVar(&opts.Scenario, "scenario", "", "scenario file to run instead of the scripts")
+	flag.StringVar(&opts.ScriptsDir, "scripts", "scripts", "directory of the scripts")
+	flag.StringVar(&opts.ParticleScript, "particle", "", "particle script to select, by file name")
+	seed := flag.Int64("seed", 0, "seed of the run, over the one of the scenario")
+	flag.DurationVar(&opts.Tick, "tick", pkg.DefaultTick, "interval between two engine updates, none by default when headless")
+	flag.IntVar(&opts.Width, "width", pkg.ScreenWidth, "width of the window")
+	flag.IntVar(&opts.Height, "height", pkg.ScreenHeight, "height of the window")
+	fullscreen := flag.Bool("fullscreen", false, "start in fullscreen")
+	flag.BoolVar(&opts.Run, "run", false, "start the simulation at launch")
+	flag.IntVar(&opts.MaxRounds, "max-rounds", 0, "stop at a round, over the stop conditions of the scenario")
+	trace := flag.String("trace", "", "file to record the run to, as JSON lines")
+	gexf := flag.String("gexf", "", "file to write the particle graph of the run to, as dynamic GEXF")
+	flag.BoolVar(&opts.GraphObstacles, "graph-obstacles", false, "add the obstacles to the particle graphs")
+	headless := flag.Bool("headless", false, "run without a window until a stop condition")
+	verbose := flag.Bool("verbose", false, "print the trace of the engine and of the scripts when headless")
+	out := flag.String("out", "runs.csv", "experiment: file of the CSV rows of the runs")
+	summary := flag.String("summary", "", "experiment: file of the CSV summary, printed if empty")
+	workers := flag.Int("workers", 0, "experiment: runs in parallel, over the experiment file")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [validate] [flags] [scenario.json]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s experiment [flags] experiment.json\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	// The validate command checks the initial state instead of running it,
+	// the experiment command runs an experiment file
+	command := ""
+	if len(os.Args) > 1 && (os.Args[1] == "validate" || os.Args[1] == "experiment") {
+		command = os.Args[1]
+
+		// The command line exits on a parse error
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if set["seed"] {
+		opts.Seed = seed
+	}
+
+	if command == "experiment" {
+		os.Exit(runExperiment(flag.Arg(0), *out, *summary, *workers, opts, set))
+	}
+
+	// An optional scenario file replaces the scripts
+	if flag.NArg() > 0 && opts.Scenario == "" {
+		opts.Scenario = flag.Arg(0)
+	}
+
+	if command == "validate" {
+		opts.Quiet = true
+
+		os.Exit(runValidate(opts))
+	}
+
+	// The output files are created once the run is sure to start
+	if *trace != "" {
+		f, err := os.Create(*trace)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		opts.Trace = f
+	}
+
+	if *gexf != "" {
+		f, err := os.Create(*gexf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		opts.GEXF = f
+	}
+
+	if *headless {
+		// As fast as possible, unless a tick is given
+		if !set["tick"] {
+			opts.Tick = 0
+		}
+
+		opts.Quiet = !*verbose
+
+		if err := pkg.RunHeadless(opts); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	r := &pkg.Renderer{Options: opts}
+
 	if err := r.Init(); err != nil {
 		log.Fatal(err)
 	}
 
-	ebiten.SetWindowSize(pkg.ScreenWidth, pkg.ScreenHeight)
+	ebiten.SetWindowSize(opts.Width, opts.Height)
 	ebiten.SetWindowTitle("Programmable Matter Simulator")
+	ebiten.SetFullscreen(*fullscreen)
 
 	if err := ebiten.RunGame(r); err != nil {
 		log.Fatal(err)
 	}
+
+	if err := r.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runValidate prints the findings of the validator and returns the exit
+// code, 1 if there are errors
+func runValidate(opts pkg.Options) int {
+	findings, err := pkg.Validate(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		return 1
+	}
+
+	errors := 0
+
+	for _, finding := range findings {
+		fmt.Println(finding)
+
+		if finding.Severity == pkg.ERROR {
+			errors += 1
+		}
+	}
+
+	fmt.Printf("%d errors, %d warnings\n", errors, len(findings)-errors)
+
+	if errors > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// runExperiment runs an experiment file, the flags that are set override
+// its seed, max rounds and scripts, and returns the exit code
+func runExperiment(path, out, summary string, workers int, opts pkg.Options, set map[string]bool) int {
+	x, err := pkg.ReadExperiment(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		return 1
+	}
+
+	if set["seed"] {
+		x.Seed = opts.Seed
+	}
+
+	if set["max-rounds"] {
+		x.MaxRounds = opts.MaxRounds
+	}
+
+	if set["scripts"] {
+		x.ScriptsDir = opts.ScriptsDir
+	}
+
+	if workers > 0 {
+		x.Workers = workers
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		return 1
+	}
+	defer f.Close()
+
+	results, err := x.Run(f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		return 1
+	}
+
+	w := os.Stdout
+	if summary != "" {
+		if w, err = os.Create(summary); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+
+			return 1
+		}
+		defer w.Close()
+	}
+
+	if err := x.WriteSummary(w, results); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		return 1
+	}
+
+	return 0
 }
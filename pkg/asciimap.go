@@ -0,0 +1,227 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An ASCII map is a text drawing of the world: every line is a row of the
+// grid, every character other than a space is a cell. On hex the even rows
+// are indented by one space, as they are shifted right on the screen, the
+// spaces are only for the eye. An optional legend follows a "---" line, with
+// "x = STATE" lines mapping characters to state names or numbers and an
+// "origin = row,column" line giving the cell of the first character.
+
+// asciiMapSeparator separates the drawing from the legend
+const asciiMapSeparator = "---"
+
+// defaultASCIILegend maps the characters that need no legend
+var defaultASCIILegend = map[rune]State{
+	'.': VOID,
+	'o': CONTRACTED,
+	'#': OBSTACLE,
+}
+
+// ParseASCIIMap reads an ASCII map into the init_state format: the states by
+// "row,column", the void cells included
+func ParseASCIIMap(r io.Reader, geometry Geometry) (map[string]interface{}, error) {
+	legend := make(map[rune]State, len(defaultASCIILegend))
+	for c, state := range defaultASCIILegend {
+		legend[c] = state
+	}
+
+	drawing := make([]string, 0)
+	origin := cell{0, 0}
+	inLegend := false
+	parser := &Particle{geometry: geometry}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+
+		if strings.TrimSpace(line) == asciiMapSeparator {
+			inLegend = true
+
+			continue
+		}
+
+		if !inLegend {
+			drawing = append(drawing, line)
+
+			continue
+		}
+
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: '%s' is not a legend entry", n, line)
+		}
+
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		if key == "origin" {
+			row, column, err := parseCellKey(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+
+			origin = cell{row, column}
+
+			continue
+		}
+
+		if len([]rune(key)) != 1 {
+			return nil, fmt.Errorf("line %d: '%s' is not a single character", n, key)
+		}
+
+		if number, err := strconv.Atoi(value); err == nil {
+			if err := parser.SetStateN(number); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+		} else if parser.state, err = parser.parseState(value); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		legend[[]rune(key)[0]] = parser.state
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]interface{})
+
+	for i, line := range drawing {
+		column := origin.column
+
+		for _, c := range line {
+			if c == ' ' || c == '\t' {
+				continue
+			}
+
+			state, ok := legend[c]
+			if !ok {
+				return nil, fmt.Errorf("line %d: '%c' is not in the legend", i+1, c)
+			}
+
+			res[fmt.Sprintf("%d,%d", origin.row+i, column)] = int64(state)
+			column += 1
+		}
+	}
+
+	return res, nil
+}
+
+// ReadASCIIMap reads an ASCII map file
+func ReadASCIIMap(path string, geometry Geometry) (map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	state, err := ParseASCIIMap(f, geometry)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return state, nil
+}
+
+// WriteASCIIMap draws the world as an ASCII map, the states without a default
+// character get a letter in the legend
+func (e *Engine) WriteASCIIMap(w io.Writer) error {
+	first, last := e.world.Bounds()
+	if e.world.Len() == 0 && !e.world.Bounded() {
+		last = first
+	}
+
+	chars := make(map[State]rune, len(defaultASCIILegend))
+	for c, state := range defaultASCIILegend {
+		chars[state] = c
+	}
+
+	letters := []rune("abcdefghijklmnpqrstuvwxyzABCDEFGHIJKLMNPQRSTUVWXYZ")
+	extra := make([]State, 0)
+
+	var b strings.Builder
+
+	for row := first.row; row <= last.row; row++ {
+		if e.geometry.Name() == "hex" && mod(row, 2) == 0 {
+			b.WriteString(" ")
+		}
+
+		for column := first.column; column <= last.column; column++ {
+			state := VOID
+			if p := e.particleAt(row, column); p != nil {
+				state = p.state
+			}
+
+			c, ok := chars[state]
+			if !ok {
+				if len(extra) == len(letters) {
+					return fmt.Errorf("too many states for an ASCII map")
+				}
+
+				c = letters[len(extra)]
+				chars[state] = c
+				extra = append(extra, state)
+			}
+
+			if column > first.column {
+				b.WriteString(" ")
+			}
+
+			b.WriteRune(c)
+		}
+
+		b.WriteString("\n")
+	}
+
+	b.WriteString(asciiMapSeparator + "\n")
+	b.WriteString(fmt.Sprintf("origin = %d,%d\n", first.row, first.column))
+
+	sort.Slice(extra, func(i, j int) bool { return chars[extra[i]] < chars[extra[j]] })
+
+	namer := &Particle{geometry: e.geometry}
+	for _, state := range extra {
+		s := state
+		b.WriteString(fmt.Sprintf("%c = %s\n", chars[state], namer.GetStateS(&s)))
+	}
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+// ExportASCIIMap writes the world to a new timestamped map file in dir and
+// returns its path
+func (e *Engine) ExportASCIIMap(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("export-%s.txt", time.Now().Format("20060102-150405")))
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := e.WriteASCIIMap(f); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
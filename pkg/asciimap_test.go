@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseASCIIMap(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		state map[string]interface{}
+		err   string
+	}{
+		{"default legend", " o #\n. o\n", map[string]interface{}{"0,0": int64(CONTRACTED), "0,1": int64(OBSTACLE), "1,0": int64(VOID), "1,1": int64(CONTRACTED)}, ""},
+		{"legend and origin", "a b\n---\norigin = -2,3\na = EXPANDR\nb = 9\n", map[string]interface{}{"-2,3": int64(EXPANDR), "-2,4": int64(MOVER)}, ""},
+		{"unknown character", "o x\n", nil, "'x' is not in the legend"},
+		{"bad legend entry", "o\n---\nx EXPANDR\n", nil, "is not a legend entry"},
+		{"bad origin", "o\n---\norigin = 1\n", nil, "line 3"},
+		{"long key", "o\n---\nxy = EXPANDR\n", nil, "is not a single character"},
+		{"bad state", "o\n---\nx = JUMPING\n", nil, "line 3"},
+	}
+
+	for _, tt := range tests {
+		state, err := ParseASCIIMap(strings.NewReader(tt.text), HexGeometry{})
+
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got %v, want an error with '%s'", tt.name, err, tt.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+
+			continue
+		}
+
+		if !sameState(state, tt.state) {
+			t.Errorf("%s: got %v, want %v", tt.name, state, tt.state)
+		}
+	}
+}
+
+func TestASCIIMapRoundTrip(t *testing.T) {
+	state := map[string]interface{}{
+		"1,1": int64(CONTRACTED),
+		"1,2": int64(CONTRACTED),
+		"2,1": int64(OBSTACLE),
+		"3,3": int64(EXPANDUR),
+		"4,0": int64(MOVEL),
+	}
+
+	worlds := []WorldConfig{
+		{Rows: 6, Cols: 5, Boundary: WALL, Geometry: HexGeometry{}},
+		{Rows: 6, Cols: 5, Boundary: WALL, Geometry: SquareGeometry{}},
+		// The drawing of a growing world starts at its first particle
+		{Boundary: GROW, Geometry: HexGeometry{}},
+	}
+
+	for _, world := range worlds {
+		e := &Engine{}
+		e.SetScriptsDir(filepath.Join("..", "scripts"))
+
+		if err := e.LoadScripts(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := e.Init(world); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := e.Bootstrap(&InitialConfig{State: state}); err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if err := e.WriteASCIIMap(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		imported, err := ParseASCIIMap(&b, world.Geometry)
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", world.Geometry.Name(), err, b.String())
+		}
+
+		// The void cells are drawn too
+		for key, val := range imported {
+			if val == int64(VOID) {
+				delete(imported, key)
+			}
+		}
+
+		if !sameState(imported, state) {
+			t.Errorf("%s: got %v, want %v", world.Geometry.Name(), imported, state)
+		}
+	}
+}
+
+// sameState compares two init_state maps
+func sameState(a, b map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for key, val := range a {
+		if b[key] != val {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,278 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BondMode is how a move deals with the bonds of the moving particle
+type BondMode int
+
+const (
+	// BLOCK fails the moves that would stretch a bond
+	BLOCK BondMode = iota
+	// DRAG moves the whole bonded group along with the particle
+	DRAG
+)
+
+func ParseBondMode(s string) (BondMode, error) {
+	switch strings.ToLower(s) {
+	case "", "block":
+		return BLOCK, nil
+	case "drag":
+		return DRAG, nil
+	}
+
+	return -1, fmt.Errorf("'%s' is not a valid bond mode", s)
+}
+
+func (m BondMode) String() string {
+	return [...]string{"block", "drag"}[m]
+}
+
+// bond links two particles, the bonds are undirected
+func (e *Engine) bond(a, b *Particle) {
+	if a == b {
+		return
+	}
+
+	e.bondMu.Lock()
+	defer e.bondMu.Unlock()
+
+	for _, pair := range [][2]int{{a.id, b.id}, {b.id, a.id}} {
+		if e.edges[pair[0]] == nil {
+			e.edges[pair[0]] = make(map[int]bool)
+		}
+
+		e.edges[pair[0]][pair[1]] = true
+	}
+}
+
+// unbond breaks the bond between two particles, if any
+func (e *Engine) unbond(a, b *Particle) {
+	e.bondMu.Lock()
+	defer e.bondMu.Unlock()
+
+	delete(e.edges[a.id], b.id)
+	delete(e.edges[b.id], a.id)
+
+	if len(e.edges[a.id]) == 0 {
+		delete(e.edges, a.id)
+	}
+
+	if len(e.edges[b.id]) == 0 {
+		delete(e.edges, b.id)
+	}
+}
+
+func (e *Engine) bonded(a, b *Particle) bool {
+	e.bondMu.RLock()
+	defer e.bondMu.RUnlock()
+
+	return e.edges[a.id][b.id]
+}
+
+// bondedNeighbors returns the N1 cells of [row, column] holding a particle
+// bonded to the one in [row, column]
+func (e *Engine) bondedNeighbors(row, column int) []cell {
+	p := e.particleAt(row, column)
+	res := make([]cell, 0)
+
+	if p == nil {
+		return res
+	}
+
+	for _, c := range e.n1Cells(row, column) {
+		if n := e.world.At(c); n != nil && e.bonded(p, n) {
+			res = append(res, c)
+		}
+	}
+
+	return res
+}
+
+// bondedGroup returns the cells of the particles reachable from [row, column]
+// through the bonds, [row, column] first
+func (e *Engine) bondedGroup(row, column int) []cell {
+	group := []cell{{row, column}}
+	seen := map[cell]bool{{row, column}: true}
+
+	for i := 0; i < len(group); i++ {
+		for _, n := range e.bondedNeighbors(group[i].row, group[i].column) {
+			if !seen[n] {
+				seen[n] = true
+				group = append(group, n)
+			}
+		}
+	}
+
+	return group
+}
+
+// updateBonds applies the bond and unbond outputs of a particle, given as
+// directions in its local frame. Only the particles in N1 can be bonded.
+func (e *Engine) updateBonds(row, column int) {
+	curParticle := e.particleAt(row, column)
+	directions := e.geometry.Directions()
+	cells := e.n1Cells(row, column)
+
+	neighborOf := func(name interface{}) *Particle {
+		for local, d := range directions {
+			if d == fmt.Sprintf("%v", name) {
+				if n := e.world.At(cells[curParticle.globalDirection(local)]); n != nil && n.state != OBSTACLE {
+					return n
+				}
+			}
+		}
+
+		return nil
+	}
+
+	for _, name := range curParticle.unbondOut {
+		if n := neighborOf(name); n != nil {
+			e.unbond(curParticle, n)
+		}
+	}
+
+	for _, name := range curParticle.bondOut {
+		if n := neighborOf(name); n != nil {
+			e.bond(curParticle, n)
+		}
+	}
+
+	curParticle.bondOut, curParticle.unbondOut = nil, nil
+}
+
+// getN1Bonds returns which N1 neighbors of a particle are bonded to it, in its local frame
+func (e *Engine) getN1Bonds(row, column int, p *Particle) []bool {
+	bonds := make([]bool, 0, maxDirections)
+
+	for _, c := range e.viewN1Cells(row, column, p) {
+		n := e.world.At(c)
+		bonds = append(bonds, n != nil && e.bonded(p, n))
+	}
+
+	return bonds
+}
+
+// moveBonded moves the particle at [row, column] to [newRow, newCol] keeping
+// its bonds, it returns false if the move has to fail. In the block mode the
+// bonded neighbors have to be N1 neighbors of the target too, in the drag
+// mode the whole group moves in the same direction when all its target cells
+// are free and its other particles are not active.
+func (e *Engine) moveBonded(row, column, newRow, newCol int, d int) bool {
+	bonded := e.bondedNeighbors(row, column)
+
+	if len(bonded) == 0 {
+		e.world.Move(cell{row, column}, cell{newRow, newCol})
+
+		return true
+	}
+
+	if e.bondMode == BLOCK {
+		adjacent := make(map[cell]bool)
+		for _, c := range e.n1Cells(newRow, newCol) {
+			adjacent[c] = true
+		}
+
+		for _, c := range bonded {
+			if !adjacent[c] {
+				return false
+			}
+		}
+
+		e.world.Move(cell{row, column}, cell{newRow, newCol})
+
+		return true
+	}
+
+	// The async tasks and the Poisson clocks refer to the particles by cell,
+	// no active particle can be dragged away
+	e.asyncMu.Lock()
+	defer e.asyncMu.Unlock()
+
+	group := e.bondedGroup(row, column)
+	members := make(map[cell]bool, len(group))
+
+	for _, c := range group {
+		members[c] = true
+	}
+
+	targets := make([]cell, len(group))
+	particles := make([]*Particle, len(group))
+
+	for i, c := range group {
+		particles[i] = e.world.At(c)
+
+		if i > 0 && (particles[i].awoken || particles[i].iState == AWAKE || particles[i].state == OBSTACLE) {
+			return false
+		}
+
+		tRow, tCol := e.geometry.Neighbor(c.row, c.column, d)
+		targets[i] = e.wrap(cell{tRow, tCol})
+
+		if !members[targets[i]] && e.getSafeState(targets[i].row, targets[i].column) != VOID {
+			return false
+		}
+	}
+
+	for _, c := range group {
+		e.world.Put(c, nil)
+	}
+
+	for i, c := range targets {
+		e.world.Put(c, particles[i])
+
+		if i > 0 {
+			e.markDragged(particles[i], c)
+			e.cellChanged(group[i].row, group[i].column)
+			e.cellChanged(c.row, c.column)
+		}
+	}
+
+	for _, c := range targets[1:] {
+		e.fallInHole(c.row, c.column)
+	}
+
+	// A group translated on a lattice without translational symmetry, like
+	// the triangles, can end up stretched: the stretched bonds break
+	for i, c := range targets {
+		adjacent := make(map[cell]bool)
+		for _, n := range e.n1Cells(c.row, c.column) {
+			adjacent[n] = true
+		}
+
+		for j, other := range targets {
+			if i != j && !adjacent[other] && e.bonded(particles[i], particles[j]) {
+				e.unbond(particles[i], particles[j])
+			}
+		}
+	}
+
+	return true
+}
+
+// markDragged records the new cell of a particle dragged by a bond, for the
+// Poisson clocks that keep the particles by cell. The other schedulers find
+// the particles again in the world.
+func (e *Engine) markDragged(p *Particle, c cell) {
+	if e.schedulerType != POISSON {
+		return
+	}
+
+	e.bondMu.Lock()
+	defer e.bondMu.Unlock()
+
+	e.dragged[p] = c
+}
+
+// draggedTo returns the cell a particle was dragged to since the last call
+func (e *Engine) draggedTo(p *Particle) (cell, bool) {
+	e.bondMu.Lock()
+	defer e.bondMu.Unlock()
+
+	c, ok := e.dragged[p]
+	delete(e.dragged, p)
+
+	return c, ok
+}
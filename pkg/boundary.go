@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Boundary int
+
+const (
+	WALL Boundary = iota
+	TORUS
+	GROW
+)
+
+func ParseBoundary(s string) (Boundary, error) {
+	switch strings.ToLower(s) {
+	case "", "wall":
+		return WALL, nil
+	case "torus":
+		return TORUS, nil
+	case "grow":
+		return GROW, nil
+	}
+
+	return -1, fmt.Errorf("'%s' is not a valid boundary", s)
+}
+
+func (b Boundary) String() string {
+	return [...]string{"wall", "torus", "grow"}[b]
+}
+
+// checkBoundary validates the world size against the boundary mode
+func checkBoundary(config WorldConfig) error {
+	switch config.Boundary {
+	case WALL:
+		if config.Rows <= 0 || config.Cols <= 0 {
+			return fmt.Errorf("a walled world needs a size, got %dx%d", config.Rows, config.Cols)
+		}
+	case TORUS:
+		if config.Rows <= 0 || config.Cols <= 0 {
+			return fmt.Errorf("a toroidal world needs a size, got %dx%d", config.Rows, config.Cols)
+		}
+
+		return config.Geometry.CheckTorus(config.Rows, config.Cols)
+	}
+
+	return nil
+}
+
+// wrap maps a cell to the world: on a torus the coordinates wrap around,
+// with the other boundaries the cell is unchanged.
+func (e *Engine) wrap(c cell) cell {
+	if e.worldConfig.Boundary != TORUS {
+		return c
+	}
+
+	return cell{mod(c.row, e.worldConfig.Rows), mod(c.column, e.worldConfig.Cols)}
+}
+
+// outOfWorld is true for the cells beyond the wall, seen as obstacles
+func (e *Engine) outOfWorld(row, col int) bool {
+	return !e.world.Inside(e.wrap(cell{row, col}))
+}
+
+func mod(a, b int) int {
+	return ((a % b) + b) % b
+}
@@ -0,0 +1,38 @@
+package pkg
+
+import (
+	"fmt"
+
+	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/stdlib"
+)
+
+// SetQuiet turns off the trace of the engine and the prints of the scripts,
+// for the runs without a window. It applies to the scripts loaded next.
+func (e *Engine) SetQuiet(quiet bool) {
+	e.quiet = quiet
+}
+
+// debugf prints a line of the trace of the engine, unless it is quiet
+func (e *Engine) debugf(format string, a ...interface{}) {
+	if !e.quiet {
+		fmt.Printf(format, a...)
+	}
+}
+
+// quietFmtModule is the tengo fmt module with the prints turned off
+func quietFmtModule() map[string]tengo.Object {
+	module := make(map[string]tengo.Object)
+	for name, fn := range stdlib.BuiltinModules["fmt"] {
+		module[name] = fn
+	}
+
+	for _, name := range []string{"print", "printf", "println"} {
+		module[name] = &tengo.UserFunction{
+			Name:  name,
+			Value: func(args ...tengo.Object) (tengo.Object, error) { return nil, nil },
+		}
+	}
+
+	return module
+}
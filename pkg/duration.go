@@ -0,0 +1,238 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Distribution int
+
+const (
+	FIXED Distribution = iota
+	UNIFORM
+	EXPONENTIAL
+	NORMAL
+)
+
+// PhaseDuration is the distribution of the duration of an async phase, in milliseconds
+type PhaseDuration struct {
+	dist   Distribution
+	value  float64
+	min    float64
+	max    float64
+	mean   float64
+	stddev float64
+}
+
+// SpeedClass multiplies the phase durations of a share of the particles
+type SpeedClass struct {
+	Factor float64
+	Share  float64
+}
+
+// UniformDuration is a duration drawn uniformly between 0 and max milliseconds
+func UniformDuration(max int) PhaseDuration {
+	return PhaseDuration{dist: UNIFORM, min: 0, max: float64(max)}
+}
+
+func mapFloat(m map[string]interface{}, key string, def float64) (float64, error) {
+	val, ok := m[key]
+	if !ok {
+		return def, nil
+	}
+
+	return toFloat(val)
+}
+
+// ParsePhaseDuration reads a phase duration from the init script. A number is
+// the max of a uniform duration, otherwise a map describes the distribution:
+//
+//	{"dist": "fixed", "value": 100}
+//	{"dist": "uniform", "min": 50, "max": 150}
+//	{"dist": "exponential", "mean": 100}
+//	{"dist": "normal", "mean": 100, "stddev": 20, "min": 0, "max": 300}
+func ParsePhaseDuration(val interface{}) (PhaseDuration, error) {
+	if max, err := toFloat(val); err == nil {
+		if max < 0 {
+			return PhaseDuration{}, fmt.Errorf("max %f is negative", max)
+		}
+
+		return PhaseDuration{dist: UNIFORM, min: 0, max: max}, nil
+	}
+
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return PhaseDuration{}, fmt.Errorf("%v is not a valid phase duration", val)
+	}
+
+	distName, _ := m["dist"].(string)
+	d := PhaseDuration{}
+
+	var err error
+
+	switch strings.ToLower(distName) {
+	case "fixed":
+		d.dist = FIXED
+		d.value, err = mapFloat(m, "value", 0)
+	case "uniform":
+		d.dist = UNIFORM
+		if d.min, err = mapFloat(m, "min", 0); err == nil {
+			d.max, err = mapFloat(m, "max", d.min)
+		}
+	case "exponential":
+		d.dist = EXPONENTIAL
+		d.mean, err = mapFloat(m, "mean", 0)
+	case "normal":
+		d.dist = NORMAL
+		if d.mean, err = mapFloat(m, "mean", 0); err != nil {
+			break
+		}
+
+		if d.stddev, err = mapFloat(m, "stddev", 0); err != nil {
+			break
+		}
+
+		if d.min, err = mapFloat(m, "min", 0); err != nil {
+			break
+		}
+
+		d.max, err = mapFloat(m, "max", math.Inf(1))
+	default:
+		return PhaseDuration{}, fmt.Errorf("'%s' is not a valid distribution", distName)
+	}
+
+	if err != nil {
+		return PhaseDuration{}, err
+	}
+
+	if d.value < 0 || d.min < 0 || d.max < 0 || d.mean < 0 || d.stddev < 0 {
+		return PhaseDuration{}, fmt.Errorf("%v has a negative duration", val)
+	}
+
+	if d.min > d.max {
+		return PhaseDuration{}, fmt.Errorf("min %f is greater than max %f", d.min, d.max)
+	}
+
+	return d, nil
+}
+
+// Value returns the phase duration in the format of ParsePhaseDuration
+func (d PhaseDuration) Value() interface{} {
+	switch d.dist {
+	case FIXED:
+		return map[string]interface{}{"dist": "fixed", "value": d.value}
+	case UNIFORM:
+		return map[string]interface{}{"dist": "uniform", "min": d.min, "max": d.max}
+	case EXPONENTIAL:
+		return map[string]interface{}{"dist": "exponential", "mean": d.mean}
+	}
+
+	res := map[string]interface{}{"dist": "normal", "mean": d.mean, "stddev": d.stddev, "min": d.min}
+	if !math.IsInf(d.max, 1) {
+		res["max"] = d.max
+	}
+
+	return res
+}
+
+// Sample draws a duration in milliseconds
+func (d PhaseDuration) Sample(rng *rand.Rand) float64 {
+	switch d.dist {
+	case FIXED:
+		return d.value
+	case UNIFORM:
+		return d.min + rng.Float64()*(d.max-d.min)
+	case EXPONENTIAL:
+		return rng.ExpFloat64() * d.mean
+	case NORMAL:
+		return math.Min(math.Max(rng.NormFloat64()*d.stddev+d.mean, d.min), d.max)
+	}
+
+	return 0
+}
+
+// ParseSpeedClasses reads the speed classes from the init script, e.g.
+//
+//	{"slow": {"factor": 4.0, "share": 0.2}}
+func ParseSpeedClasses(classes map[string]interface{}) (map[string]SpeedClass, error) {
+	res := make(map[string]SpeedClass)
+	total := 0.0
+
+	for name, val := range classes {
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("speed class '%s' is not a map", name)
+		}
+
+		factor, err := mapFloat(m, "factor", 1)
+		if err != nil {
+			return nil, err
+		}
+
+		share, err := mapFloat(m, "share", 0)
+		if err != nil {
+			return nil, err
+		}
+
+		if factor <= 0 {
+			return nil, fmt.Errorf("speed class '%s' has a non positive factor", name)
+		}
+
+		if share < 0 {
+			return nil, fmt.Errorf("speed class '%s' has a negative share", name)
+		}
+
+		total += share
+		res[name] = SpeedClass{factor, share}
+	}
+
+	// The particles left out of the shares have the factor 1
+	if total > 1+1e-9 {
+		return nil, fmt.Errorf("the shares of the speed classes sum to %f, more than 1", total)
+	}
+
+	return res, nil
+}
+
+// speedOf returns the speed factor of the particle at the given key: the
+// explicit class if any, otherwise a class drawn according to the shares.
+func (e *Engine) speedOf(key string) (float64, error) {
+	if className, ok := e.speedClassOf[key]; ok {
+		class, ok := e.speedClasses[fmt.Sprintf("%v", className)]
+		if !ok {
+			return 1, fmt.Errorf("speed class '%v' of particle %s is not defined", className, key)
+		}
+
+		return class.Factor, nil
+	}
+
+	names := make([]string, 0, len(e.speedClasses))
+	for name := range e.speedClasses {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	draw := e.rng.Float64()
+	for _, name := range names {
+		class := e.speedClasses[name]
+		if draw < class.Share {
+			return class.Factor, nil
+		}
+
+		draw -= class.Share
+	}
+
+	return 1, nil
+}
+
+// phaseDuration draws the duration of an async phase for a particle
+func (e *Engine) phaseDuration(d PhaseDuration, p *Particle) time.Duration {
+	ms := d.Sample(e.rng) * p.speed
+
+	return time.Duration(ms * float64(time.Millisecond))
+}
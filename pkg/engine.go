@@ -5,14 +5,13 @@ import (
 	"io/ioutil"
 	"math"
 	"math/rand"
-	"path"
-	"strconv"
+	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/d5/tengo/v2"
-	"github.com/d5/tengo/v2/stdlib"
 )
 
 type Phases int
@@ -29,20 +28,45 @@ type Scheduler int
 const (
 	SYNC Scheduler = iota
 	ASYNC
+	POISSON
 )
 
+// asyncResult is the end of the async task of the particle at [row, column],
+// err is set if the task failed
 type asyncResult struct {
 	row, column int
+	err         error
 }
 
+// asyncResultsBuffer is the size of the async results queue, whatever the
+// size of the world: the tasks wait for the controller when it is full
+const asyncResultsBuffer = 4096
+
 type Engine struct {
 	phase                          Phases
 	schedulerType                  Scheduler
 	schedulerEventDriven           bool
 	schedulerEventDrivenWithBlocks bool
 	schedulerRes                   []interface{}
-	grid                           [][]*Particle
+	world                          world
+	worldConfig                    WorldConfig
+	geometry                       Geometry
+	visibilityRadius               int
+	randomOrientation              bool
+	randomChirality                bool
 	edges                          map[int]map[int]bool
+	bondMode                       BondMode
+	bondMu                         sync.RWMutex
+	dragged                        map[*Particle]cell
+	nextID                         int
+	terrain                        map[cell]Terrain
+	terrainSlowFactor              float64
+	terrainStickiness              float64
+	lostMu                         sync.Mutex
+	lostParticles                  int
+	movesMu                        sync.Mutex
+	moves                          int
+	failedMoves                    int
 	initScript                     *tengo.Compiled
 	schedulerScript                *tengo.Script
 	particleScript                 []*tengo.Script
@@ -51,16 +75,96 @@ type Engine struct {
 	running                        bool
 	asyncLoopRunning               bool
 	asyncResults                   chan asyncResult
-	asyncInitPhase                 int
-	asyncLookPhase                 int
-	asyncComputePhase              int
-	asyncMovePhase                 int
+	asyncInitPhase                 PhaseDuration
+	asyncLookPhase                 PhaseDuration
+	asyncComputePhase              PhaseDuration
+	asyncMovePhase                 PhaseDuration
+	speedClasses                   map[string]SpeedClass
+	speedClassOf                   map[string]interface{}
 	asyncMu                        sync.RWMutex
-	asyncGridAwoken                [][]bool
+	poissonRate                    float64
+	poissonRates                   map[string]interface{}
+	poissonTimeStep                float64
+	poissonQueue                   activationQueue
+	poissonReady                   bool
+	virtualTime                    float64
+	schedulerTriggers              []Trigger
+	triggerScript                  *tengo.Script
+	environmentScript              *tengo.Script
+	environmentRound               int
+	scenario                       *Scenario
+	seed                           int64
+	rng                            *rand.Rand
+	genRng                         *rand.Rand
+	imagePalette                   Palette
+	hexSize                        int
+	scriptsDir                     string
+	scenarioPath                   string
+	seedOverride                   *int64
+	maxRounds                      int
+	trace                          *tracer
+	graphRecorder                  *graphRecorder
+	stopReason                     string
+	stopRound                      int
+	stopChangeSeq                  uint64
+	idleRounds                     int
+	triggerMu                      sync.Mutex
+	touchedCells                   map[cell]bool
+	lightCells                     map[cell]bool
+	messageCells                   map[cell]bool
+	moveVisibility                 MoveVisibility
+	staleMu                        sync.Mutex
+	changeSeq                      uint64
+	cellVersions                   map[cell]uint64
+	staleLog                       string
+	staleFile                      *os.File
+	staleActivations               int
+	err                            error
+	quiet                          bool
+	asyncTasks                     sync.WaitGroup
+	stepping                       bool
+	updateMu                       sync.Mutex
+	stepQueue                      []interface{}
 }
 
-func (e *Engine) Init(numRows, numCols int) error {
+// Init creates an empty world, the previous one is stopped first
+func (e *Engine) Init(config WorldConfig) error {
+	// The update in progress and the async tasks of the previous world end
+	// before it is replaced, they refer to its particles by cell
+	e.Stop()
+	e.updateMu.Lock()
+	e.asyncTasks.Wait()
+	e.updateMu.Unlock()
+
+	// The seed is picked with the initial state
+	if e.seed == 0 {
+		e.pickSeed()
+	}
+
+	e.rng = newLockedRand(e.seed)
+	e.stopReason = ""
+	e.err = nil
+	e.stopRound = 0
+	e.stopChangeSeq = 0
+	e.idleRounds = 0
 	e.phase = SCHEDULER
+	e.poissonRate = 1.0
+	e.poissonRates = make(map[string]interface{})
+	e.poissonTimeStep = 1.0
+	e.poissonQueue = nil
+	e.poissonReady = false
+	e.virtualTime = 0
+	e.schedulerTriggers = make([]Trigger, 0)
+	e.touchedCells = make(map[cell]bool)
+	e.lightCells = make(map[cell]bool)
+	e.messageCells = make(map[cell]bool)
+	e.moveVisibility = ATOMIC
+	e.changeSeq = 0
+	e.cellVersions = make(map[cell]uint64)
+	e.closeStaleLog()
+	e.staleLog = ""
+	e.staleActivations = 0
+	e.stepQueue = nil
 
 	// Trigger the scheduler to read the scheduler type and update it
 	if _, err := e.Scheduler([]interface{}{}, []interface{}{}); err != nil {
@@ -68,29 +172,40 @@ func (e *Engine) Init(numRows, numCols int) error {
 	}
 
 	e.schedulerRes = make([]interface{}, 0)
-	e.grid = make([][]*Particle, numRows)
-	e.asyncGridAwoken = make([][]bool, numRows)
-	e.edges = make(map[int]map[int]bool)
-	e.asyncInitPhase = 1000    // max time to wait = 1000 milliseconds
-	e.asyncLookPhase = 1000    // max time to wait = 1000 milliseconds
-	e.asyncComputePhase = 1000 // max time to wait = 1000 milliseconds
-	e.asyncMovePhase = 1000    // max time to wait = 1000 milliseconds
-
-	for i := range e.grid {
-		e.grid[i] = make([]*Particle, numCols)
-		e.asyncGridAwoken[i] = make([]bool, numCols)
+	if config.Geometry == nil {
+		config.Geometry = HexGeometry{}
 	}
 
-	for row, columns := range e.grid {
-		for column := range columns {
-			newParticle := Particle{}
-			newParticle.Init()
-			e.grid[row][column] = &newParticle
-		}
+	e.worldConfig = config
+	e.geometry = config.Geometry
+	e.edges = make(map[int]map[int]bool)
+	e.bondMode = BLOCK
+	e.dragged = make(map[*Particle]cell)
+	e.nextID = 0
+	e.terrain = make(map[cell]Terrain)
+	e.terrainSlowFactor = 2.0
+	e.terrainStickiness = 0.5
+	e.lostParticles = 0
+	e.moves = 0
+	e.failedMoves = 0
+	e.environmentRound = 0
+	e.asyncInitPhase = UniformDuration(1000)    // max time to wait = 1000 milliseconds
+	e.asyncLookPhase = UniformDuration(1000)    // max time to wait = 1000 milliseconds
+	e.asyncComputePhase = UniformDuration(1000) // max time to wait = 1000 milliseconds
+	e.asyncMovePhase = UniformDuration(1000)    // max time to wait = 1000 milliseconds
+	e.speedClasses = make(map[string]SpeedClass)
+	e.speedClassOf = make(map[string]interface{})
+	e.visibilityRadius = 0
+
+	world, err := newWorld(config)
+	if err != nil {
+		return err
 	}
 
+	e.world = world
+
 	if !e.asyncLoopRunning {
-		e.asyncResults = make(chan asyncResult, numRows*numCols)
+		e.asyncResults = make(chan asyncResult, asyncResultsBuffer)
 		go e.asyncUpdateController()
 		e.asyncLoopRunning = true
 	}
@@ -106,37 +221,129 @@ func (e *Engine) SetAsyncSheduler() {
 	e.schedulerType = ASYNC
 }
 
-func (e *Engine) Bootstrap(initialState map[string]interface{}, ppWakeup int, ppLook int, ppCompute int, ppMove int) error {
-	e.asyncInitPhase = ppWakeup
-	e.asyncLookPhase = ppLook
-	e.asyncMovePhase = ppCompute
-	e.asyncComputePhase = ppMove
+func (e *Engine) SetPoissonSheduler() {
+	e.schedulerType = POISSON
+}
+
+func (e *Engine) Bootstrap(config *InitialConfig) error {
+	e.asyncInitPhase = config.PhaseWakeup
+	e.asyncLookPhase = config.PhaseLook
+	e.asyncComputePhase = config.PhaseCompute
+	e.asyncMovePhase = config.PhaseMove
+	e.speedClasses = config.SpeedClasses
+	e.speedClassOf = config.SpeedClassOf
+	e.visibilityRadius = config.VisibilityRadius
+	e.randomOrientation = config.RandomOrientation
+	e.randomChirality = config.RandomChirality
+	e.bondMode = config.BondMode
+	e.terrainSlowFactor = config.TerrainSlowFactor
+	e.terrainStickiness = config.TerrainStickiness
+	e.imagePalette = config.ImagePalette
+	e.hexSize = config.HexSize
+
+	for c, terrain := range config.Terrain {
+		if !e.inGrid(c) {
+			return fmt.Errorf("terrain cell %d,%d is outside the world", c.row, c.column)
+		}
+
+		e.terrain[c] = terrain
+	}
 
-	for key, val := range initialState {
-		parts := strings.Split(key, ",")
+	// Sorted keys give a deterministic order of the particles in the world
+	keys := make([]string, 0, len(config.State))
+	for key := range config.State {
+		keys = append(keys, key)
+	}
 
-		x, err := strconv.ParseInt(parts[0], 10, 0)
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		row, column, err := parseCellKey(key)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("init_state: %w", err)
 		}
 
-		y, err := strconv.ParseInt(parts[1], 10, 0)
-		if err != nil {
-			panic(err)
+		val, ok := config.State[key].(int64)
+		if !ok {
+			return fmt.Errorf("init_state %s: '%v' is not a state number", key, config.State[key])
+		}
+
+		c := cell{row, column}
+		if !e.inGrid(c) {
+			return fmt.Errorf("cell %s is outside the world", key)
 		}
 
-		err = e.grid[x][y].SetStateN(int(val.(int64)))
+		if terrain := e.terrain[c]; terrain == SOLID || terrain == HOLE {
+			if val != int64(VOID) {
+				return fmt.Errorf("cell %s is a %s and cannot hold a particle", key, terrain)
+			}
+		}
+
+		if val == int64(VOID) {
+			e.world.Put(c, nil)
+
+			continue
+		}
+
+		particle, err := e.newParticle(key, c, int(val))
 		if err != nil {
-			panic(err)
+			return err
 		}
 
-		e.grid[x][y].iState = SLEEP
-		e.grid[x][y].moveFailed = false
-		e.grid[x][y].nextState = VOID
-		e.grid[x][y].round = 0
+		e.world.Put(c, particle)
+		e.markTouched(c.row, c.column)
 	}
 
-	return nil
+	return e.restoreParticles(config.Particles)
+}
+
+// newParticle creates a sleeping particle for the cell of the given key,
+// with the rate, the speed and the orientation of the configuration
+func (e *Engine) newParticle(key string, c cell, stateN int) (*Particle, error) {
+	particle := (&Particle{}).Init()
+	particle.geometry = e.geometry
+
+	if err := particle.SetStateN(stateN); err != nil {
+		return nil, err
+	}
+
+	if d, ok := stateDirection(particle.state); ok && d >= len(e.geometry.Directions()) {
+		return nil, fmt.Errorf("state %d of cell %s has no direction in the %s geometry", stateN, key, e.geometry.Name())
+	}
+
+	particle.id = e.nextID
+	e.nextID += 1
+	particle.iState = SLEEP
+	particle.moveFailed = false
+	particle.nextState = VOID
+	particle.round = 0
+	particle.rate = e.poissonRate
+	particle.light = ""
+	particle.nextLight = ""
+
+	var err error
+
+	if rate, ok := e.poissonRates[key]; ok {
+		if particle.rate, err = toFloat(rate); err != nil {
+			return nil, err
+		}
+	}
+
+	if particle.speed, err = e.speedOf(key); err != nil {
+		return nil, err
+	}
+
+	if e.randomOrientation {
+		particle.rotation = e.rng.Intn(len(e.geometry.Directions()))
+	}
+
+	if e.randomChirality {
+		particle.mirror = e.rng.Intn(2) == 1
+	}
+
+	particle.frame = e.frameOf(c.row, c.column, particle)
+
+	return particle, nil
 }
 
 func (e *Engine) IsRunning() bool {
@@ -151,6 +358,7 @@ func (e *Engine) Start() {
 	defer e.asyncMu.Unlock()
 
 	e.running = true
+	e.stepQueue = nil
 }
 
 func (e *Engine) Stop() {
@@ -160,26 +368,52 @@ func (e *Engine) Stop() {
 	e.running = false
 }
 
+// fail stops the run on an error of the engine, the first one is kept
+func (e *Engine) fail(err error) {
+	e.asyncMu.Lock()
+	defer e.asyncMu.Unlock()
+
+	if e.err == nil {
+		e.err = err
+		e.stopReason = fmt.Sprintf("error: %s", err)
+	}
+
+	e.running = false
+}
+
+// Err returns the error that stopped the run, nil if there was none
+func (e *Engine) Err() error {
+	e.asyncMu.RLock()
+	defer e.asyncMu.RUnlock()
+
+	return e.err
+}
+
 func (e *Engine) LoadScripts() error {
 	e.particleScript = make([]*tengo.Script, 0)
 	e.particleScriptNames = make([]string, 0)
 
-	// Load tengo modules
-	modules := stdlib.GetModuleMap(stdlib.AllModuleNames()...)
+	// Load tengo modules, rand draws from the engine generator
+	modules := e.scriptModules()
+
+	if e.scenario != nil {
+		return e.loadScenarioScripts(modules)
+	}
 
-	fData, err := ioutil.ReadFile("scripts/init.tengo")
+	fData, err := ioutil.ReadFile(e.scriptPath("init.tengo"))
 	if err != nil {
 		return err
 	}
 
 	initScript := tengo.NewScript(fData)
+	initScript.SetImports(modules)
 
 	e.initScript, err = initScript.Compile()
 	if err != nil {
 		return err
 	}
 
-	fData, err = ioutil.ReadFile("scripts/scheduler.tengo")
+	fData, err = ioutil.ReadFile(e.scriptPath("scheduler.tengo"))
 	if err != nil {
 		return err
 	}
@@ -187,14 +421,41 @@ func (e *Engine) LoadScripts() error {
 	e.schedulerScript = tengo.NewScript(fData)
 	e.schedulerScript.SetImports(modules) // Add tengo stdlib
 
-	files, err := ioutil.ReadDir("scripts/")
+	// The trigger predicate script is optional
+	e.triggerScript = nil
+
+	fData, err = ioutil.ReadFile(e.scriptPath("trigger.tengo"))
+	if err == nil {
+		e.triggerScript = tengo.NewScript(fData)
+		e.triggerScript.SetImports(modules) // Add tengo stdlib
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// The environment script is optional too
+	e.environmentScript = nil
+
+	fData, err = ioutil.ReadFile(e.scriptPath("environment.tengo"))
+	if err == nil {
+		e.environmentScript = tengo.NewScript(fData)
+		e.environmentScript.SetImports(modules) // Add tengo stdlib
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return e.loadParticleScripts(modules)
+}
+
+// loadParticleScripts loads all the particle*.tengo scripts
+func (e *Engine) loadParticleScripts(modules *tengo.ModuleMap) error {
+	files, err := ioutil.ReadDir(e.scriptPath(""))
 	if err != nil {
 		return err
 	}
 
 	for _, file := range files {
 		if !file.IsDir() && strings.HasPrefix(file.Name(), "particle") && strings.HasSuffix(file.Name(), ".tengo") {
-			fData, err := ioutil.ReadFile(path.Join("scripts", file.Name()))
+			fData, err := ioutil.ReadFile(e.scriptPath(file.Name()))
 			if err != nil {
 				return err
 			}
@@ -212,19 +473,189 @@ func (e *Engine) LoadScripts() error {
 	return nil
 }
 
-func (e *Engine) InitialState() (int, map[string]interface{}, int, int, int, int, error) {
+// InitialConfig is the configuration read from the init script
+type InitialConfig struct {
+	HexSize          int
+	World            WorldConfig
+	State            map[string]interface{}
+	PhaseWakeup      PhaseDuration
+	PhaseLook        PhaseDuration
+	PhaseCompute     PhaseDuration
+	PhaseMove        PhaseDuration
+	SpeedClasses     map[string]SpeedClass
+	SpeedClassOf     map[string]interface{}
+	VisibilityRadius int
+	// Every particle gets a random rotation and/or mirroring of its directions
+	RandomOrientation bool
+	RandomChirality   bool
+	BondMode          BondMode
+	// Terrain of the cells, the cells not in the map are floor
+	Terrain           map[cell]Terrain
+	TerrainSlowFactor float64
+	TerrainStickiness float64
+	// Colours of the PNG maps
+	ImagePalette Palette
+	// Saved state of the particles by "row,column", see Snapshot
+	Particles map[string]ParticleSnapshot
+}
+
+func (e *Engine) InitialState() (*InitialConfig, error) {
+	e.pickSeed()
+
+	if e.scenario != nil {
+		return e.scenario.initialConfig(e.genRng)
+	}
+
 	if err := e.initScript.Run(); err != nil {
-		return -1, nil, -1, -1, -1, -1, err
+		return nil, err
+	}
+
+	config := &InitialConfig{
+		HexSize: e.initScript.Get("hex_size").Int(),
+		World: WorldConfig{
+			Rows: e.initScript.Get("world_rows").Int(),
+			Cols: e.initScript.Get("world_cols").Int(),
+		},
+		State:             e.initScript.Get("init_state").Map(),
+		SpeedClasses:      make(map[string]SpeedClass),
+		SpeedClassOf:      make(map[string]interface{}),
+		Terrain:           make(map[cell]Terrain),
+		TerrainSlowFactor: 2.0,
+		TerrainStickiness: 0.5,
+	}
+
+	phases := []*PhaseDuration{&config.PhaseWakeup, &config.PhaseLook, &config.PhaseCompute, &config.PhaseMove}
+	for i, name := range []string{"particle_phase_wakeup", "particle_phase_look", "particle_phase_compute", "particle_phase_move"} {
+		phase, err := ParsePhaseDuration(e.initScript.Get(name).Value())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		*phases[i] = phase
+	}
+
+	if storage := e.initScript.Get("world_storage"); !storage.IsUndefined() {
+		worldStorage, err := ParseWorldStorage(storage.String())
+		if err != nil {
+			return nil, err
+		}
+
+		config.World.Storage = worldStorage
+	}
+
+	if geometry := e.initScript.Get("world_geometry"); !geometry.IsUndefined() {
+		worldGeometry, err := ParseGeometry(geometry.String())
+		if err != nil {
+			return nil, err
+		}
+
+		config.World.Geometry = worldGeometry
+	}
+
+	// The cells drawn in an ASCII map replace the ones of init_state
+	if mapFile := e.initScript.Get("init_map_file"); !mapFile.IsUndefined() && mapFile.String() != "" {
+		mapState, err := ReadASCIIMap(mapFile.String(), config.World.Geometry)
+		if err != nil {
+			return nil, err
+		}
+
+		for key, val := range mapState {
+			config.State[key] = val
+		}
+	}
+
+	config.ImagePalette = DefaultPalette()
+	if palette := e.initScript.Get("image_palette"); !palette.IsUndefined() {
+		imagePalette, err := ParsePalette(palette.Map(), config.World.Geometry)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ImagePalette = imagePalette
 	}
 
-	initState := e.initScript.Get("init_state")
-	hex_size := e.initScript.Get("hex_size")
-	pp_wakeup := e.initScript.Get("particle_phase_wakeup")
-	pp_look := e.initScript.Get("particle_phase_look")
-	pp_compute := e.initScript.Get("particle_phase_compute")
-	pp_move := e.initScript.Get("particle_phase_move")
+	// The cells of a PNG map replace the ones of init_state and of the ASCII map
+	if imageFile := e.initScript.Get("init_image_file"); !imageFile.IsUndefined() && imageFile.String() != "" {
+		imageState, err := ReadPNGMap(imageFile.String(), config.ImagePalette)
+		if err != nil {
+			return nil, err
+		}
+
+		for key, val := range imageState {
+			config.State[key] = val
+		}
+	}
 
-	return hex_size.Int(), initState.Map(), pp_wakeup.Int(), pp_look.Int(), pp_compute.Int(), pp_move.Int(), nil
+	if boundary := e.initScript.Get("world_boundary"); !boundary.IsUndefined() {
+		worldBoundary, err := ParseBoundary(boundary.String())
+		if err != nil {
+			return nil, err
+		}
+
+		config.World.Boundary = worldBoundary
+	}
+
+	if classes := e.initScript.Get("speed_classes"); !classes.IsUndefined() {
+		speedClasses, err := ParseSpeedClasses(classes.Map())
+		if err != nil {
+			return nil, err
+		}
+
+		config.SpeedClasses = speedClasses
+	}
+
+	if classOf := e.initScript.Get("particle_speed_class"); !classOf.IsUndefined() {
+		config.SpeedClassOf = classOf.Map()
+	}
+
+	if orientation := e.initScript.Get("random_orientation"); !orientation.IsUndefined() {
+		config.RandomOrientation = orientation.Bool()
+	}
+
+	if chirality := e.initScript.Get("random_chirality"); !chirality.IsUndefined() {
+		config.RandomChirality = chirality.Bool()
+	}
+
+	if mode := e.initScript.Get("bond_mode"); !mode.IsUndefined() {
+		bondMode, err := ParseBondMode(mode.String())
+		if err != nil {
+			return nil, err
+		}
+
+		config.BondMode = bondMode
+	}
+
+	if terrain := e.initScript.Get("terrain"); !terrain.IsUndefined() {
+		terrainMap, err := ParseTerrainMap(terrain.Map())
+		if err != nil {
+			return nil, err
+		}
+
+		config.Terrain = terrainMap
+	}
+
+	if factor := e.initScript.Get("terrain_slow_factor"); !factor.IsUndefined() {
+		config.TerrainSlowFactor = factor.Float()
+		if config.TerrainSlowFactor < 1 {
+			return nil, fmt.Errorf("terrain_slow_factor %f is less than 1", config.TerrainSlowFactor)
+		}
+	}
+
+	if stickiness := e.initScript.Get("terrain_sticky_probability"); !stickiness.IsUndefined() {
+		config.TerrainStickiness = stickiness.Float()
+		if config.TerrainStickiness < 0 || config.TerrainStickiness > 1 {
+			return nil, fmt.Errorf("terrain_sticky_probability %f is not in [0, 1]", config.TerrainStickiness)
+		}
+	}
+
+	if radius := e.initScript.Get("visibility_radius"); !radius.IsUndefined() {
+		config.VisibilityRadius = radius.Int()
+		if config.VisibilityRadius < 0 {
+			return nil, fmt.Errorf("visibility_radius %d is negative", config.VisibilityRadius)
+		}
+	}
+
+	return config, nil
 }
 
 func (e *Engine) Scheduler(particles []interface{}, states []interface{}) ([]interface{}, error) {
@@ -238,6 +669,12 @@ func (e *Engine) Scheduler(particles []interface{}, states []interface{}) ([]int
 		return nil, err
 	}
 
+	// Parameters of the scheduler, set by the scenario
+	err = e.schedulerScript.Add("params", e.schedulerParams())
+	if err != nil {
+		return nil, err
+	}
+
 	schdulerScriptCompiled, err := e.schedulerScript.Compile()
 	if err != nil {
 		return nil, err
@@ -253,11 +690,60 @@ func (e *Engine) Scheduler(particles []interface{}, states []interface{}) ([]int
 	e.schedulerEventDriven = schdulerScriptCompiled.Get("scheduler_event_driven").Bool()
 	e.schedulerEventDrivenWithBlocks = schdulerScriptCompiled.Get("scheduler_event_driven_with_blocks").Bool()
 
+	if triggers := schdulerScriptCompiled.Get("scheduler_triggers"); !triggers.IsUndefined() {
+		e.schedulerTriggers = make([]Trigger, 0)
+
+		for _, t := range triggers.Array() {
+			trigger, err := parseTrigger(fmt.Sprintf("%v", t))
+			if err != nil {
+				return nil, err
+			}
+
+			e.schedulerTriggers = append(e.schedulerTriggers, trigger)
+		}
+	}
+
+	if visibility := schdulerScriptCompiled.Get("move_visibility"); !visibility.IsUndefined() {
+		if e.moveVisibility, err = parseMoveVisibility(visibility.String()); err != nil {
+			return nil, err
+		}
+	}
+
+	if staleLog := schdulerScriptCompiled.Get("stale_log"); !staleLog.IsUndefined() {
+		e.staleLog = staleLog.String()
+	}
+
+	if rate := schdulerScriptCompiled.Get("poisson_rate"); !rate.IsUndefined() {
+		e.poissonRate = rate.Float()
+	}
+
+	if rates := schdulerScriptCompiled.Get("poisson_rates"); !rates.IsUndefined() {
+		e.poissonRates = rates.Map()
+	}
+
+	if timeStep := schdulerScriptCompiled.Get("poisson_time_step"); !timeStep.IsUndefined() {
+		e.poissonTimeStep = timeStep.Float()
+	}
+
 	switch strings.ToLower(schedulerType) {
 	case "async":
 		e.SetAsyncSheduler()
 	case "sync":
 		e.SetSyncSheduler()
+	case "poisson":
+		e.SetPoissonSheduler()
+	}
+
+	if err := e.applySchedulerOverrides(); err != nil {
+		return nil, err
+	}
+
+	if err := e.checkPoissonRates(); err != nil {
+		return nil, err
+	}
+
+	if err := e.openStaleLog(); err != nil {
+		return nil, err
 	}
 
 	return activeParticles.Array(), nil
@@ -273,247 +759,364 @@ func (e *Engine) SelectScript(i int) (string, error) {
 	return e.particleScriptNames[e.particleScriptSelected], nil
 }
 
-func (e *Engine) Particle(p *Particle, neighbors1 []string, neighbors2 []string, neighbors1Deg []int) (string, error) {
-	e.asyncMu.Lock()
+// SelectScriptByName selects the particle script with the given file name,
+// with or without the .tengo extension
+func (e *Engine) SelectScriptByName(name string) error {
+	for i, scriptName := range e.particleScriptNames {
+		if scriptName == name || scriptName == name+".tengo" {
+			e.particleScriptSelected = i
 
-	p.moveFailed = false
+			return nil
+		}
+	}
 
-	curScript := e.particleScript[e.particleScriptSelected]
-	// inputs: state, l, r, ul, ur, ll, lr
-	err := curScript.Add("state", p.GetStateS(nil))
+	return fmt.Errorf("no particle script named '%s', expected one of %s", name, strings.Join(e.particleScriptNames, ", "))
+}
+
+// addParticleInputs adds to a script the view of a particle as input variables
+func (e *Engine) addParticleInputs(curScript *tengo.Script, p *Particle, neighbors1 []string, neighbors2 []string, neighbors1Deg []int) error {
+	// inputs: state, the N1 directions (l, r, ul, ur, ll, lr on hex), the N2
+	// positions (l2, r2, u2l, u2r, l2l, l2r on hex) and the N1 degrees (dl, dr, ...)
+	err := curScript.Add("state", p.localStateS(p.state))
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	for i, s := range []string{"l", "r", "ul", "ur", "ll", "lr"} {
-		err := curScript.Add(s, neighbors1[i])
-		if err != nil {
-			return "", err
+	directions := e.geometry.Directions()
+	names := make([]interface{}, len(directions))
+	n1 := make(map[string]interface{}, len(directions))
+
+	for i, name := range directions {
+		names[i] = name
+		n1[name] = neighbors1[i]
+
+		if err := curScript.Add(name, neighbors1[i]); err != nil {
+			return err
 		}
-	}
 
-	for i, s := range []string{"l2", "r2", "u2l", "u2r", "l2l", "l2r"} {
-		err := curScript.Add(s, neighbors2[i])
-		if err != nil {
-			return "", err
+		if err := curScript.Add("d"+name, neighbors1Deg[i]); err != nil {
+			return err
 		}
 	}
 
-	for i, s := range []string{"dl", "dr", "dul", "dur", "dll", "dlr"} {
-		err := curScript.Add(s, neighbors1Deg[i])
-		if err != nil {
-			return "", err
+	for i, pos := range e.geometry.N2() {
+		if err := curScript.Add(pos.Name, neighbors2[i]); err != nil {
+			return err
 		}
 	}
 
-	particleScriptCompiled, err := curScript.Compile()
+	if err := curScript.Add("geometry", e.geometry.Name()); err != nil {
+		return err
+	}
+
+	if err := curScript.Add("directions", names); err != nil {
+		return err
+	}
+
+	// The N1 states by direction name, for the scripts that hold on any lattice
+	if err := curScript.Add("n1", n1); err != nil {
+		return err
+	}
+
+	// Parameters of the algorithm, set by the scenario
+	if err := curScript.Add("params", e.particleParams()); err != nil {
+		return err
+	}
+
+	// Full rings 1..visibility_radius, clockwise from the left
+	rings, ringDegs := p.ringInputs()
+
+	if err := curScript.Add("rings", rings); err != nil {
+		return err
+	}
+
+	if err := curScript.Add("ring_degs", ringDegs); err != nil {
+		return err
+	}
+
+	bonds := make([]interface{}, len(p.n1Bonds))
+	for i, bonded := range p.n1Bonds {
+		bonds[i] = bonded
+	}
+
+	if err := curScript.Add("bonds", bonds); err != nil {
+		return err
+	}
+
+	lights := make([]interface{}, len(p.n1Lights))
+	for i, light := range p.n1Lights {
+		lights[i] = light
+	}
+
+	if err := curScript.Add("light", p.light); err != nil {
+		return err
+	}
+
+	if err := curScript.Add("lights", lights); err != nil {
+		return err
+	}
+
+	e.triggerMu.Lock()
+	inbox := p.inbox
+	e.triggerMu.Unlock()
+
+	return curScript.Add("inbox", inbox)
+}
+
+func (e *Engine) Particle(p *Particle, neighbors1 []string, neighbors2 []string, neighbors1Deg []int) (string, error) {
+	e.asyncMu.Lock()
+
+	p.moveFailed = false
+
+	curScript := e.particleScript[e.particleScriptSelected]
+
+	err := e.addParticleInputs(curScript, p, neighbors1, neighbors2, neighbors1Deg)
 	if err != nil {
+		e.asyncMu.Unlock()
+
 		return "", err
 	}
 
+	particleScriptCompiled, err := curScript.Compile()
+
 	e.asyncMu.Unlock()
 
+	if err != nil {
+		return "", err
+	}
+
 	err = particleScriptCompiled.Run()
 	if err != nil {
 		return "", err
 	}
 
-	nextState := particleScriptCompiled.Get("next_state")
+	// The inbox is consumed by the computation
+	e.triggerMu.Lock()
+	p.inbox = make([]interface{}, 0)
+	e.triggerMu.Unlock()
 
-	return nextState.String(), nil
-}
+	p.nextLight = p.light
+	if nextLight := particleScriptCompiled.Get("next_light"); !nextLight.IsUndefined() {
+		p.nextLight = nextLight.String()
+	}
 
-func (e *Engine) randDuration(max, perc int) time.Duration {
-	var val int
+	p.outbox = nil
+	if send := particleScriptCompiled.Get("send"); !send.IsUndefined() {
+		p.outbox = send.Map()
+	}
 
-	if perc < 0 || perc > 100 {
-		randN := rand.Intn(101)
-		val = (max * randN) / 100
-	} else {
-		val = (max * perc) / 100
+	// The bonds to form and to break, as local directions
+	p.bondOut, p.unbondOut = nil, nil
+	if bond := particleScriptCompiled.Get("bond"); !bond.IsUndefined() {
+		p.bondOut = bond.Array()
+	}
+
+	if unbond := particleScriptCompiled.Get("unbond"); !unbond.IsUndefined() {
+		p.unbondOut = unbond.Array()
 	}
 
-	return time.Duration(val * int(time.Millisecond))
+	nextState := particleScriptCompiled.Get("next_state")
+
+	// The next state is computed in the local frame of the particle
+	return p.globalStateS(nextState.String()), nil
 }
 
 func (e *Engine) asyncTask(row, column int) {
-	curParticle := e.grid[row][column]
+	// A failing script ends the task with an error, not the simulator
+	defer func() {
+		if r := recover(); r != nil {
+			e.asyncResults <- asyncResult{row, column, fmt.Errorf("%v", r)}
+		}
+	}()
 
-	fmt.Printf("[%d,%d]->iSTATE:%d\n", row, column, curParticle.iState)
+	curParticle := e.particleAt(row, column)
 
-	fmt.Printf("[%d,%d]->INIT\n", row, column)
-	time.Sleep(e.randDuration(e.asyncInitPhase, -1))
+	e.debugf("[%d,%d]->iSTATE:%d\n", row, column, curParticle.iState)
 
-	fmt.Printf("[%d,%d]->AWOKEN: %t\n", row, column, e.asyncGridAwoken[row][column])
+	e.debugf("[%d,%d]->INIT\n", row, column)
+	time.Sleep(e.phaseDuration(e.asyncInitPhase, curParticle))
+
+	e.debugf("[%d,%d]->AWOKEN: %t\n", row, column, curParticle.awoken)
 	curParticle.Awake()
 
-	fmt.Printf("[%d,%d]->LOOK\n", row, column)
+	e.debugf("[%d,%d]->LOOK\n", row, column)
 
 	e.updateNeighbors(row, column)
+	e.takeSnapshot(curParticle)
 
-	time.Sleep(e.randDuration(e.asyncLookPhase, -1))
+	time.Sleep(e.phaseDuration(e.asyncLookPhase, curParticle))
 
-	fmt.Printf("[%d,%d]->COMPUTE\n", row, column)
+	e.debugf("[%d,%d]->COMPUTE\n", row, column)
 
 	neighbors1, neighbors2 := curParticle.GetNeighborsString()
 
 	// inputs: state, [l, r, ul, ur, ll, lr], [2l, 2r, u2l, u2r, l2l, l2r], [lDeg, rDeg, ulDeg, urDeg, llDeg, lrDeg]
 	nextStateS, err := e.Particle(curParticle, neighbors1, neighbors2, curParticle.n1Deg)
 	if err != nil {
-		panic(err)
+		e.asyncResults <- asyncResult{row, column, err}
+
+		return
 	}
 
-	time.Sleep(e.randDuration(e.asyncComputePhase, -1))
+	time.Sleep(e.phaseDuration(e.asyncComputePhase, curParticle))
 
-	fmt.Printf("[%d,%d]->MOVE\n", row, column)
+	e.debugf("[%d,%d]->MOVE\n", row, column)
 
-	switch nextStateS {
-	case "VOID":
-		curParticle.nextState = VOID
-	case "CONTRACTED":
-		curParticle.nextState = CONTRACTED
-	case "EXPANDL":
-		curParticle.nextState = EXPANDL
-	case "EXPANDR":
-		curParticle.nextState = EXPANDR
-	case "EXPANDUL":
-		curParticle.nextState = EXPANDUL
-	case "EXPANDUR":
-		curParticle.nextState = EXPANDUR
-	case "EXPANDLL":
-		curParticle.nextState = EXPANDLL
-	case "EXPANDLR":
-		curParticle.nextState = EXPANDLR
-	case "MOVEL":
-		curParticle.nextState = MOVEL
-	case "MOVER":
-		curParticle.nextState = MOVER
-	case "MOVEUL":
-		curParticle.nextState = MOVEUL
-	case "MOVEUR":
-		curParticle.nextState = MOVEUR
-	case "MOVELL":
-		curParticle.nextState = MOVELL
-	case "MOVELR":
-		curParticle.nextState = MOVELR
-	default:
-		panic(fmt.Errorf("'%s' is not a valid state string", nextStateS))
+	if err := curParticle.SetNextStateS(nextStateS); err != nil {
+		e.asyncResults <- asyncResult{row, column, err}
+
+		return
 	}
 
-	time.Sleep(e.randDuration(e.asyncMovePhase, -1))
+	if e.moveVisibility == INPROGRESS {
+		e.showMoveInProgress(row, column)
+	}
+
+	time.Sleep(e.moveDuration(row, column, curParticle))
 
-	e.asyncResults <- asyncResult{row, column}
+	e.asyncResults <- asyncResult{row, column, nil}
 }
 
 func (e *Engine) asyncUpdateController() {
 	for result := range e.asyncResults {
-		fmt.Println("----- GET RESULT -----")
-		curParticle := e.grid[result.row][result.column]
-
-		if curParticle.state != VOID && curParticle.state != OBSTACLE {
-			newRow := result.row
-			newCol := result.column
-
-			switch curParticle.nextState {
-			case EXPANDL, MOVEL:
-				newCol -= 1
-				fmt.Printf("MOVE LEFT -> %d\n", e.grid[newRow][newCol].state)
-
-			case EXPANDR, MOVER:
-				newCol += 1
-				fmt.Printf("MOVE RIGHT -> %d\n", e.grid[newRow][newCol].state)
-
-			case EXPANDUL, MOVEUL:
-				newRow -= 1
-				if newRow%2 == 0 {
-					newCol -= 1
-				}
-				fmt.Printf("MOVE UPPER LEFT -> %d\n", e.grid[newRow][newCol].state)
+		e.debugf("----- GET RESULT -----\n")
+		curParticle := e.particleAt(result.row, result.column)
 
-			case EXPANDUR, MOVEUR:
-				newRow -= 1
-				if newRow%2 != 0 {
-					newCol += 1
-				}
-				fmt.Printf("MOVE UPPER RIGHT -> %d\n", e.grid[newRow][newCol].state)
+		// The particle left its cell meanwhile
+		if curParticle == nil {
+			e.asyncTasks.Done()
 
-			case EXPANDLL, MOVELL:
-				newRow += 1
-				if newRow%2 == 0 {
-					newCol -= 1
-				}
-				fmt.Printf("MOVE LOWER LEFT -> %d\n", e.grid[newRow][newCol].state)
+			continue
+		}
 
-			case EXPANDLR, MOVELR:
-				newRow += 1
-				if newRow%2 != 0 {
-					newCol += 1
-				}
-				fmt.Printf("MOVE LOWER RIGHT -> %d\n", e.grid[newRow][newCol].state)
-			}
+		// A failed task stops the run, the particle does not move
+		if result.err != nil {
+			e.fail(fmt.Errorf("particle %d,%d: %w", result.row, result.column, result.err))
+		} else if curParticle.state != OBSTACLE {
+			e.hideMoveInProgress(result.row, result.column)
+			e.applyNextState(result.row, result.column)
+		}
 
-			switch curParticle.nextState {
-			case MOVEL, MOVER, MOVEUL, MOVEUR, MOVELL, MOVELR:
-				if e.grid[newRow][newCol].state == VOID {
-					e.grid[newRow][newCol], e.grid[result.row][result.column] = e.grid[result.row][result.column], e.grid[newRow][newCol]
-					curParticle.state = CONTRACTED
-				} else {
-					curParticle.moveFailed = true
-				}
+		e.debugf("SLEEP [%d,%d]\n", result.row, result.column)
+		curParticle.Sleep()
+
+		e.asyncMu.Lock()
+		curParticle.awoken = false
+		e.asyncMu.Unlock()
+
+		e.asyncTasks.Done()
+	}
+	e.debugf("----- EXITED -----\n")
+}
+
+// moveTarget returns the cell reached from [row, column] following the
+// direction of an expand or move state.
+func (e *Engine) moveTarget(row, column int, state State) (int, int) {
+	dir, ok := stateDirection(state)
+	if !ok {
+		return row, column
+	}
+
+	targetRow, targetCol := e.geometry.Neighbor(row, column, dir)
+	c := e.wrap(cell{targetRow, targetCol})
+
+	return c.row, c.column
+}
 
+// applyNextState moves the particle at [row, column] to its next state,
+// marking the move as failed if the target cell is not free.
+func (e *Engine) applyNextState(row, column int) {
+	curParticle := e.particleAt(row, column)
+	newRow, newCol := e.moveTarget(row, column, curParticle.nextState)
+
+	if err := e.checkStale(row, column); err != nil {
+		e.fail(err)
+	}
+
+	e.updateLight(row, column)
+	e.deliverMessages(row, column)
+	e.updateBonds(row, column)
+
+	if curParticle.nextState != curParticle.state {
+		e.cellChanged(row, column)
+	}
+
+	e.debugf("NEXT STATE: %d\n", curParticle.nextState)
+
+	switch {
+	case isMove(curParticle.nextState):
+		target := e.getSafeState(newRow, newCol)
+		e.debugf("MOVE: %d to -> %d\n", curParticle.nextState, target)
+		dir, _ := stateDirection(curParticle.nextState)
+		if target == VOID && !e.stuck(row, column) && e.moveBonded(row, column, newRow, newCol, dir) {
+			curParticle.state = CONTRACTED
+			e.cellChanged(newRow, newCol)
+			e.fallInHole(newRow, newCol)
+			e.countMove(false)
+		} else {
+			curParticle.moveFailed = true
+			e.countMove(true)
+		}
+
+		curParticle.nextState = VOID
+	case isExpand(curParticle.nextState):
+		if curParticle.nextState != curParticle.state {
+			if target := e.getSafeState(newRow, newCol); target != VOID && target != CONTRACTED {
+				curParticle.moveFailed = true
+				e.countMove(true)
+				curParticle.state = CONTRACTED
 				curParticle.nextState = VOID
-			case EXPANDL, EXPANDR, EXPANDUL, EXPANDUR, EXPANDLL, EXPANDLR:
-				if curParticle.nextState != curParticle.state {
-					if e.grid[newRow][newCol].state != VOID && e.grid[newRow][newCol].state != CONTRACTED {
-						curParticle.moveFailed = true
-						curParticle.state = CONTRACTED
-						curParticle.nextState = VOID
-					} else {
-						curParticle.state = curParticle.nextState
-						curParticle.nextState = VOID
-					}
-				} else {
-					curParticle.nextState = VOID
-				}
-			default:
+			} else {
 				curParticle.state = curParticle.nextState
 				curParticle.nextState = VOID
+				e.cellChanged(newRow, newCol)
 			}
+		} else {
+			curParticle.nextState = VOID
 		}
+	default:
+		curParticle.state = curParticle.nextState
+		curParticle.nextState = VOID
+	}
+}
 
-		fmt.Printf("SLEEP [%d,%d]\n", result.row, result.column)
-		curParticle.Sleep()
+// countMove counts a move applied, or failed
+func (e *Engine) countMove(failed bool) {
+	e.movesMu.Lock()
+	defer e.movesMu.Unlock()
 
-		e.asyncGridAwoken[result.row][result.column] = false
+	if failed {
+		e.failedMoves += 1
+	} else {
+		e.moves += 1
 	}
-	fmt.Println("----- EXITED -----")
 }
 
-func (e *Engine) syncUpdate() {
+// Moves returns the number of moves applied and failed since Init, the
+// failed expansions included
+func (e *Engine) Moves() (int, int) {
+	e.movesMu.Lock()
+	defer e.movesMu.Unlock()
+
+	return e.moves, e.failedMoves
+}
+
+// syncUpdate runs the current phase of the synchronous round
+func (e *Engine) syncUpdate() error {
 	switch e.phase {
 	case SCHEDULER:
-		particles := make([]interface{}, 0)
-		states := make([]interface{}, 0)
-
-		for row, columns := range e.grid {
-			for column, particle := range columns {
-				if particle.state != VOID && particle.state != OBSTACLE {
-					particles = append(particles, fmt.Sprintf("%d,%d", row, column))
-					states = append(states, particle.GetStateS(nil))
-				}
-			}
-		}
+		particles, states := e.activeParticles()
 
-		fmt.Println("SYNC SCHEDULER")
+		e.debugf("SYNC SCHEDULER\n")
 
 		res, err := e.Scheduler(particles, states)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		// fmt.Printf("Scheduler awakes: %s\n", res)
 
 		for i := range res {
-			j := rand.Intn(i + 1)
+			j := e.rng.Intn(i + 1)
 			res[i], res[j] = res[j], res[i]
 		}
 
@@ -521,26 +1124,18 @@ func (e *Engine) syncUpdate() {
 		copy(e.schedulerRes, res)
 
 		for _, p := range e.schedulerRes {
-			parsed, ok := p.(string)
-			if !ok {
-				panic(ok)
-			}
-
-			splitted := strings.Split(parsed, ",")
-
-			row, err := strconv.ParseInt(splitted[0], 10, 0)
+			row, column, err := parseCellKey(fmt.Sprintf("%v", p))
 			if err != nil {
-				panic(err)
+				return err
 			}
 
-			column, err := strconv.ParseInt(splitted[1], 10, 0)
-			if err != nil {
-				panic(err)
+			curParticle := e.particleAt(row, column)
+			if curParticle == nil {
+				continue
 			}
 
-			curParticle := e.grid[row][column]
 			if awoken := curParticle.Awake(); !awoken {
-				panic("cannot awake particle...")
+				return fmt.Errorf("particle %d,%d picked twice by the scheduler", row, column)
 			}
 		}
 
@@ -549,69 +1144,34 @@ func (e *Engine) syncUpdate() {
 	case LOOK:
 		e.updateNeighbors(-1, -1)
 
+		e.world.Each(func(_ cell, particle *Particle) {
+			if particle.iState == AWAKE {
+				e.takeSnapshot(particle)
+			}
+		})
+
 		e.phase = COMPUTE
 
 	case COMPUTE:
 		for _, p := range e.schedulerRes {
-			parsed, ok := p.(string)
-			if !ok {
-				panic(ok)
-			}
-
-			splitted := strings.Split(parsed, ",")
-
-			row, err := strconv.ParseInt(splitted[0], 10, 0)
-			if err != nil {
-				panic(err)
-			}
-
-			column, err := strconv.ParseInt(splitted[1], 10, 0)
+			row, column, err := parseCellKey(fmt.Sprintf("%v", p))
 			if err != nil {
-				panic(err)
+				return err
 			}
 
-			curParticle := e.grid[row][column]
+			curParticle := e.particleAt(row, column)
 
-			if curParticle.iState == AWAKE {
+			if curParticle != nil && curParticle.iState == AWAKE {
 				neighbors1, neighbors2 := curParticle.GetNeighborsString()
 
 				// inputs: state, [l, r, ul, ur, ll, lr], [2l, 2r, u2l, u2r, l2l, l2r], [lDeg, rDeg, ulDeg, urDeg, llDeg, lrDeg]
 				nextState, err := e.Particle(curParticle, neighbors1, neighbors2, curParticle.n1Deg)
 				if err != nil {
-					panic(err)
+					return fmt.Errorf("particle %d,%d: %w", row, column, err)
 				}
 
-				switch nextState {
-				case "VOID":
-					curParticle.nextState = VOID
-				case "CONTRACTED":
-					curParticle.nextState = CONTRACTED
-				case "EXPANDL":
-					curParticle.nextState = EXPANDL
-				case "EXPANDR":
-					curParticle.nextState = EXPANDR
-				case "EXPANDUL":
-					curParticle.nextState = EXPANDUL
-				case "EXPANDUR":
-					curParticle.nextState = EXPANDUR
-				case "EXPANDLL":
-					curParticle.nextState = EXPANDLL
-				case "EXPANDLR":
-					curParticle.nextState = EXPANDLR
-				case "MOVEL":
-					curParticle.nextState = MOVEL
-				case "MOVER":
-					curParticle.nextState = MOVER
-				case "MOVEUL":
-					curParticle.nextState = MOVEUL
-				case "MOVEUR":
-					curParticle.nextState = MOVEUR
-				case "MOVELL":
-					curParticle.nextState = MOVELL
-				case "MOVELR":
-					curParticle.nextState = MOVELR
-				default:
-					panic(fmt.Errorf("'%s' is not a valid state string", nextState))
+				if err := curParticle.SetNextStateS(nextState); err != nil {
+					return fmt.Errorf("particle %d,%d: %w", row, column, err)
 				}
 			}
 		}
@@ -620,86 +1180,15 @@ func (e *Engine) syncUpdate() {
 
 	case MOVE:
 		for _, p := range e.schedulerRes {
-			parsed, ok := p.(string)
-			if !ok {
-				panic(ok)
-			}
-
-			splitted := strings.Split(parsed, ",")
-
-			row, err := strconv.ParseInt(splitted[0], 10, 0)
-			if err != nil {
-				panic(err)
-			}
-
-			column, err := strconv.ParseInt(splitted[1], 10, 0)
+			row, column, err := parseCellKey(fmt.Sprintf("%v", p))
 			if err != nil {
-				panic(err)
+				return err
 			}
 
-			curParticle := e.grid[row][column]
-
-			if curParticle.iState == AWAKE {
-				newRow := row
-				newCol := column
-
-				switch curParticle.nextState {
-				case EXPANDL, MOVEL:
-					newCol -= 1
-				case EXPANDR, MOVER:
-					newCol += 1
-				case EXPANDUL, MOVEUL:
-					newRow -= 1
-					if newRow%2 == 0 {
-						newCol -= 1
-					}
-				case EXPANDUR, MOVEUR:
-					newRow -= 1
-					if newRow%2 != 0 {
-						newCol += 1
-					}
-				case EXPANDLL, MOVELL:
-					newRow += 1
-					if newRow%2 == 0 {
-						newCol -= 1
-					}
-				case EXPANDLR, MOVELR:
-					newRow += 1
-					if newRow%2 != 0 {
-						newCol += 1
-					}
-				}
+			curParticle := e.particleAt(row, column)
 
-				fmt.Printf("NEXT STATE: %d\n", curParticle.nextState)
-
-				switch curParticle.nextState {
-				case MOVEL, MOVER, MOVEUL, MOVEUR, MOVELL, MOVELR:
-					fmt.Printf("MOVE: %d to -> %d\n", curParticle.nextState, e.grid[newRow][newCol].state)
-					if e.grid[newRow][newCol].state == VOID {
-						e.grid[newRow][newCol], e.grid[row][column] = e.grid[row][column], e.grid[newRow][newCol]
-						curParticle.state = CONTRACTED
-					} else {
-						curParticle.moveFailed = true
-					}
-
-					curParticle.nextState = VOID
-				case EXPANDL, EXPANDR, EXPANDUL, EXPANDUR, EXPANDLL, EXPANDLR:
-					if curParticle.nextState != curParticle.state {
-						if e.grid[newRow][newCol].state != VOID && e.grid[newRow][newCol].state != CONTRACTED {
-							curParticle.moveFailed = true
-							curParticle.state = CONTRACTED
-							curParticle.nextState = VOID
-						} else {
-							curParticle.state = curParticle.nextState
-							curParticle.nextState = VOID
-						}
-					} else {
-						curParticle.nextState = VOID
-					}
-				default:
-					curParticle.state = curParticle.nextState
-					curParticle.nextState = VOID
-				}
+			if curParticle != nil && curParticle.iState == AWAKE {
+				e.applyNextState(row, column)
 
 				curParticle.Sleep()
 			}
@@ -707,223 +1196,302 @@ func (e *Engine) syncUpdate() {
 
 		e.phase = SCHEDULER
 	}
+
+	return nil
 }
 
-func (e *Engine) asyncUpdate() {
+// asyncUpdate runs a scheduler tick and launches a task for every particle
+// woken that is not already running
+func (e *Engine) asyncUpdate() error {
 	particles := make([]interface{}, 0)
 	states := make([]interface{}, 0)
 	eventDrivenParticles := make([]interface{}, 0)
 
-	for row, columns := range e.grid {
-		for column, particle := range columns {
-			if e.schedulerEventDriven {
-				if particle.state == CONTRACTED {
-					neighbors1, _ := e.getNeighbors(row, column)
+	e.world.Each(func(c cell, particle *Particle) {
+		key := fmt.Sprintf("%d,%d", c.row, c.column)
 
-					// fmt.Printf("particle (%d,%d): %#\n", row, column, neighbors1)
+		if e.schedulerEventDriven {
+			if particle.state == CONTRACTED && len(e.schedulerTriggers) > 0 {
+				// Woken by the triggers only
+				particle.deg = 0
+			} else if particle.state == CONTRACTED {
+				neighbors1, _ := e.getNeighbors(c.row, c.column)
 
-					for _, neighbor := range neighbors1 {
-						if (neighbor != VOID && neighbor != OBSTACLE) || (e.schedulerEventDrivenWithBlocks && neighbor != VOID) {
-							eventDrivenParticles = append(eventDrivenParticles, fmt.Sprintf("%d,%d", row, column))
+				// fmt.Printf("particle (%d,%d): %v\n", c.row, c.column, neighbors1)
 
-							break
-						}
-					}
+				for _, neighbor := range neighbors1 {
+					if (neighbor != VOID && neighbor != OBSTACLE) || (e.schedulerEventDrivenWithBlocks && neighbor != VOID) {
+						eventDrivenParticles = append(eventDrivenParticles, key)
 
-					// Update deg to calculate isolated particles
-					particle.deg = 0
-				} else {
-					if particle.state != VOID && particle.state != OBSTACLE {
-						particles = append(particles, fmt.Sprintf("%d,%d", row, column))
-						states = append(states, particle.GetStateS(nil))
+						break
 					}
 				}
-			} else {
-				if particle.state != VOID && particle.state != OBSTACLE {
-					particles = append(particles, fmt.Sprintf("%d,%d", row, column))
-					states = append(states, particle.GetStateS(nil))
-				}
+
+				// Update deg to calculate isolated particles
+				particle.deg = 0
+			} else if particle.state != OBSTACLE {
+				particles = append(particles, key)
+				states = append(states, particle.GetStateS(nil))
 			}
+		} else if particle.state != OBSTACLE {
+			particles = append(particles, key)
+			states = append(states, particle.GetStateS(nil))
 		}
-	}
+	})
 
-	fmt.Println("ASYNC SCHEDULER")
+	e.debugf("ASYNC SCHEDULER\n")
 
 	res, err := e.Scheduler(particles, states)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	fmt.Printf("Event driven %#\n", eventDrivenParticles)
+	if e.schedulerEventDriven && len(e.schedulerTriggers) > 0 {
+		triggered, err := e.triggeredParticles()
+		if err != nil {
+			return err
+		}
+
+		eventDrivenParticles = append(eventDrivenParticles, triggered...)
+	}
+
+	e.debugf("Event driven %v\n", eventDrivenParticles)
 
 	if e.schedulerEventDriven {
 		res = append(res, eventDrivenParticles...)
 	}
 
-	fmt.Printf("Scheduler awakes: %s\n", res)
+	e.debugf("Scheduler awakes: %s\n", res)
 
 	for i := range res {
-		j := rand.Intn(i + 1)
+		j := e.rng.Intn(i + 1)
 		res[i], res[j] = res[j], res[i]
 	}
 
 	e.schedulerRes = make([]interface{}, len(res))
 	copy(e.schedulerRes, res)
 
-	fmt.Println(e.schedulerRes)
+	e.debugf("%v\n", e.schedulerRes)
 
 	for _, p := range e.schedulerRes {
-		parsed, ok := p.(string)
-		if !ok {
-			panic(ok)
-		}
-
-		splitted := strings.Split(parsed, ",")
-
-		row, err := strconv.ParseInt(splitted[0], 10, 0)
+		row, column, err := parseCellKey(fmt.Sprintf("%v", p))
 		if err != nil {
-			panic(err)
+			return err
 		}
 
-		column, err := strconv.ParseInt(splitted[1], 10, 0)
-		if err != nil {
-			panic(err)
-		}
+		e.debugf("LAUNCH [%d,%d]\n", row, column)
 
-		fmt.Printf("LAUNCH [%d,%d]\n", row, column)
+		curParticle := e.particleAt(row, column)
+		if curParticle == nil {
+			continue
+		}
 
 		e.asyncMu.Lock()
-		if !e.asyncGridAwoken[row][column] {
-			e.asyncGridAwoken[row][column] = true
-			go e.asyncTask(int(row), int(column))
+		if !curParticle.awoken {
+			curParticle.awoken = true
+			e.asyncTasks.Add(1)
+			go e.asyncTask(row, column)
 		}
 		e.asyncMu.Unlock()
 	}
+
+	return nil
 }
 
 func (e *Engine) Update(eTick *chan int) {
-	fmt.Printf("UPDATE ENGINE %t\n", e.running)
+	e.debugf("UPDATE ENGINE %t\n", e.running)
 
 	if !e.running {
 		return
 	}
 
+	e.update()
+
+	if eTick != nil {
+		*eTick <- e.getRound()
+	}
+}
+
+// update runs an update of the scheduler, the lock is released also when a
+// script fails. A script that panics stops the run with an error.
+func (e *Engine) update() {
+	e.updateMu.Lock()
+	defer e.updateMu.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			e.fail(fmt.Errorf("%v", r))
+		}
+	}()
+
+	// The engine can be stopped while waiting for the lock
+	if !e.IsRunning() {
+		return
+	}
+
+	var err error
+
 	switch e.schedulerType {
 	case SYNC:
-		e.syncUpdate()
+		err = e.syncUpdate()
 	case ASYNC:
-		e.asyncUpdate()
+		err = e.asyncUpdate()
+	case POISSON:
+		err = e.poissonUpdate()
 	}
 
-	if eTick != nil {
-		*eTick <- e.getRound()
+	if err != nil {
+		e.fail(err)
+
+		return
+	}
+
+	if err := e.updateEnvironment(); err != nil {
+		e.fail(err)
+
+		return
+	}
+
+	if reason := e.stopReached(); reason != "" {
+		e.asyncMu.Lock()
+		e.running = false
+		if e.err == nil {
+			e.stopReason = reason
+		}
+		e.asyncMu.Unlock()
+	}
+
+	if err := e.recordTrace(); err != nil {
+		e.fail(err)
+
+		return
+	}
+
+	e.recordGraph()
+}
+
+// Close stops the run, waits for its async tasks and releases the engine:
+// the async results controller ends and the stale log is closed
+func (e *Engine) Close() error {
+	e.Stop()
+
+	e.updateMu.Lock()
+	defer e.updateMu.Unlock()
+
+	e.asyncTasks.Wait()
+
+	if e.asyncLoopRunning {
+		close(e.asyncResults)
+		e.asyncLoopRunning = false
 	}
+
+	return e.closeStaleLog()
+}
+
+// particleAt returns the particle at [row, column], nil for an empty cell
+func (e *Engine) particleAt(row, column int) *Particle {
+	return e.world.At(cell{row, column})
 }
 
 func (e *Engine) getSafeN1Degs(row, col int) int {
-	if row < 1 || col < 1 || row > len(e.grid)-1 || col > len(e.grid[0])-1 {
-		return 6
+	if e.impassable(row, col) {
+		return len(e.geometry.Directions())
+	}
+
+	if particle := e.particleAt(row, col); particle != nil {
+		return particle.GetDeg()
 	}
 
-	return e.grid[row][col].GetDeg()
+	return 0
 }
 
-func (e *Engine) getN1Degs(row, column int) (neighbors1Deg []int) {
-	neighbors1Deg = make([]int, 0)
-	// L
-	curRow := row
-	curCol := column - 1
-	neighbors1Deg = append(neighbors1Deg, e.getSafeN1Degs(curRow, curCol))
-
-	// R
-	curCol = column + 1
-	neighbors1Deg = append(neighbors1Deg, e.getSafeN1Degs(curRow, curCol))
-
-	// UL
-	curRow = row - 1
-	curCol = column
-	neighbors1Deg = append(neighbors1Deg, e.getSafeN1Degs(curRow, curCol))
-
-	// UR
-	curRow = row - 1
-	curCol = column + 1
-	neighbors1Deg = append(neighbors1Deg, e.getSafeN1Degs(curRow, curCol))
-
-	// LL
-	curRow = row + 1
-	curCol = column
-	neighbors1Deg = append(neighbors1Deg, e.getSafeN1Degs(curRow, curCol))
-
-	// LR
-	curRow = row + 1
-	curCol = column + 1
-	neighbors1Deg = append(neighbors1Deg, e.getSafeN1Degs(curRow, curCol))
+// getN1Degs returns the degrees of the N1 neighbors of a particle, in its local frame
+func (e *Engine) getN1Degs(row, column int, p *Particle) (neighbors1Deg []int) {
+	neighbors1Deg = make([]int, 0, maxDirections)
+
+	for _, c := range e.viewN1Cells(row, column, p) {
+		neighbors1Deg = append(neighbors1Deg, e.getSafeN1Degs(c.row, c.column))
+	}
 
 	return neighbors1Deg
 }
 
-func (e *Engine) updateNeighbors(iRow, iCol int) {
-	if iRow == -1 && iCol == -1 {
-		// Update neighbors
-		for row, columns := range e.grid {
-			for column, particle := range columns {
-				if particle.state != VOID && particle.state != OBSTACLE {
-					neighbors1, neighbors2 := e.getNeighbors(row, column)
-					if err := particle.SetNeighbors(neighbors1, neighbors2); err != nil {
-						panic(err)
-					}
+// getN1Lights returns the lights of the N1 neighbors of a particle, in its
+// local frame, empty for the free cells
+func (e *Engine) getN1Lights(row, column int, p *Particle) (neighbors1Lights []string) {
+	neighbors1Lights = make([]string, 0, maxDirections)
 
-					deg := 0
-					if err := particle.SetDeg(deg); err != nil {
-						panic(err)
-					}
+	for _, c := range e.viewN1Cells(row, column, p) {
+		light := ""
+		if particle := e.world.At(c); particle != nil {
+			light = particle.light
+		}
 
-					for _, neighbor := range neighbors1 {
-						if neighbor != VOID && neighbor != OBSTACLE {
-							deg += 1
-						}
-					}
+		neighbors1Lights = append(neighbors1Lights, light)
+	}
 
-					if err := particle.SetDeg(deg); err != nil {
-						panic(err)
-					}
-				}
-			}
+	return neighbors1Lights
+}
+
+// updateView updates the neighbors, the deg and the neighbor lights of a
+// particle, as seen in its local frame
+func (e *Engine) updateView(row, column int, particle *Particle) {
+	particle.frame = e.frameOf(row, column, particle)
+
+	neighbors1 := e.getStates(e.viewN1Cells(row, column, particle))
+	neighbors2 := e.getStates(e.viewN2Cells(row, column, particle))
+
+	if err := particle.SetNeighbors(neighbors1, neighbors2); err != nil {
+		panic(err)
+	}
+
+	deg := 0
+	for _, neighbor := range neighbors1 {
+		if neighbor != VOID && neighbor != OBSTACLE {
+			deg += 1
 		}
+	}
+
+	if err := particle.SetDeg(deg); err != nil {
+		panic(err)
+	}
+
+	if err := particle.SetNeighborsLights(e.getN1Lights(row, column, particle)); err != nil {
+		panic(err)
+	}
+
+	particle.n1Bonds = e.getN1Bonds(row, column, particle)
+
+	e.updateRings(row, column, particle)
+}
+
+func (e *Engine) updateNeighbors(iRow, iCol int) {
+	if iRow == -1 && iCol == -1 {
+		// Update neighbors
+		e.world.Each(func(c cell, particle *Particle) {
+			if particle.state != OBSTACLE {
+				e.updateView(c.row, c.column, particle)
+			}
+		})
 		// Update neighbors' deg
-		for row, columns := range e.grid {
-			for column, particle := range columns {
-				if particle.state != VOID && particle.state != OBSTACLE {
-					neighbors1Deg := e.getN1Degs(int(row), int(column))
-					if err := particle.SetNeighborsDeg(neighbors1Deg); err != nil {
-						panic(err)
-					}
+		e.world.Each(func(c cell, particle *Particle) {
+			if particle.state != OBSTACLE {
+				neighbors1Deg := e.getN1Degs(c.row, c.column, particle)
+				if err := particle.SetNeighborsDeg(neighbors1Deg); err != nil {
+					panic(err)
 				}
 			}
-		}
+		})
 	} else {
-		particle := e.grid[iRow][iCol]
-		neighbors1, neighbors2 := e.getNeighbors(iRow, iCol)
-		if err := particle.SetNeighbors(neighbors1, neighbors2); err != nil {
-			panic(err)
-		}
-
-		deg := 0
-		if err := particle.SetDeg(deg); err != nil {
-			panic(err)
-		}
-
-		for _, neighbor := range neighbors1 {
-			if neighbor != VOID && neighbor != OBSTACLE {
-				deg += 1
-			}
+		// The cell can be emptied meanwhile by the async results
+		particle := e.particleAt(iRow, iCol)
+		if particle == nil {
+			return
 		}
 
-		if err := particle.SetDeg(deg); err != nil {
-			panic(err)
-		}
+		e.updateView(iRow, iCol, particle)
 
-		neighbors1Deg := e.getN1Degs(int(iRow), int(iCol))
+		neighbors1Deg := e.getN1Degs(iRow, iCol, particle)
 		if err := particle.SetNeighborsDeg(neighbors1Deg); err != nil {
 			panic(err)
 		}
@@ -938,103 +1506,48 @@ func (e *Engine) getRound() int {
 
 	min := math.MaxInt
 
-	for _, columns := range e.grid {
-		for _, particle := range columns {
-			if particle.state != VOID && particle.state != OBSTACLE {
-				if round := particle.Round(); round < min {
-					min = round
-				}
+	e.world.Each(func(_ cell, particle *Particle) {
+		if particle.state != OBSTACLE {
+			if round := particle.Round(); round < min {
+				min = round
 			}
 		}
-	}
+	})
 
 	return min
 }
 
 func (e *Engine) getSafeState(row, col int) State {
-	if row < 1 || col < 1 || row > len(e.grid)-1 || col > len(e.grid[0])-1 {
+	if e.impassable(row, col) {
 		return OBSTACLE
 	}
 
-	return e.grid[row][col].state
+	if particle := e.particleAt(row, col); particle != nil {
+		return particle.state
+	}
+
+	return VOID
 }
 
 func (e *Engine) getNeighbors(row, column int) (neighbors1 []State, neighbors2 []State) {
-	e.asyncMu.RLock()
-	defer e.asyncMu.RUnlock()
-
-	neighbors1 = make([]State, 0)
-	neighbors2 = make([]State, 0)
-
-	// L
-	curRow := row
-	curCol := column - 1
-	neighbors1 = append(neighbors1, e.getSafeState(curRow, curCol))
+	// [L, R, UL, UR, LL, LR]
+	neighbors1 = e.getStates(e.n1Cells(row, column))
+	// [2L, 2R, U2L, U2R, L2L, L2R]
+	neighbors2 = e.getStates(e.n2Cells(row, column))
 
-	// R
-	curCol = column + 1
-	neighbors1 = append(neighbors1, e.getSafeState(curRow, curCol))
-
-	// UL
-	curRow = row - 1
-	curCol = column
-	if curRow%2 == 0 {
-		curCol -= 1
-	}
-	neighbors1 = append(neighbors1, e.getSafeState(curRow, curCol))
+	return neighbors1, neighbors2
+}
 
-	// UR
-	curRow = row - 1
-	curCol = column
-	if curRow%2 != 0 {
-		curCol += 1
-	}
-	neighbors1 = append(neighbors1, e.getSafeState(curRow, curCol))
+// getStates returns the states of some cells
+func (e *Engine) getStates(cells []cell) []State {
+	e.asyncMu.RLock()
+	defer e.asyncMu.RUnlock()
 
-	// LL
-	curRow = row + 1
-	curCol = column
-	if curRow%2 == 0 {
-		curCol -= 1
-	}
-	neighbors1 = append(neighbors1, e.getSafeState(curRow, curCol))
+	states := make([]State, 0, len(cells))
 
-	// LR
-	curRow = row + 1
-	curCol = column
-	if curRow%2 != 0 {
-		curCol += 1
+	for _, c := range cells {
+		states = append(states, e.getSafeState(c.row, c.column))
 	}
-	neighbors1 = append(neighbors1, e.getSafeState(curRow, curCol))
 
-	// 2L
-	curRow = row
-	curCol = column - 2
-	neighbors2 = append(neighbors2, e.getSafeState(curRow, curCol))
-
-	// 2R
-	curCol = column + 2
-	neighbors2 = append(neighbors2, e.getSafeState(curRow, curCol))
-
-	// U2L
-	curRow = row - 2
-	curCol = column - 1
-	neighbors2 = append(neighbors2, e.getSafeState(curRow, curCol))
-
-	// U2R
-	curRow = row - 2
-	curCol = column + 1
-	neighbors2 = append(neighbors2, e.getSafeState(curRow, curCol))
-
-	// L2L
-	curRow = row + 2
-	curCol = column - 1
-	neighbors2 = append(neighbors2, e.getSafeState(curRow, curCol))
-
-	// L2R
-	curRow = row + 2
-	curCol = column + 1
-	neighbors2 = append(neighbors2, e.getSafeState(curRow, curCol))
-
-	return neighbors1, neighbors2
+	return states
 }
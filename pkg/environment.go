@@ -0,0 +1,188 @@
+package pkg
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// removeParticle empties the cell [row, column] breaking the bonds of its particle
+func (e *Engine) removeParticle(row, column int) {
+	p := e.particleAt(row, column)
+	if p == nil {
+		return
+	}
+
+	for _, n := range e.bondedNeighbors(row, column) {
+		e.unbond(p, e.world.At(n))
+	}
+
+	e.world.Put(cell{row, column}, nil)
+	e.cellChanged(row, column)
+}
+
+// environmentInputs returns the occupancy map, every particle and obstacle
+// state by "row,column", and the terrain map of the non floor cells
+func (e *Engine) environmentInputs() (map[string]interface{}, map[string]interface{}) {
+	occupancy := make(map[string]interface{})
+
+	e.world.Each(func(c cell, p *Particle) {
+		occupancy[fmt.Sprintf("%d,%d", c.row, c.column)] = p.GetStateS(nil)
+	})
+
+	terrain := make(map[string]interface{}, len(e.terrain))
+	for c, t := range e.terrain {
+		terrain[fmt.Sprintf("%d,%d", c.row, c.column)] = t.String()
+	}
+
+	return occupancy, terrain
+}
+
+// updateEnvironment runs the environment script once per round, between
+// two rounds: at the end of a sync round or, with the other schedulers, once
+// the running activations are over. The changes that would break the world,
+// like a particle in an occupied cell, are skipped.
+func (e *Engine) updateEnvironment() error {
+	if e.environmentScript == nil || (e.schedulerType == SYNC && e.phase != SCHEDULER) {
+		return nil
+	}
+
+	round := e.getRound()
+	if round == math.MaxInt || round <= e.environmentRound {
+		return nil
+	}
+
+	// The async tasks still running belong to the previous round
+	e.asyncTasks.Wait()
+
+	occupancy, terrain := e.environmentInputs()
+
+	if err := e.environmentScript.Add("round", round); err != nil {
+		return err
+	}
+
+	if err := e.environmentScript.Add("occupancy", occupancy); err != nil {
+		return err
+	}
+
+	if err := e.environmentScript.Add("terrain", terrain); err != nil {
+		return err
+	}
+
+	environmentScriptCompiled, err := e.environmentScript.Compile()
+	if err != nil {
+		return err
+	}
+
+	if err := environmentScriptCompiled.Run(); err != nil {
+		return err
+	}
+
+	e.environmentRound = round
+
+	// Removals first, so that a cell can be emptied and filled in the same round
+	for _, name := range []string{"remove", "remove_obstacles"} {
+		cells := environmentScriptCompiled.Get(name)
+		if cells.IsUndefined() {
+			continue
+		}
+
+		for _, key := range cells.Array() {
+			row, column, err := parseCellKey(fmt.Sprintf("%v", key))
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+
+			// A cell with nothing to remove is skipped
+			p := e.particleAt(row, column)
+			if p == nil || (p.state == OBSTACLE) != (name == "remove_obstacles") {
+				continue
+			}
+
+			e.removeParticle(row, column)
+		}
+	}
+
+	spawn := make(map[string]interface{})
+
+	if obstacles := environmentScriptCompiled.Get("add_obstacles"); !obstacles.IsUndefined() {
+		for _, key := range obstacles.Array() {
+			spawn[fmt.Sprintf("%v", key)] = int64(OBSTACLE)
+		}
+	}
+
+	if particles := environmentScriptCompiled.Get("spawn"); !particles.IsUndefined() {
+		for key, state := range particles.Map() {
+			spawn[key] = state
+		}
+	}
+
+	return e.spawnParticles(spawn, round)
+}
+
+// spawnParticles places new particles, by "row,column", in the free cells.
+// The states are numbers or names and the new particles start at round.
+func (e *Engine) spawnParticles(spawn map[string]interface{}, round int) error {
+	keys := make([]string, 0, len(spawn))
+	for key := range spawn {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		row, column, err := parseCellKey(key)
+		if err != nil {
+			return fmt.Errorf("spawn: %w", err)
+		}
+
+		c := e.wrap(cell{row, column})
+
+		// An occupied cell is skipped, the swarm may have moved there
+		if e.getSafeState(c.row, c.column) != VOID || e.terrainAt(c.row, c.column) == HOLE {
+			continue
+		}
+
+		var stateN int
+
+		switch state := spawn[key].(type) {
+		case int64:
+			stateN = int(state)
+		case string:
+			parsed, err := (&Particle{geometry: e.geometry}).parseState(state)
+			if err != nil {
+				return fmt.Errorf("spawn %s: %w", key, err)
+			}
+
+			stateN = int(parsed)
+		default:
+			return fmt.Errorf("spawn %s: '%v' is not a valid state", key, state)
+		}
+
+		if State(stateN) == VOID {
+			continue
+		}
+
+		particle, err := e.newParticle(key, c, stateN)
+		if err != nil {
+			return err
+		}
+
+		particle.round = round
+
+		e.world.Put(c, particle)
+		e.cellChanged(c.row, c.column)
+
+		if e.poissonReady && particle.state != OBSTACLE && particle.rate > 0 {
+			heap.Push(&e.poissonQueue, &activation{
+				particle: particle,
+				row:      c.row,
+				column:   c.column,
+				time:     e.virtualTime + e.nextClockTick(particle),
+			})
+		}
+	}
+
+	return nil
+}
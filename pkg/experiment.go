@@ -0,0 +1,491 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Experiment runs a scenario for every combination of parameter values,
+// Repetitions times each with the seeds Seed, Seed+1, ...: the same seeds
+// for all the combinations. The sync and Poisson runs replay the same way
+// from a seed; the async runs do not, their order depends on the phase sleeps
+// and on the scheduling of the goroutines.
+type Experiment struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Scenario is the scenario file the parameters are set in
+	Scenario string `json:"scenario"`
+	// ScriptsDir holds scheduler.tengo and the particle scripts, "scripts"
+	// by default
+	ScriptsDir string `json:"scripts,omitempty"`
+	// Values of the parameters by path in the scenario, the keys of the
+	// objects and the indexes of the arrays separated by dots (e.g.
+	// "generators.1.size" or "scheduler.params.activation_probability")
+	Parameters  map[string][]interface{} `json:"parameters"`
+	Repetitions int                      `json:"repetitions"`
+	// Seed of the first repetition, a random seed if missing
+	Seed *int64 `json:"seed,omitempty"`
+	// MaxRounds stops the runs at a round, 0 keeps the scenario conditions
+	MaxRounds int `json:"max_rounds,omitempty"`
+	// Workers is the number of runs in parallel, the number of CPUs by default
+	Workers int `json:"workers,omitempty"`
+	// Sorted parameter paths, the columns of the CSV files
+	names []string
+}
+
+// ExperimentRun is a run of an experiment: the values of the parameters, in
+// the order of the parameter paths, and the seed
+type ExperimentRun struct {
+	ID          int
+	Combination int
+	Repetition  int
+	Seed        int64
+	Values      []interface{}
+}
+
+// ExperimentResult is the outcome of a run, Err is set for the runs that
+// could not start or failed
+type ExperimentResult struct {
+	Run         ExperimentRun
+	Rounds      int
+	VirtualTime float64
+	Moves       int
+	Failures    int
+	Lost        int
+	StopReason  string
+	Duration    time.Duration
+	Err         error
+}
+
+// ParseExperiment reads an experiment from JSON
+func ParseExperiment(r io.Reader) (*Experiment, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	decoder.UseNumber()
+
+	x := &Experiment{}
+	if err := decoder.Decode(x); err != nil {
+		return nil, err
+	}
+
+	if x.Scenario == "" {
+		return nil, fmt.Errorf("the experiment has no scenario")
+	}
+
+	if x.Repetitions <= 0 {
+		x.Repetitions = 1
+	}
+
+	if x.Workers <= 0 {
+		x.Workers = runtime.NumCPU()
+	}
+
+	if x.Seed == nil {
+		seed := time.Now().UnixNano()
+		x.Seed = &seed
+	}
+
+	for name, values := range x.Parameters {
+		if len(values) == 0 {
+			return nil, fmt.Errorf("parameter %s has no values", name)
+		}
+
+		x.names = append(x.names, name)
+	}
+
+	sort.Strings(x.names)
+
+	return x, nil
+}
+
+// ReadExperiment reads an experiment file
+func ReadExperiment(path string) (*Experiment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	x, err := ParseExperiment(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return x, nil
+}
+
+// Runs returns the runs of the experiment: the Cartesian product of the
+// parameter values, the last parameter changing first, times the
+// repetitions
+func (x *Experiment) Runs() []ExperimentRun {
+	combinations := 1
+	for _, name := range x.names {
+		combinations *= len(x.Parameters[name])
+	}
+
+	runs := make([]ExperimentRun, 0, combinations*x.Repetitions)
+
+	for c := 0; c < combinations; c++ {
+		values := make([]interface{}, len(x.names))
+
+		rest := c
+		for i := len(x.names) - 1; i >= 0; i-- {
+			choices := x.Parameters[x.names[i]]
+			values[i] = choices[rest%len(choices)]
+			rest /= len(choices)
+		}
+
+		for rep := 0; rep < x.Repetitions; rep++ {
+			runs = append(runs, ExperimentRun{len(runs), c, rep, *x.Seed + int64(rep), values})
+		}
+	}
+
+	return runs
+}
+
+// scenario returns the scenario of a run, with the values of its
+// parameters
+func (x *Experiment) scenario(src []byte, run ExperimentRun) (*Scenario, error) {
+	decoder := json.NewDecoder(bytes.NewReader(src))
+	decoder.UseNumber()
+
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", x.Scenario, err)
+	}
+
+	for i, name := range x.names {
+		var err error
+		if doc, err = setJSONPath(doc, strings.Split(name, "."), run.Values[i]); err != nil {
+			return nil, fmt.Errorf("parameter %s: %w", name, err)
+		}
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := ParseScenario(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", x.Scenario, err)
+	}
+
+	s.dir = filepath.Dir(x.Scenario)
+
+	return s, nil
+}
+
+// setJSONPath sets the value at a path of a decoded JSON document, the
+// missing object keys are created
+func setJSONPath(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	switch v := doc.(type) {
+	case nil:
+		child, err := setJSONPath(nil, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{path[0]: child}, nil
+	case map[string]interface{}:
+		child, err := setJSONPath(v[path[0]], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+
+		v[path[0]] = child
+
+		return v, nil
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= len(v) {
+			return nil, fmt.Errorf("'%s' is not an index of a list of %d items", path[0], len(v))
+		}
+
+		if v[i], err = setJSONPath(v[i], path[1:], value); err != nil {
+			return nil, err
+		}
+
+		return v, nil
+	}
+
+	return nil, fmt.Errorf("'%s' is not in an object or a list", path[0])
+}
+
+// runOne runs a scenario until a stop condition
+func (x *Experiment) runOne(src []byte, run ExperimentRun) (res ExperimentResult) {
+	res.Run = run
+	start := time.Now()
+
+	// A failing script panics in the update of the engine
+	defer func() {
+		if r := recover(); r != nil {
+			res.Err = fmt.Errorf("%v", r)
+		}
+
+		res.Duration = time.Since(start)
+	}()
+
+	s, err := x.scenario(src, run)
+	if err != nil {
+		res.Err = err
+
+		return res
+	}
+
+	seed := run.Seed
+	o := Options{Scenario: x.Scenario, ScriptsDir: x.ScriptsDir, Seed: &seed, MaxRounds: x.MaxRounds, Quiet: true, scenario: s}
+
+	// The engine ends with the run, also when it panics
+	e := &Engine{}
+	defer e.Close()
+
+	if _, err := o.setupEngine(e); err != nil {
+		res.Err = err
+
+		return res
+	}
+
+	if err := e.runUntilStopped(0); err != nil {
+		res.Err = err
+
+		return res
+	}
+
+	res.Rounds = e.getRound()
+	if res.Rounds == math.MaxInt {
+		res.Rounds = 0
+	}
+
+	res.VirtualTime = e.virtualTime
+	res.Moves, res.Failures = e.Moves()
+	res.Lost = e.LostParticles()
+	res.StopReason = e.StopReason()
+
+	return res
+}
+
+// Run executes the runs of the experiment, Workers at a time, and writes a
+// CSV row to w as each run ends. The results are returned by run id.
+func (x *Experiment) Run(w io.Writer) ([]ExperimentResult, error) {
+	src, err := ioutil.ReadFile(x.Scenario)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := csv.NewWriter(w)
+
+	header := append([]string{"run", "repetition", "seed"}, x.names...)
+	header = append(header, "rounds", "virtual_time", "moves", "failures", "lost", "stop_reason", "duration_ms", "error")
+
+	if err := writer.Write(header); err != nil {
+		return nil, err
+	}
+
+	runs := x.Runs()
+	jobs := make(chan ExperimentRun)
+	results := make(chan ExperimentResult)
+
+	var workers sync.WaitGroup
+
+	for i := 0; i < x.Workers; i++ {
+		workers.Add(1)
+
+		go func() {
+			defer workers.Done()
+
+			for run := range jobs {
+				results <- x.runOne(src, run)
+			}
+		}()
+	}
+
+	go func() {
+		for _, run := range runs {
+			jobs <- run
+		}
+
+		close(jobs)
+		workers.Wait()
+		close(results)
+	}()
+
+	res := make([]ExperimentResult, len(runs))
+
+	for result := range results {
+		res[result.Run.ID] = result
+
+		if err == nil {
+			err = x.writeResult(writer, result)
+		}
+	}
+
+	return res, err
+}
+
+func (x *Experiment) writeResult(writer *csv.Writer, r ExperimentResult) error {
+	row := []string{strconv.Itoa(r.Run.ID), strconv.Itoa(r.Run.Repetition), strconv.FormatInt(r.Run.Seed, 10)}
+
+	for _, value := range r.Run.Values {
+		row = append(row, fmt.Sprint(value))
+	}
+
+	errMsg := ""
+	if r.Err != nil {
+		errMsg = r.Err.Error()
+	}
+
+	row = append(row,
+		strconv.Itoa(r.Rounds),
+		strconv.FormatFloat(r.VirtualTime, 'f', -1, 64),
+		strconv.Itoa(r.Moves),
+		strconv.Itoa(r.Failures),
+		strconv.Itoa(r.Lost),
+		r.StopReason,
+		strconv.FormatInt(r.Duration.Milliseconds(), 10),
+		errMsg,
+	)
+
+	if err := writer.Write(row); err != nil {
+		return err
+	}
+
+	// A long experiment keeps the finished runs if it is interrupted
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// tCritical95 are the two-sided 95% critical values of the Student t
+// distribution for 1..30 degrees of freedom
+var tCritical95 = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// meanCI returns the mean of the samples and the half width of its 95%
+// confidence interval, NaN with less than two samples
+func meanCI(samples []float64) (float64, float64) {
+	n := len(samples)
+	if n == 0 {
+		return math.NaN(), math.NaN()
+	}
+
+	mean := 0.0
+	for _, s := range samples {
+		mean += s
+	}
+
+	mean /= float64(n)
+
+	if n < 2 {
+		return mean, math.NaN()
+	}
+
+	variance := 0.0
+	for _, s := range samples {
+		variance += (s - mean) * (s - mean)
+	}
+
+	variance /= float64(n - 1)
+
+	t := 1.96
+	if n-1 <= len(tCritical95) {
+		t = tCritical95[n-2]
+	}
+
+	return mean, t * math.Sqrt(variance/float64(n))
+}
+
+func formatStat(v float64) string {
+	if math.IsNaN(v) {
+		return ""
+	}
+
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
+
+// WriteSummary writes a CSV row per combination of parameter values: the
+// number of runs, of failed runs, and the mean and the half width of the 95%
+// confidence interval of the rounds, the moves and the failures of the runs
+// that did not fail
+func (x *Experiment) WriteSummary(w io.Writer, results []ExperimentResult) error {
+	writer := csv.NewWriter(w)
+
+	header := append([]string{}, x.names...)
+	header = append(header, "runs", "errors",
+		"rounds_mean", "rounds_ci95", "moves_mean", "moves_ci95", "failures_mean", "failures_ci95")
+
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	byCombination := make(map[int][]ExperimentResult)
+	combinations := make([]int, 0)
+
+	for _, r := range results {
+		if _, ok := byCombination[r.Run.Combination]; !ok {
+			combinations = append(combinations, r.Run.Combination)
+		}
+
+		byCombination[r.Run.Combination] = append(byCombination[r.Run.Combination], r)
+	}
+
+	sort.Ints(combinations)
+
+	for _, c := range combinations {
+		group := byCombination[c]
+		rounds, moves, failures := []float64{}, []float64{}, []float64{}
+		errors := 0
+
+		for _, r := range group {
+			if r.Err != nil {
+				errors += 1
+
+				continue
+			}
+
+			rounds = append(rounds, float64(r.Rounds))
+			moves = append(moves, float64(r.Moves))
+			failures = append(failures, float64(r.Failures))
+		}
+
+		row := make([]string, 0, len(header))
+		for _, value := range group[0].Run.Values {
+			row = append(row, fmt.Sprint(value))
+		}
+
+		row = append(row, strconv.Itoa(len(group)), strconv.Itoa(errors))
+
+		for _, samples := range [][]float64{rounds, moves, failures} {
+			mean, ci := meanCI(samples)
+			row = append(row, formatStat(mean), formatStat(ci))
+		}
+
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+
+	return writer.Error()
+}
@@ -0,0 +1,98 @@
+package pkg
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestMeanCI(t *testing.T) {
+	// 32 samples, 31 degrees of freedom beyond the table of t: the normal
+	// value
+	many := make([]float64, 32)
+	for i := range many {
+		many[i] = float64(2 * (i % 2))
+	}
+
+	tests := []struct {
+		samples   []float64
+		mean      float64
+		halfWidth float64
+	}{
+		{nil, math.NaN(), math.NaN()},
+		{[]float64{4}, 4, math.NaN()},
+		{[]float64{2, 4}, 3, 12.706},
+		{[]float64{1, 2, 3}, 2, 4.303 / math.Sqrt(3)},
+		{[]float64{5, 5, 5, 5}, 5, 0},
+		{many, 1, 1.96 * math.Sqrt(32.0/31/32)},
+	}
+
+	for _, tt := range tests {
+		mean, halfWidth := meanCI(tt.samples)
+
+		if !sameFloat(mean, tt.mean) || !sameFloat(halfWidth, tt.halfWidth) {
+			t.Errorf("%v: got %v ± %v, want %v ± %v", tt.samples, mean, halfWidth, tt.mean, tt.halfWidth)
+		}
+	}
+}
+
+func sameFloat(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestSetJSONPath(t *testing.T) {
+	doc := `{"seed": 1, "world": {"rows": 10}, "particle": {"scripts": [{"script": "a.tengo"}, {"script": "b.tengo"}]}}`
+
+	tests := []struct {
+		path  string
+		value interface{}
+		want  string
+		err   string
+	}{
+		{"seed", 7.0, `"seed":7`, ""},
+		{"world.rows", 20.0, `"world":{"rows":20}`, ""},
+		{"world.cols", 30.0, `"world":{"cols":30,"rows":10}`, ""},
+		{"stop.max_rounds", 100.0, `"stop":{"max_rounds":100}`, ""},
+		{"particle.scripts.1.script", "c.tengo", `[{"script":"a.tengo"},{"script":"c.tengo"}]`, ""},
+		{"particle.scripts.2.script", "c.tengo", "", "'2' is not an index of a list of 2 items"},
+		{"particle.scripts.x", "c.tengo", "", "'x' is not an index of a list of 2 items"},
+		{"seed.value", 7.0, "", "'value' is not in an object or a list"},
+	}
+
+	for _, tt := range tests {
+		var v interface{}
+		if err := json.Unmarshal([]byte(doc), &v); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := setJSONPath(v, strings.Split(tt.path, "."), tt.value)
+
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got %v, want %s", tt.path, err, tt.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.path, err)
+
+			continue
+		}
+
+		data, err := json.Marshal(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(string(data), tt.want) {
+			t.Errorf("%s: got %s, want %s in it", tt.path, data, tt.want)
+		}
+	}
+}
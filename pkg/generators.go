@@ -0,0 +1,815 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/d5/tengo/v2"
+)
+
+// A generator draws a family of shapes at any size, for the scaling studies.
+// It is described by a spec map: "type" is the name of the generator, the
+// other keys are its parameters. Cells are "row,column" strings or
+// [row, column] arrays, states and directions are numbers or names.
+//
+//	blob      random connected shape of size cells grown around center
+//	line      length cells from start in direction
+//	hexagon   filled ball of radius around center, a hexagon on hex
+//	ring      cells at distance radius from center
+//	spiral    size cells along a spiral around center, ring after ring
+//	obstacles every cell of the area, from "from" rows x cols, is an
+//	          obstacle with probability density
+//	corridor  straight free path of length cells from start in direction,
+//	          walled with obstacles on both sides
+//	maze      random maze of obstacles in the area, from "from" rows x cols
+//	          (hex and square only)
+//
+// The shapes are made of state cells, CONTRACTED by default; the obstacles,
+// corridors and mazes are made of OBSTACLE cells and also clear their free
+// cells, so that they can be carved into the cells of the previous ones.
+
+// generatorNames are the generators in the order of the docs
+var generatorNames = []string{"blob", "line", "hexagon", "ring", "spiral", "obstacles", "corridor", "maze"}
+
+// generatorLimit is the largest number of cells of a generated shape
+const generatorLimit = 1 << 20
+
+// Generate runs a generator spec and returns its cells in the init_state
+// format, checking that they fit the world. A world without a size, that
+// fills the window, is only checked when the particles are placed.
+func Generate(spec map[string]interface{}, config WorldConfig, rng *rand.Rand) (map[string]interface{}, error) {
+	geometry := config.Geometry
+	if geometry == nil {
+		geometry = HexGeometry{}
+	}
+
+	name := strings.ToLower(fmt.Sprintf("%v", spec["type"]))
+	g := &generator{spec: spec, geometry: geometry, world: config, rng: rng}
+
+	var (
+		cells map[cell]State
+		err   error
+	)
+
+	switch name {
+	case "blob":
+		cells, err = g.blob()
+	case "line":
+		cells, err = g.line()
+	case "hexagon":
+		cells, err = g.hexagon()
+	case "ring":
+		cells, err = g.ring()
+	case "spiral":
+		cells, err = g.spiral()
+	case "obstacles":
+		cells, err = g.obstacles()
+	case "corridor":
+		cells, err = g.corridor()
+	case "maze":
+		cells, err = g.maze()
+	default:
+		return nil, fmt.Errorf("'%v' is not a valid generator, expected one of %s", spec["type"], strings.Join(generatorNames, ", "))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("generator %s: %w", name, err)
+	}
+
+	if err := g.fits(cells); err != nil {
+		return nil, fmt.Errorf("generator %s: %w", name, err)
+	}
+
+	res := make(map[string]interface{}, len(cells))
+	for c, state := range cells {
+		res[fmt.Sprintf("%d,%d", c.row, c.column)] = int64(state)
+	}
+
+	return res, nil
+}
+
+type generator struct {
+	spec     map[string]interface{}
+	geometry Geometry
+	world    WorldConfig
+	rng      *rand.Rand
+}
+
+// fits returns an error if a cell is beyond the wall or, on a torus, if the
+// shape wraps onto itself
+func (g *generator) fits(cells map[cell]State) error {
+	if g.world.Boundary == GROW || g.world.Rows <= 0 || g.world.Cols <= 0 {
+		return nil
+	}
+
+	wrapped := make(map[cell]cell, len(cells))
+
+	for c := range cells {
+		if g.world.Boundary != TORUS {
+			if c.row < 0 || c.row >= g.world.Rows || c.column < 0 || c.column >= g.world.Cols {
+				return fmt.Errorf("cell %d,%d is outside the %dx%d world", c.row, c.column, g.world.Rows, g.world.Cols)
+			}
+
+			continue
+		}
+
+		w := cell{mod(c.row, g.world.Rows), mod(c.column, g.world.Cols)}
+		if other, ok := wrapped[w]; ok {
+			return fmt.Errorf("cells %d,%d and %d,%d wrap onto the same cell of the %dx%d world",
+				other.row, other.column, c.row, c.column, g.world.Rows, g.world.Cols)
+		}
+
+		wrapped[w] = c
+	}
+
+	return nil
+}
+
+// inside is true for the cells a growing shape can use
+func (g *generator) inside(c cell) bool {
+	if g.world.Boundary != WALL || g.world.Rows <= 0 || g.world.Cols <= 0 {
+		return true
+	}
+
+	return c.row >= 0 && c.row < g.world.Rows && c.column >= 0 && c.column < g.world.Cols
+}
+
+func (g *generator) int(key string, def int) (int, error) {
+	val, ok := g.spec[key]
+	if !ok {
+		return def, nil
+	}
+
+	switch v := val.(type) {
+	case int64:
+		return int(v), nil
+	case int:
+		return v, nil
+	case float64:
+		if v == math.Trunc(v) {
+			return int(v), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%s '%v' is not an integer", key, val)
+}
+
+// size returns a positive integer parameter
+func (g *generator) size(key string, def int) (int, error) {
+	n, err := g.int(key, def)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 0 || n > generatorLimit {
+		return 0, fmt.Errorf("%s %d is not in [0, %d]", key, n, generatorLimit)
+	}
+
+	return n, nil
+}
+
+func (g *generator) float(key string, def float64) (float64, error) {
+	val, ok := g.spec[key]
+	if !ok {
+		return def, nil
+	}
+
+	switch v := val.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	}
+
+	return 0, fmt.Errorf("%s '%v' is not a number", key, val)
+}
+
+func (g *generator) cell(key string, def cell) (cell, error) {
+	val, ok := g.spec[key]
+	if !ok {
+		return def, nil
+	}
+
+	switch v := val.(type) {
+	case string:
+		row, column, err := parseCellKey(v)
+		if err != nil {
+			return cell{}, fmt.Errorf("%s: %w", key, err)
+		}
+
+		return cell{row, column}, nil
+	case []interface{}:
+		if len(v) == 2 {
+			row, okRow := v[0].(int64)
+			column, okColumn := v[1].(int64)
+
+			if okRow && okColumn {
+				return cell{int(row), int(column)}, nil
+			}
+		}
+	}
+
+	return cell{}, fmt.Errorf("%s '%v' is not a cell", key, val)
+}
+
+func (g *generator) state(def State) (State, error) {
+	val, ok := g.spec["state"]
+	if !ok {
+		return def, nil
+	}
+
+	parser := &Particle{geometry: g.geometry}
+
+	switch v := val.(type) {
+	case int64:
+		if err := parser.SetStateN(int(v)); err != nil {
+			return VOID, err
+		}
+
+		return parser.state, nil
+	case string:
+		return parser.parseState(strings.ToUpper(v))
+	}
+
+	return VOID, fmt.Errorf("state '%v' is not a valid state", val)
+}
+
+func (g *generator) direction() (int, error) {
+	val, ok := g.spec["direction"]
+	if !ok {
+		return 1, nil
+	}
+
+	directions := g.geometry.Directions()
+
+	switch v := val.(type) {
+	case int64:
+		if v >= 0 && int(v) < len(directions) {
+			return int(v), nil
+		}
+	case string:
+		for d, name := range directions {
+			if name == strings.ToLower(v) {
+				return d, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("direction '%v' is not one of %s", val, strings.Join(directions, ", "))
+}
+
+// area returns the first cell and the size of the area of the obstacles and
+// of the mazes, the whole world by default
+func (g *generator) area() (cell, int, int, error) {
+	from, err := g.cell("from", cell{0, 0})
+	if err != nil {
+		return cell{}, 0, 0, err
+	}
+
+	rows, err := g.size("rows", g.world.Rows)
+	if err != nil {
+		return cell{}, 0, 0, err
+	}
+
+	cols, err := g.size("cols", g.world.Cols)
+	if err != nil {
+		return cell{}, 0, 0, err
+	}
+
+	if rows <= 0 || cols <= 0 {
+		return cell{}, 0, 0, fmt.Errorf("rows and cols are needed when the world has no size")
+	}
+
+	if rows*cols > generatorLimit {
+		return cell{}, 0, 0, fmt.Errorf("%dx%d is larger than %d cells", rows, cols, generatorLimit)
+	}
+
+	return from, rows, cols, nil
+}
+
+// rings returns the cells around center by distance, up to radius or until
+// they are at least cells, the cells of a ring in clockwise order from the left
+func (g *generator) rings(center cell, radius, cells int) ([][]cell, error) {
+	res := [][]cell{{center}}
+	seen := map[cell]bool{center: true}
+
+	// Clockwise on the screen, with y growing down, from the left
+	cx, cy := g.geometry.Center(center.row, center.column, 64)
+	angle := func(c cell) float64 {
+		x, y := g.geometry.Center(c.row, c.column, 64)
+
+		return math.Mod(math.Atan2(float64(cy-y), float64(cx-x))+2*math.Pi, 2*math.Pi)
+	}
+
+	for r := 1; r <= radius && len(seen) < cells; r++ {
+		next := make([]cell, 0)
+
+		for _, c := range res[r-1] {
+			for d := range g.geometry.Directions() {
+				row, column := g.geometry.Neighbor(c.row, c.column, d)
+				n := cell{row, column}
+
+				if !seen[n] {
+					seen[n] = true
+					next = append(next, n)
+				}
+			}
+		}
+
+		if len(seen) > generatorLimit {
+			return nil, fmt.Errorf("radius %d is larger than %d cells", radius, generatorLimit)
+		}
+
+		sort.SliceStable(next, func(i, j int) bool { return angle(next[i]) < angle(next[j]) })
+
+		res = append(res, next)
+	}
+
+	return res, nil
+}
+
+func (g *generator) blob() (map[cell]State, error) {
+	center, err := g.cell("center", cell{0, 0})
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := g.size("size", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := g.state(CONTRACTED)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[cell]State, n)
+	if n == 0 {
+		return res, nil
+	}
+
+	if !g.inside(center) {
+		return nil, fmt.Errorf("center %d,%d is outside the world", center.row, center.column)
+	}
+
+	// Grow from a random member in a random direction, the members are kept
+	// in a slice for a seeded run to draw the same shape
+	members := []cell{center}
+	res[center] = state
+
+	for attempts := 0; len(members) < n; attempts++ {
+		if attempts > 100*n {
+			return nil, fmt.Errorf("no room for %d cells around %d,%d", n, center.row, center.column)
+		}
+
+		c := members[g.rng.Intn(len(members))]
+		row, column := g.geometry.Neighbor(c.row, c.column, g.rng.Intn(len(g.geometry.Directions())))
+		next := cell{row, column}
+
+		if _, ok := res[next]; ok || !g.inside(next) {
+			continue
+		}
+
+		members = append(members, next)
+		res[next] = state
+	}
+
+	return res, nil
+}
+
+func (g *generator) line() (map[cell]State, error) {
+	start, err := g.cell("start", cell{0, 0})
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := g.direction()
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := g.size("length", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := g.state(CONTRACTED)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[cell]State, n)
+	for _, c := range g.path(start, d, n) {
+		res[c] = state
+	}
+
+	return res, nil
+}
+
+// path returns n cells from start in direction d
+func (g *generator) path(start cell, d, n int) []cell {
+	res := make([]cell, 0, n)
+
+	for c := start; len(res) < n; {
+		res = append(res, c)
+		c.row, c.column = g.geometry.Neighbor(c.row, c.column, d)
+	}
+
+	return res
+}
+
+func (g *generator) hexagon() (map[cell]State, error) {
+	return g.ball(false)
+}
+
+func (g *generator) ring() (map[cell]State, error) {
+	return g.ball(true)
+}
+
+// ball returns the cells within radius of center, or only the outer ring
+func (g *generator) ball(outer bool) (map[cell]State, error) {
+	center, err := g.cell("center", cell{0, 0})
+	if err != nil {
+		return nil, err
+	}
+
+	radius, err := g.size("radius", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := g.state(CONTRACTED)
+	if err != nil {
+		return nil, err
+	}
+
+	rings, err := g.rings(center, radius, generatorLimit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	if outer {
+		rings = rings[radius:]
+	}
+
+	res := make(map[cell]State)
+	for _, ring := range rings {
+		for _, c := range ring {
+			res[c] = state
+		}
+	}
+
+	return res, nil
+}
+
+func (g *generator) spiral() (map[cell]State, error) {
+	// With three neighbors a triangle arm gets stuck against its own turns
+	if _, ok := g.geometry.(TriangleGeometry); ok {
+		return nil, fmt.Errorf("spirals need a hex or square geometry")
+	}
+
+	center, err := g.cell("center", cell{0, 0})
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := g.size("size", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := g.state(CONTRACTED)
+	if err != nil {
+		return nil, err
+	}
+
+	arm := g.spiralArm(center, n)
+	if len(arm) < n {
+		return nil, fmt.Errorf("the arm is stuck after %d cells", len(arm))
+	}
+
+	res := make(map[cell]State, n)
+
+	for _, c := range arm {
+		res[c] = state
+	}
+
+	return res, nil
+}
+
+// spiralArm returns up to n cells of an arm winding clockwise around
+// center: every step takes the neighbor turning the most clockwise among the
+// ones that touch no other cell of the arm, so that a free cell separates
+// the turns. The angles are measured on the screen, for every lattice.
+func (g *generator) spiralArm(center cell, n int) []cell {
+	const size = 64
+
+	if n <= 1 {
+		return []cell{center}[:n]
+	}
+
+	// The arm leaves the center towards the left
+	row, column := g.geometry.Neighbor(center.row, center.column, g.geometry.Clockwise(center.row, center.column)[0])
+	arm := []cell{center, {row, column}}
+	seen := map[cell]bool{center: true, {row, column}: true}
+
+	// Direction on the screen of the step from a to b, y grows downwards
+	angle := func(a, b cell) float64 {
+		ax, ay := g.geometry.Center(a.row, a.column, size)
+		bx, by := g.geometry.Center(b.row, b.column, size)
+
+		return math.Atan2(float64(by-ay), float64(bx-ax))
+	}
+
+	for len(arm) < n {
+		prev, last := arm[len(arm)-2], arm[len(arm)-1]
+		heading := angle(prev, last)
+
+		next, best := cell{}, math.Inf(-1)
+
+		for d := range g.geometry.Directions() {
+			row, column := g.geometry.Neighbor(last.row, last.column, d)
+			c := cell{row, column}
+
+			if !g.free(c, last, seen) {
+				continue
+			}
+
+			// Turn in [-pi, pi), clockwise is positive on the screen
+			turn := math.Mod(angle(last, c)-heading+3*math.Pi, 2*math.Pi) - math.Pi
+			if turn > best {
+				next, best = c, turn
+			}
+		}
+
+		if math.IsInf(best, -1) {
+			break
+		}
+
+		seen[next] = true
+		arm = append(arm, next)
+	}
+
+	return arm
+}
+
+// free is true for a cell out of the arm whose only neighbor in the arm is last
+func (g *generator) free(c, last cell, arm map[cell]bool) bool {
+	if arm[c] {
+		return false
+	}
+
+	for d := range g.geometry.Directions() {
+		row, column := g.geometry.Neighbor(c.row, c.column, d)
+		if n := (cell{row, column}); n != last && arm[n] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (g *generator) obstacles() (map[cell]State, error) {
+	from, rows, cols, err := g.area()
+	if err != nil {
+		return nil, err
+	}
+
+	density, err := g.float("density", 0.1)
+	if err != nil {
+		return nil, err
+	}
+
+	if density < 0 || density > 1 {
+		return nil, fmt.Errorf("density %f is not in [0, 1]", density)
+	}
+
+	res := make(map[cell]State)
+
+	for row := from.row; row < from.row+rows; row++ {
+		for column := from.column; column < from.column+cols; column++ {
+			if g.rng.Float64() < density {
+				res[cell{row, column}] = OBSTACLE
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func (g *generator) corridor() (map[cell]State, error) {
+	start, err := g.cell("start", cell{0, 0})
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := g.direction()
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := g.size("length", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[cell]State)
+	if n == 0 {
+		return res, nil
+	}
+
+	path := g.path(start, d, n)
+	for _, c := range path {
+		res[c] = VOID
+	}
+
+	// Both ends stay open
+	open := make(map[cell]bool, 2)
+	row, column := g.geometry.Neighbor(start.row, start.column, g.geometry.Opposite(d))
+	open[cell{row, column}] = true
+	end := path[len(path)-1]
+	row, column = g.geometry.Neighbor(end.row, end.column, d)
+	open[cell{row, column}] = true
+
+	for _, c := range path {
+		for side := range g.geometry.Directions() {
+			row, column := g.geometry.Neighbor(c.row, c.column, side)
+			wall := cell{row, column}
+
+			if _, ok := res[wall]; !ok && !open[wall] {
+				res[wall] = OBSTACLE
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// maze carves a random depth first maze: the rooms are the cells with odd
+// offsets in the area, the walls between two rooms are opened along the
+// spanning tree. The rooms of a row and the ones of a column are N1
+// neighbors on hex and square only.
+func (g *generator) maze() (map[cell]State, error) {
+	if _, ok := g.geometry.(TriangleGeometry); ok {
+		return nil, fmt.Errorf("mazes need a hex or square geometry")
+	}
+
+	from, rows, cols, err := g.area()
+	if err != nil {
+		return nil, err
+	}
+
+	if rows < 3 || cols < 3 {
+		return nil, fmt.Errorf("a maze needs at least 3x3 cells, got %dx%d", rows, cols)
+	}
+
+	res := make(map[cell]State, rows*cols)
+	for row := 0; row < rows; row++ {
+		for column := 0; column < cols; column++ {
+			res[cell{from.row + row, from.column + column}] = OBSTACLE
+		}
+	}
+
+	room := func(i, j int) cell { return cell{from.row + 2*i + 1, from.column + 2*j + 1} }
+	roomRows, roomCols := (rows-1)/2, (cols-1)/2
+
+	visited := make(map[[2]int]bool, roomRows*roomCols)
+	stack := [][2]int{{0, 0}}
+	visited[[2]int{0, 0}] = true
+	res[room(0, 0)] = VOID
+
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		next := make([][2]int, 0, 4)
+
+		for _, delta := range [][2]int{{0, -1}, {0, 1}, {-1, 0}, {1, 0}} {
+			n := [2]int{current[0] + delta[0], current[1] + delta[1]}
+
+			if n[0] >= 0 && n[0] < roomRows && n[1] >= 0 && n[1] < roomCols && !visited[n] {
+				next = append(next, n)
+			}
+		}
+
+		if len(next) == 0 {
+			stack = stack[:len(stack)-1]
+
+			continue
+		}
+
+		n := next[g.rng.Intn(len(next))]
+		a, b := room(current[0], current[1]), room(n[0], n[1])
+
+		visited[n] = true
+		res[b] = VOID
+		res[cell{(a.row + b.row) / 2, (a.column + b.column) / 2}] = VOID
+		stack = append(stack, n)
+	}
+
+	return res, nil
+}
+
+// genModule is the tengo gen module: a function per generator, taking the
+// parameters of its spec, and merge to join the results. The random
+// generators draw from the engine generator of the run.
+func (e *Engine) genModule() map[string]tengo.Object {
+	module := map[string]tengo.Object{
+		"merge": &tengo.UserFunction{
+			Name: "merge",
+			Value: func(args ...tengo.Object) (tengo.Object, error) {
+				res := make(map[string]tengo.Object)
+
+				for i, arg := range args {
+					m, ok := arg.(*tengo.Map)
+					if !ok {
+						return nil, tengo.ErrInvalidArgumentType{
+							Name:     fmt.Sprintf("argument %d", i+1),
+							Expected: "map",
+							Found:    arg.TypeName(),
+						}
+					}
+
+					for key, val := range m.Value {
+						res[key] = val
+					}
+				}
+
+				return &tengo.Map{Value: res}, nil
+			},
+		},
+	}
+
+	for _, name := range generatorNames {
+		name := name
+
+		module[name] = &tengo.UserFunction{
+			Name: name,
+			Value: func(args ...tengo.Object) (tengo.Object, error) {
+				if len(args) != 1 {
+					return nil, tengo.ErrWrongNumArguments
+				}
+
+				spec, ok := tengo.ToInterface(args[0]).(map[string]interface{})
+				if !ok {
+					return nil, tengo.ErrInvalidArgumentType{Name: "spec", Expected: "map", Found: args[0].TypeName()}
+				}
+
+				spec["type"] = name
+
+				config, err := generatorWorld(spec)
+				if err != nil {
+					return nil, err
+				}
+
+				cells, err := Generate(spec, config, e.genRng)
+				if err != nil {
+					return nil, err
+				}
+
+				return tengo.FromInterface(cells)
+			},
+		}
+	}
+
+	return module
+}
+
+// generatorWorld reads the world of a tengo generator call, the world
+// variables of init.tengo can be passed as "world_rows", "world_cols",
+// "world_boundary" and "world_geometry" to check the shape
+func generatorWorld(spec map[string]interface{}) (WorldConfig, error) {
+	config := WorldConfig{}
+
+	if rows, ok := spec["world_rows"].(int64); ok {
+		config.Rows = int(rows)
+	}
+
+	if cols, ok := spec["world_cols"].(int64); ok {
+		config.Cols = int(cols)
+	}
+
+	if boundary, ok := spec["world_boundary"].(string); ok {
+		worldBoundary, err := ParseBoundary(boundary)
+		if err != nil {
+			return config, err
+		}
+
+		config.Boundary = worldBoundary
+	}
+
+	if geometry, ok := spec["world_geometry"].(string); ok {
+		worldGeometry, err := ParseGeometry(geometry)
+		if err != nil {
+			return config, err
+		}
+
+		config.Geometry = worldGeometry
+	}
+
+	return config, nil
+}
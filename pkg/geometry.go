@@ -0,0 +1,365 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/mircot/programmable-matter-simulator/pkg/hex"
+)
+
+// maxDirections is the number of N1 directions of the richest geometry
+const maxDirections = 8
+
+// N2Position is a cell of the N2 view, reached following the N1 directions in Path
+type N2Position struct {
+	Name string
+	Path []int
+}
+
+// Geometry is the lattice of the world: its directions, the neighborhoods
+// of the cells and their placement on the screen. The directions are the
+// indexes of the names returned by Directions.
+type Geometry interface {
+	Name() string
+	// Directions returns the names of the N1 directions, in the order of the script inputs
+	Directions() []string
+	// Opposite returns the direction pointing back
+	Opposite(d int) int
+	// Clockwise returns the directions of a cell in clockwise order, starting from l
+	Clockwise(row, column int) []int
+	// Neighbor returns the N1 neighbor of a cell in a direction
+	Neighbor(row, column, d int) (int, int)
+	// N2 returns the positions of the N2 view, in the order of the script inputs
+	N2() []N2Position
+	// GridDirections returns the directions drawn as grid lines from every cell
+	GridDirections() []int
+	// CheckTorus returns an error if a world of that size cannot wrap around
+	CheckTorus(numRows, numCols int) error
+	// Spacing returns the horizontal distance between two columns and the
+	// vertical one between two rows, for a cell of the given size
+	Spacing(size int) (int, int)
+	// Center returns the pixel coordinates of the center of a cell
+	Center(row, column, size int) (int, int)
+	// FromPixel returns the cell whose center is the nearest to a pixel
+	FromPixel(x, y, size int) (int, int)
+	// Corners returns the pixel coordinates of the corners of a cell, clockwise
+	Corners(row, column, size int) [][2]float64
+}
+
+func ParseGeometry(s string) (Geometry, error) {
+	switch strings.ToLower(s) {
+	case "", "hex":
+		return HexGeometry{}, nil
+	case "square4":
+		return SquareGeometry{Diagonals: false}, nil
+	case "square8":
+		return SquareGeometry{Diagonals: true}, nil
+	case "triangle":
+		return TriangleGeometry{}, nil
+	}
+
+	return nil, fmt.Errorf("'%s' is not a valid geometry", s)
+}
+
+// HexGeometry is the hexagonal grid with even rows shifted right, the
+// N2 view is made of the cells two steps away in every direction
+type HexGeometry struct{}
+
+func (g HexGeometry) Name() string {
+	return "hex"
+}
+
+func (g HexGeometry) Directions() []string {
+	res := make([]string, len(hex.Directions))
+	for i, d := range hex.Directions {
+		res[i] = d.String()
+	}
+
+	return res
+}
+
+func (g HexGeometry) Opposite(d int) int {
+	return int(hex.Direction(d).Opposite())
+}
+
+func (g HexGeometry) Clockwise(row, column int) []int {
+	res := make([]int, len(hex.Clockwise))
+	for i, d := range hex.Clockwise {
+		res[i] = int(d)
+	}
+
+	return res
+}
+
+func (g HexGeometry) Neighbor(row, column, d int) (int, int) {
+	n := hex.Offset{Row: row, Col: column}.Neighbor(hex.Direction(d))
+
+	return n.Row, n.Col
+}
+
+func (g HexGeometry) N2() []N2Position {
+	return []N2Position{
+		{"l2", []int{int(hex.L), int(hex.L)}},
+		{"r2", []int{int(hex.R), int(hex.R)}},
+		{"u2l", []int{int(hex.UL), int(hex.UL)}},
+		{"u2r", []int{int(hex.UR), int(hex.UR)}},
+		{"l2l", []int{int(hex.LL), int(hex.LL)}},
+		{"l2r", []int{int(hex.LR), int(hex.LR)}},
+	}
+}
+
+func (g HexGeometry) GridDirections() []int {
+	return []int{int(hex.R), int(hex.LL), int(hex.LR)}
+}
+
+func (g HexGeometry) CheckTorus(numRows, numCols int) error {
+	// Even rows are shifted, wrapping an odd number of rows breaks the neighborhoods
+	if numRows%2 != 0 {
+		return fmt.Errorf("a toroidal hex world needs an even number of rows, got %d", numRows)
+	}
+
+	return nil
+}
+
+// layout returns the hex layout of a cell size
+// Ref: https://www.redblobgames.com/grids/hexagons/#distances
+func (g HexGeometry) layout(size int) hex.Layout {
+	h := int(math.Sqrt(3) * float64(size))
+
+	return hex.Layout{HalfW: size, HalfH: h / 2}
+}
+
+func (g HexGeometry) Spacing(size int) (int, int) {
+	l := g.layout(size)
+
+	return l.HalfW, l.HalfH
+}
+
+func (g HexGeometry) Center(row, column, size int) (int, int) {
+	return g.layout(size).Center(hex.Offset{Row: row, Col: column})
+}
+
+func (g HexGeometry) FromPixel(x, y, size int) (int, int) {
+	o := g.layout(size).FromPixel(x, y)
+
+	return o.Row, o.Col
+}
+
+func (g HexGeometry) Corners(row, column, size int) [][2]float64 {
+	x, y := g.Center(row, column, size)
+	halfW, halfH := g.Spacing(size)
+
+	// Pointy top: the columns are one width apart, the rows 3/4 of the height
+	r := float64(halfH) * 2 / 3
+
+	return [][2]float64{
+		{float64(x), float64(y) - r},
+		{float64(x) + float64(halfW)/2, float64(y) - r/2},
+		{float64(x) + float64(halfW)/2, float64(y) + r/2},
+		{float64(x), float64(y) + r},
+		{float64(x) - float64(halfW)/2, float64(y) + r/2},
+		{float64(x) - float64(halfW)/2, float64(y) - r/2},
+	}
+}
+
+// SquareGeometry is the square grid with the 4-neighborhood, or the
+// 8-neighborhood with the diagonals
+type SquareGeometry struct {
+	Diagonals bool
+}
+
+var squareDirections = []string{"l", "r", "u", "d", "ul", "ur", "ll", "lr"}
+
+// [l, r, u, d, ul, ur, ll, lr] as [row, column] deltas
+var squareDeltas = [][2]int{{0, -1}, {0, 1}, {-1, 0}, {1, 0}, {-1, -1}, {-1, 1}, {1, -1}, {1, 1}}
+
+func (g SquareGeometry) Name() string {
+	if g.Diagonals {
+		return "square8"
+	}
+
+	return "square4"
+}
+
+func (g SquareGeometry) Directions() []string {
+	if g.Diagonals {
+		return squareDirections
+	}
+
+	return squareDirections[:4]
+}
+
+func (g SquareGeometry) Opposite(d int) int {
+	return []int{1, 0, 3, 2, 7, 6, 5, 4}[d]
+}
+
+func (g SquareGeometry) Clockwise(row, column int) []int {
+	if g.Diagonals {
+		// [l, ul, u, ur, r, lr, d, ll]
+		return []int{0, 4, 2, 5, 1, 7, 3, 6}
+	}
+
+	// [l, u, r, d]
+	return []int{0, 2, 1, 3}
+}
+
+func (g SquareGeometry) Neighbor(row, column, d int) (int, int) {
+	return row + squareDeltas[d][0], column + squareDeltas[d][1]
+}
+
+func (g SquareGeometry) N2() []N2Position {
+	names := []string{"l2", "r2", "u2", "d2", "u2l", "u2r", "l2l", "l2r"}
+	res := make([]N2Position, 0, len(names))
+
+	for d := range g.Directions() {
+		res = append(res, N2Position{names[d], []int{d, d}})
+	}
+
+	return res
+}
+
+func (g SquareGeometry) GridDirections() []int {
+	return []int{1, 3}
+}
+
+func (g SquareGeometry) CheckTorus(numRows, numCols int) error {
+	return nil
+}
+
+func (g SquareGeometry) Spacing(size int) (int, int) {
+	return size, size
+}
+
+func (g SquareGeometry) Center(row, column, size int) (int, int) {
+	return column * size, row * size
+}
+
+func (g SquareGeometry) FromPixel(x, y, size int) (int, int) {
+	return int(math.Round(float64(y) / float64(size))), int(math.Round(float64(x) / float64(size)))
+}
+
+func (g SquareGeometry) Corners(row, column, size int) [][2]float64 {
+	x, y := g.Center(row, column, size)
+	half := float64(size) / 2
+
+	return [][2]float64{
+		{float64(x) - half, float64(y) - half},
+		{float64(x) + half, float64(y) - half},
+		{float64(x) + half, float64(y) + half},
+		{float64(x) - half, float64(y) + half},
+	}
+}
+
+// TriangleGeometry is the grid of triangles pointing up, when row + column
+// is even, or down. Every triangle has a left, a right and a vertical
+// neighbor: below the ones pointing up, above the ones pointing down.
+type TriangleGeometry struct{}
+
+func (g TriangleGeometry) Name() string {
+	return "triangle"
+}
+
+func (g TriangleGeometry) Directions() []string {
+	return []string{"l", "r", "v"}
+}
+
+func (g TriangleGeometry) Opposite(d int) int {
+	return []int{1, 0, 2}[d]
+}
+
+func (g TriangleGeometry) pointsUp(row, column int) bool {
+	return mod(row+column, 2) == 0
+}
+
+func (g TriangleGeometry) Clockwise(row, column int) []int {
+	if g.pointsUp(row, column) {
+		// [l, r, v] with v below
+		return []int{0, 1, 2}
+	}
+
+	// [l, v, r] with v above
+	return []int{0, 2, 1}
+}
+
+func (g TriangleGeometry) Neighbor(row, column, d int) (int, int) {
+	switch d {
+	case 0:
+		return row, column - 1
+	case 1:
+		return row, column + 1
+	}
+
+	if g.pointsUp(row, column) {
+		return row + 1, column
+	}
+
+	return row - 1, column
+}
+
+func (g TriangleGeometry) N2() []N2Position {
+	return []N2Position{
+		{"l2", []int{0, 0}},
+		{"r2", []int{1, 1}},
+		{"vl", []int{2, 0}},
+		{"vr", []int{2, 1}},
+	}
+}
+
+func (g TriangleGeometry) GridDirections() []int {
+	return []int{1, 2}
+}
+
+func (g TriangleGeometry) CheckTorus(numRows, numCols int) error {
+	// The direction of a triangle depends on the parity of row + column
+	if numRows%2 != 0 || numCols%2 != 0 {
+		return fmt.Errorf("a toroidal triangle world needs an even number of rows and columns, got %dx%d", numRows, numCols)
+	}
+
+	return nil
+}
+
+func (g TriangleGeometry) Spacing(size int) (int, int) {
+	return size, int(math.Sqrt(3) * float64(size))
+}
+
+func (g TriangleGeometry) Center(row, column, size int) (int, int) {
+	_, h := g.Spacing(size)
+
+	// The centroid is at 2/3 of the height from the apex
+	if g.pointsUp(row, column) {
+		return column * size, row*h + 2*h/3
+	}
+
+	return column * size, row*h + h/3
+}
+
+func (g TriangleGeometry) FromPixel(x, y, size int) (int, int) {
+	_, h := g.Spacing(size)
+	row := int(math.Floor(float64(y) / float64(h)))
+	column := int(math.Round(float64(x) / float64(size)))
+
+	bestRow, bestColumn, bestDist := row, column, math.MaxInt
+
+	for r := row - 1; r <= row+1; r++ {
+		for c := column - 1; c <= column+1; c++ {
+			cx, cy := g.Center(r, c, size)
+			if dist := (cx-x)*(cx-x) + (cy-y)*(cy-y); dist < bestDist {
+				bestRow, bestColumn, bestDist = r, c, dist
+			}
+		}
+	}
+
+	return bestRow, bestColumn
+}
+
+func (g TriangleGeometry) Corners(row, column, size int) [][2]float64 {
+	_, h := g.Spacing(size)
+	x, top, bottom := float64(column*size), float64(row*h), float64(row*h+h)
+
+	if g.pointsUp(row, column) {
+		return [][2]float64{{x, top}, {x + float64(size), bottom}, {x - float64(size), bottom}}
+	}
+
+	return [][2]float64{{x - float64(size), top}, {x + float64(size), top}, {x, bottom}}
+}
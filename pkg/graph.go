@@ -0,0 +1,482 @@
+package pkg
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GraphFormat is the file format of a snapshot of the particle graph
+type GraphFormat int
+
+const (
+	DOT GraphFormat = iota
+	GRAPHML
+)
+
+func ParseGraphFormat(s string) (GraphFormat, error) {
+	switch strings.ToLower(s) {
+	case "dot":
+		return DOT, nil
+	case "graphml":
+		return GRAPHML, nil
+	}
+
+	return -1, fmt.Errorf("'%s' is not a valid graph format", s)
+}
+
+func (f GraphFormat) String() string {
+	return [...]string{"dot", "graphml"}[f]
+}
+
+// GraphNode is an occupied cell, identified by its particle so that it
+// keeps its id when it moves
+type GraphNode struct {
+	ID     string
+	Row    int
+	Column int
+	// Kind is "particle" or "obstacle"
+	Kind  string
+	State string
+}
+
+// GraphEdge joins two N1 neighbors, Source < Target
+type GraphEdge struct {
+	Source string
+	Target string
+	Bonded bool
+}
+
+// Graph is the adjacency graph of the occupied cells, the nodes sorted by
+// cell and the edges by id
+type Graph struct {
+	Nodes []GraphNode
+	Edges []GraphEdge
+}
+
+// Graph builds the graph of the particles with the N1 adjacency, with the
+// obstacles as nodes of their own kind if obstacles is set
+func (e *Engine) Graph(obstacles bool) *Graph {
+	g := &Graph{}
+	ids := make(map[cell]string)
+
+	e.world.Each(func(c cell, p *Particle) {
+		kind := "particle"
+		if p.state == OBSTACLE {
+			if !obstacles {
+				return
+			}
+
+			kind = "obstacle"
+		}
+
+		ids[c] = fmt.Sprintf("n%d", p.id)
+		g.Nodes = append(g.Nodes, GraphNode{ids[c], c.row, c.column, kind, p.GetStateS(nil)})
+	})
+
+	// The edges are the N1 neighbors a particle sees, getNeighbors and
+	// n1Cells follow the same order of the directions
+	for c, id := range ids {
+		neighbors1, _ := e.getNeighbors(c.row, c.column)
+
+		for i, n := range e.n1Cells(c.row, c.column) {
+			if neighbors1[i] == VOID {
+				continue
+			}
+
+			nID, ok := ids[n]
+			if !ok || nID <= id {
+				continue
+			}
+
+			g.Edges = append(g.Edges, GraphEdge{id, nID, e.bonded(e.world.At(c), e.world.At(n))})
+		}
+	}
+
+	sort.Slice(g.Nodes, func(i, j int) bool {
+		if g.Nodes[i].Row != g.Nodes[j].Row {
+			return g.Nodes[i].Row < g.Nodes[j].Row
+		}
+
+		return g.Nodes[i].Column < g.Nodes[j].Column
+	})
+	sort.Slice(g.Edges, func(i, j int) bool {
+		if g.Edges[i].Source != g.Edges[j].Source {
+			return g.Edges[i].Source < g.Edges[j].Source
+		}
+
+		return g.Edges[i].Target < g.Edges[j].Target
+	})
+
+	return g
+}
+
+// Write writes the graph in a format
+func (g *Graph) Write(w io.Writer, format GraphFormat) error {
+	if format == GRAPHML {
+		return g.WriteGraphML(w)
+	}
+
+	return g.WriteDOT(w)
+}
+
+// WriteDOT writes the graph in the Graphviz DOT language, the bonds are
+// bold edges
+func (g *Graph) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+
+	b.WriteString("graph particles {\n")
+
+	for _, n := range g.Nodes {
+		shape := "circle"
+		if n.Kind == "obstacle" {
+			shape = "box"
+		}
+
+		b.WriteString(fmt.Sprintf("  %s [label=\"%d,%d\", kind=%s, state=%s, row=%d, column=%d, shape=%s];\n",
+			n.ID, n.Row, n.Column, n.Kind, n.State, n.Row, n.Column, shape))
+	}
+
+	for _, edge := range g.Edges {
+		if edge.Bonded {
+			b.WriteString(fmt.Sprintf("  %s -- %s [bonded=true, style=bold];\n", edge.Source, edge.Target))
+		} else {
+			b.WriteString(fmt.Sprintf("  %s -- %s;\n", edge.Source, edge.Target))
+		}
+	}
+
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+type xmlKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type xmlData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type graphMLNode struct {
+	ID   string    `xml:"id,attr"`
+	Data []xmlData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string    `xml:"source,attr"`
+	Target string    `xml:"target,attr"`
+	Data   []xmlData `xml:"data"`
+}
+
+type graphML struct {
+	XMLName xml.Name `xml:"graphml"`
+	XMLNS   string   `xml:"xmlns,attr"`
+	Keys    []xmlKey `xml:"key"`
+	Graph   struct {
+		ID          string        `xml:"id,attr"`
+		EdgeDefault string        `xml:"edgedefault,attr"`
+		Nodes       []graphMLNode `xml:"node"`
+		Edges       []graphMLEdge `xml:"edge"`
+	} `xml:"graph"`
+}
+
+// WriteGraphML writes the graph as GraphML, with the kind, the state and
+// the cell of the nodes and the bonds of the edges as attributes
+func (g *Graph) WriteGraphML(w io.Writer) error {
+	doc := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []xmlKey{
+			{"kind", "node", "kind", "string"},
+			{"state", "node", "state", "string"},
+			{"row", "node", "row", "int"},
+			{"column", "node", "column", "int"},
+			{"bonded", "edge", "bonded", "boolean"},
+		},
+	}
+
+	doc.Graph.ID = "particles"
+	doc.Graph.EdgeDefault = "undirected"
+
+	for _, n := range g.Nodes {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{n.ID, []xmlData{
+			{"kind", n.Kind},
+			{"state", n.State},
+			{"row", fmt.Sprint(n.Row)},
+			{"column", fmt.Sprint(n.Column)},
+		}})
+	}
+
+	for _, edge := range g.Edges {
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{edge.Source, edge.Target, []xmlData{
+			{"bonded", fmt.Sprint(edge.Bonded)},
+		}})
+	}
+
+	return writeXML(w, doc)
+}
+
+func writeXML(w io.Writer, doc interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+
+	return err
+}
+
+// ExportGraph writes the particle graph to a new timestamped file in dir
+// and returns its path
+func (e *Engine) ExportGraph(dir string, format GraphFormat, obstacles bool) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("graph-%s.%s", time.Now().Format("20060102-150405"), format))
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := e.Graph(obstacles).Write(f, format); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// A dynamic graph records the particle graph at every engine update, the
+// time of the spells is the number of the update, 0 for the initial world.
+// The nodes, the edges and the values of the node attributes live from the
+// first to the last update they are seen in.
+
+type spell struct {
+	value string
+	start int
+	end   int
+}
+
+type dynamicNode struct {
+	spells []spell
+	// Spells of the values of the kind, state, row and column attributes
+	attrs map[string][]spell
+}
+
+type dynamicEdge struct {
+	source string
+	target string
+	spells []spell
+}
+
+type graphRecorder struct {
+	obstacles bool
+	time      int
+	nodes     map[string]*dynamicNode
+	edges     map[string]*dynamicEdge
+}
+
+// extend continues the last spell if it ended at the previous time with
+// the same value, or starts a new one
+func extend(spells []spell, value string, t int) []spell {
+	if last := len(spells) - 1; last >= 0 && spells[last].end == t-1 && spells[last].value == value {
+		spells[last].end = t
+
+		return spells
+	}
+
+	return append(spells, spell{value, t, t})
+}
+
+// StartGraphRecording records the particle graph at every update, to be
+// written with WriteGEXF
+func (e *Engine) StartGraphRecording(obstacles bool) {
+	e.graphRecorder = &graphRecorder{
+		obstacles: obstacles,
+		time:      -1,
+		nodes:     make(map[string]*dynamicNode),
+		edges:     make(map[string]*dynamicEdge),
+	}
+
+	e.recordGraph()
+}
+
+// recordGraph adds the particle graph of the world to the recording
+func (e *Engine) recordGraph() {
+	rec := e.graphRecorder
+	if rec == nil {
+		return
+	}
+
+	rec.time += 1
+	g := e.Graph(rec.obstacles)
+
+	for _, n := range g.Nodes {
+		node, ok := rec.nodes[n.ID]
+		if !ok {
+			node = &dynamicNode{attrs: make(map[string][]spell)}
+			rec.nodes[n.ID] = node
+		}
+
+		node.spells = extend(node.spells, "", rec.time)
+
+		for name, value := range map[string]interface{}{"kind": n.Kind, "state": n.State, "row": n.Row, "column": n.Column} {
+			node.attrs[name] = extend(node.attrs[name], fmt.Sprint(value), rec.time)
+		}
+	}
+
+	for _, edge := range g.Edges {
+		id := edge.Source + "-" + edge.Target
+
+		dynEdge, ok := rec.edges[id]
+		if !ok {
+			dynEdge = &dynamicEdge{source: edge.Source, target: edge.Target}
+			rec.edges[id] = dynEdge
+		}
+
+		dynEdge.spells = extend(dynEdge.spells, "", rec.time)
+	}
+}
+
+type gexfAttribute struct {
+	ID    string `xml:"id,attr"`
+	Title string `xml:"title,attr"`
+	Type  string `xml:"type,attr"`
+}
+
+type gexfValue struct {
+	For   string `xml:"for,attr"`
+	Value string `xml:"value,attr"`
+	Start int    `xml:"start,attr"`
+	End   int    `xml:"end,attr"`
+}
+
+type gexfSpell struct {
+	Start int `xml:"start,attr"`
+	End   int `xml:"end,attr"`
+}
+
+type gexfNode struct {
+	ID     string      `xml:"id,attr"`
+	Label  string      `xml:"label,attr"`
+	Values []gexfValue `xml:"attvalues>attvalue"`
+	Spells []gexfSpell `xml:"spells>spell"`
+}
+
+type gexfEdge struct {
+	ID     string      `xml:"id,attr"`
+	Source string      `xml:"source,attr"`
+	Target string      `xml:"target,attr"`
+	Spells []gexfSpell `xml:"spells>spell"`
+}
+
+type gexf struct {
+	XMLName xml.Name `xml:"gexf"`
+	XMLNS   string   `xml:"xmlns,attr"`
+	Version string   `xml:"version,attr"`
+	Graph   struct {
+		Mode            string `xml:"mode,attr"`
+		DefaultEdgeType string `xml:"defaultedgetype,attr"`
+		TimeFormat      string `xml:"timeformat,attr"`
+		Attributes      struct {
+			Class     string          `xml:"class,attr"`
+			Mode      string          `xml:"mode,attr"`
+			Attribute []gexfAttribute `xml:"attribute"`
+		} `xml:"attributes"`
+		Nodes []gexfNode `xml:"nodes>node"`
+		Edges []gexfEdge `xml:"edges>edge"`
+	} `xml:"graph"`
+}
+
+func gexfSpells(spells []spell) []gexfSpell {
+	res := make([]gexfSpell, 0, len(spells))
+	for _, s := range spells {
+		res = append(res, gexfSpell{s.start, s.end})
+	}
+
+	return res
+}
+
+// WriteGEXF writes the recorded run as a dynamic GEXF graph, with the
+// lifetimes of the nodes and of the edges as spells
+func (e *Engine) WriteGEXF(w io.Writer) error {
+	// An update in progress ends first
+	e.updateMu.Lock()
+	defer e.updateMu.Unlock()
+
+	rec := e.graphRecorder
+	if rec == nil {
+		return fmt.Errorf("the graph of the run is not recorded")
+	}
+
+	doc := gexf{XMLNS: "http://gexf.net/1.3", Version: "1.3"}
+	doc.Graph.Mode = "dynamic"
+	doc.Graph.DefaultEdgeType = "undirected"
+	doc.Graph.TimeFormat = "integer"
+	doc.Graph.Attributes.Class = "node"
+	doc.Graph.Attributes.Mode = "dynamic"
+
+	names := []string{"kind", "state", "row", "column"}
+	for _, name := range names {
+		attrType := "string"
+		if name == "row" || name == "column" {
+			attrType = "integer"
+		}
+
+		doc.Graph.Attributes.Attribute = append(doc.Graph.Attributes.Attribute, gexfAttribute{name, name, attrType})
+	}
+
+	ids := make([]string, 0, len(rec.nodes))
+	for id := range rec.nodes {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		node := rec.nodes[id]
+		n := gexfNode{ID: id, Label: id, Spells: gexfSpells(node.spells)}
+
+		for _, name := range names {
+			for _, s := range node.attrs[name] {
+				n.Values = append(n.Values, gexfValue{name, s.value, s.start, s.end})
+			}
+		}
+
+		doc.Graph.Nodes = append(doc.Graph.Nodes, n)
+	}
+
+	ids = ids[:0]
+	for id := range rec.edges {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		edge := rec.edges[id]
+		doc.Graph.Edges = append(doc.Graph.Edges, gexfEdge{id, edge.source, edge.target, gexfSpells(edge.spells)})
+	}
+
+	return writeXML(w, doc)
+}
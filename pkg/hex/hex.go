@@ -0,0 +1,219 @@
+// Package hex implements the coordinates of the hexagonal grid used by the
+// simulator: axial and cube coordinates, the offset coordinates of the
+// engine grid (even rows shifted right) and the pixel layout of the renderer.
+//
+// Ref: https://www.redblobgames.com/grids/hexagons/
+package hex
+
+import "math"
+
+type Direction int
+
+// The N1 directions, in the order used by the engine and the scripts
+const (
+	L Direction = iota
+	R
+	UL
+	UR
+	LL
+	LR
+)
+
+// Directions are all the N1 directions, in the order used by the engine
+var Directions = []Direction{L, R, UL, UR, LL, LR}
+
+// Clockwise are the N1 directions in clockwise order starting from L
+var Clockwise = []Direction{L, UL, UR, R, LR, LL}
+
+var directionNames = []string{"l", "r", "ul", "ur", "ll", "lr"}
+
+var axialDirections = []Axial{
+	L:  {-1, 0},
+	R:  {1, 0},
+	UL: {0, -1},
+	UR: {1, -1},
+	LL: {-1, 1},
+	LR: {0, 1},
+}
+
+func (d Direction) String() string {
+	if d < L || d > LR {
+		return "unknown"
+	}
+
+	return directionNames[d]
+}
+
+// Opposite returns the direction pointing back
+func (d Direction) Opposite() Direction {
+	return [...]Direction{R, L, LR, LL, UR, UL}[d]
+}
+
+// Axial coordinates of a cell
+type Axial struct {
+	Q, R int
+}
+
+// Cube coordinates of a cell, X + Y + Z is always 0
+type Cube struct {
+	X, Y, Z int
+}
+
+// Offset coordinates of a cell in the engine grid, even rows are shifted right
+type Offset struct {
+	Row, Col int
+}
+
+func (a Axial) Add(b Axial) Axial {
+	return Axial{a.Q + b.Q, a.R + b.R}
+}
+
+func (a Axial) Scale(k int) Axial {
+	return Axial{a.Q * k, a.R * k}
+}
+
+// Neighbor returns the N1 neighbor in the given direction
+func (a Axial) Neighbor(d Direction) Axial {
+	return a.Add(axialDirections[d])
+}
+
+func (a Axial) Cube() Cube {
+	return Cube{a.Q, a.R, -a.Q - a.R}
+}
+
+func (a Axial) Offset() Offset {
+	return Offset{a.R, a.Q + (a.R+(a.R&1))/2}
+}
+
+// Distance returns the number of N1 steps between two cells
+func (a Axial) Distance(b Axial) int {
+	return a.Cube().Distance(b.Cube())
+}
+
+// Ring returns the cells at the given distance, in clockwise order starting
+// from the corner in the L direction
+func (a Axial) Ring(radius int) []Axial {
+	if radius <= 0 {
+		return []Axial{a}
+	}
+
+	res := make([]Axial, 0, 6*radius)
+	cur := a.Add(axialDirections[L].Scale(radius))
+
+	for _, d := range []Direction{UR, R, LR, LL, L, UL} {
+		for i := 0; i < radius; i++ {
+			res = append(res, cur)
+			cur = cur.Neighbor(d)
+		}
+	}
+
+	return res
+}
+
+// Spiral returns the cells within the given distance, ring by ring
+func (a Axial) Spiral(radius int) []Axial {
+	res := make([]Axial, 0)
+
+	for k := 0; k <= radius; k++ {
+		res = append(res, a.Ring(k)...)
+	}
+
+	return res
+}
+
+func (c Cube) Axial() Axial {
+	return Axial{c.X, c.Y}
+}
+
+func (c Cube) Distance(b Cube) int {
+	return (abs(c.X-b.X) + abs(c.Y-b.Y) + abs(c.Z-b.Z)) / 2
+}
+
+func (o Offset) Axial() Axial {
+	return Axial{o.Col - (o.Row+(o.Row&1))/2, o.Row}
+}
+
+// Neighbor returns the N1 neighbor in the given direction
+func (o Offset) Neighbor(d Direction) Offset {
+	return o.Axial().Neighbor(d).Offset()
+}
+
+// Neighbors returns the N1 neighbors in the order of Directions
+func (o Offset) Neighbors() []Offset {
+	res := make([]Offset, 0, len(Directions))
+
+	for _, d := range Directions {
+		res = append(res, o.Neighbor(d))
+	}
+
+	return res
+}
+
+// Distance returns the number of N1 steps between two cells
+func (o Offset) Distance(b Offset) int {
+	return o.Axial().Distance(b.Axial())
+}
+
+// Ring returns the cells at the given distance, see Axial.Ring
+func (o Offset) Ring(radius int) []Offset {
+	ring := o.Axial().Ring(radius)
+	res := make([]Offset, len(ring))
+
+	for i, a := range ring {
+		res[i] = a.Offset()
+	}
+
+	return res
+}
+
+// Layout places the cells on the screen: HalfW is the horizontal distance
+// between two cells in the same row and HalfH the distance between two rows
+type Layout struct {
+	HalfW, HalfH int
+}
+
+// Center returns the pixel coordinates of the center of a cell
+func (l Layout) Center(o Offset) (int, int) {
+	x := o.Col * l.HalfW
+	if o.Row%2 == 0 {
+		x += l.HalfW / 2
+	}
+
+	return x, o.Row * l.HalfH
+}
+
+// FromPixel returns the cell whose center is the nearest to a pixel
+func (l Layout) FromPixel(x, y int) Offset {
+	r := float64(y) / float64(l.HalfH)
+	q := float64(x)/float64(l.HalfW) - r/2 - 0.5
+
+	return cubeRound(q, r, -q-r).Axial().Offset()
+}
+
+func cubeRound(x, y, z float64) Cube {
+	rx := math.Round(x)
+	ry := math.Round(y)
+	rz := math.Round(z)
+
+	dx := math.Abs(rx - x)
+	dy := math.Abs(ry - y)
+	dz := math.Abs(rz - z)
+
+	if dx > dy && dx > dz {
+		rx = -ry - rz
+	} else if dy > dz {
+		ry = -rx - rz
+	} else {
+		rz = -rx - ry
+	}
+
+	return Cube{int(rx), int(ry), int(rz)}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+
+	return x
+}
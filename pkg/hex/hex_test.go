@@ -0,0 +1,102 @@
+package hex
+
+import "testing"
+
+func TestOffsetAxialRoundTrip(t *testing.T) {
+	for row := -9; row <= 9; row++ {
+		for col := -9; col <= 9; col++ {
+			o := Offset{row, col}
+
+			if got := o.Axial().Offset(); got != o {
+				t.Errorf("%v -> %v -> %v", o, o.Axial(), got)
+			}
+
+			if got := o.Axial().Cube().Axial(); got != o.Axial() {
+				t.Errorf("%v -> %v -> %v", o.Axial(), o.Axial().Cube(), got)
+			}
+		}
+	}
+}
+
+func TestNeighborParity(t *testing.T) {
+	tests := []struct {
+		cell Offset
+		want []Offset // in the order of Directions: l, r, ul, ur, ll, lr
+	}{
+		// Even rows are shifted right: the rows above and below are offset by +1
+		{Offset{4, 5}, []Offset{{4, 4}, {4, 6}, {3, 5}, {3, 6}, {5, 5}, {5, 6}}},
+		{Offset{0, 0}, []Offset{{0, -1}, {0, 1}, {-1, 0}, {-1, 1}, {1, 0}, {1, 1}}},
+		{Offset{-2, 3}, []Offset{{-2, 2}, {-2, 4}, {-3, 3}, {-3, 4}, {-1, 3}, {-1, 4}}},
+		// Odd rows are not shifted: the rows above and below are offset by -1
+		{Offset{3, 5}, []Offset{{3, 4}, {3, 6}, {2, 4}, {2, 5}, {4, 4}, {4, 5}}},
+		{Offset{1, 0}, []Offset{{1, -1}, {1, 1}, {0, -1}, {0, 0}, {2, -1}, {2, 0}}},
+		{Offset{-1, 3}, []Offset{{-1, 2}, {-1, 4}, {-2, 2}, {-2, 3}, {0, 2}, {0, 3}}},
+	}
+
+	for _, tt := range tests {
+		got := tt.cell.Neighbors()
+
+		for i, d := range Directions {
+			if got[i] != tt.want[i] {
+				t.Errorf("%v %s: got %v, want %v", tt.cell, d, got[i], tt.want[i])
+			}
+
+			if back := got[i].Neighbor(d.Opposite()); back != tt.cell {
+				t.Errorf("%v %s %s: got %v", tt.cell, d, d.Opposite(), back)
+			}
+
+			if dist := tt.cell.Distance(got[i]); dist != 1 {
+				t.Errorf("%v %s: distance %d", tt.cell, d, dist)
+			}
+		}
+	}
+}
+
+func TestRingSizes(t *testing.T) {
+	for _, center := range []Offset{{0, 0}, {5, 5}, {4, 7}, {-3, 2}} {
+		if ring := center.Ring(0); len(ring) != 1 || ring[0] != center {
+			t.Errorf("%v ring 0: got %v", center, ring)
+		}
+
+		for radius := 1; radius <= 6; radius++ {
+			ring := center.Ring(radius)
+
+			if len(ring) != 6*radius {
+				t.Errorf("%v ring %d: got %d cells, want %d", center, radius, len(ring), 6*radius)
+			}
+
+			seen := make(map[Offset]bool, len(ring))
+
+			for i, o := range ring {
+				if seen[o] {
+					t.Errorf("%v ring %d: %v is repeated", center, radius, o)
+				}
+
+				seen[o] = true
+
+				if dist := center.Distance(o); dist != radius {
+					t.Errorf("%v ring %d: %v at distance %d", center, radius, o, dist)
+				}
+
+				// Consecutive cells are adjacent, the ring is closed
+				if next := ring[(i+1)%len(ring)]; o.Distance(next) != 1 {
+					t.Errorf("%v ring %d: %v and %v are not adjacent", center, radius, o, next)
+				}
+			}
+		}
+	}
+}
+
+func TestLayoutFromPixel(t *testing.T) {
+	l := Layout{HalfW: 32, HalfH: 28}
+
+	for row := 0; row <= 8; row++ {
+		for col := 0; col <= 8; col++ {
+			o := Offset{row, col}
+
+			if got := l.FromPixel(l.Center(o)); got != o {
+				t.Errorf("%v: got %v", o, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ScenarioEntry is a scenario file of the library, Err is set for the files
+// that cannot be run
+type ScenarioEntry struct {
+	Path        string
+	Name        string
+	Description string
+	Particles   int
+	Err         error
+}
+
+// ListScenarios reads the JSON scenarios of dir, sorted by file name. The
+// particles are counted on the initial state drawn with the scenario seed.
+func ListScenarios(dir string) ([]ScenarioEntry, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	res := make([]ScenarioEntry, 0, len(files))
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(strings.ToLower(f.Name()), ".json") {
+			continue
+		}
+
+		entry := ScenarioEntry{
+			Path: filepath.Join(dir, f.Name()),
+			Name: strings.TrimSuffix(f.Name(), filepath.Ext(f.Name())),
+		}
+
+		s, err := ReadScenario(entry.Path)
+		if err != nil {
+			entry.Err = err
+			res = append(res, entry)
+
+			continue
+		}
+
+		if s.Name != "" {
+			entry.Name = s.Name
+		}
+
+		entry.Description = s.Description
+
+		var seed int64
+		if s.Seed != nil {
+			seed = *s.Seed
+		}
+
+		config, err := s.initialConfig(rand.New(rand.NewSource(seed)))
+		if err != nil {
+			entry.Err = err
+			res = append(res, entry)
+
+			continue
+		}
+
+		for _, state := range config.State {
+			if n, ok := state.(int64); ok && State(n) != VOID && State(n) != OBSTACLE {
+				entry.Particles += 1
+			}
+		}
+
+		res = append(res, entry)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,226 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// ScreenWidth and ScreenHeight are the default size of the window
+	ScreenWidth  = 800
+	ScreenHeight = 600
+	// DefaultTick is the interval between two engine updates in the window
+	DefaultTick = 250 * time.Millisecond
+)
+
+// Options are the settings of a launch, from the command line
+type Options struct {
+	// Scenario is the path of the scenario file to run, empty for the scripts
+	Scenario string
+	// ScriptsDir holds init.tengo, scheduler.tengo and the particle scripts
+	ScriptsDir string
+	// ParticleScript is the file name of the particle script to select
+	ParticleScript string
+	// Seed fixes the seed of the runs, over the one of the scenario
+	Seed *int64
+	// Tick is the interval between two engine updates
+	Tick time.Duration
+	// Width and Height are the size of the window, or of the world that fills it
+	Width  int
+	Height int
+	// Run starts the simulation at launch
+	Run bool
+	// MaxRounds stops the runs at a round, 0 keeps the scenario conditions
+	MaxRounds int
+	// Trace records the runs, see StartTrace
+	Trace io.Writer
+	// GEXF gets the particle graph of the run, written when it ends, see
+	// StartGraphRecording
+	GEXF io.Writer
+	// GraphObstacles adds the obstacles to the particle graphs
+	GraphObstacles bool
+	// Quiet turns off the trace of the engine and the prints of the scripts
+	Quiet bool
+	// scenario is already read from Scenario, with the values of an
+	// experiment run
+	scenario *Scenario
+}
+
+// SetScriptsDir sets the directory of the scripts, "scripts" by default
+func (e *Engine) SetScriptsDir(dir string) {
+	e.scriptsDir = dir
+}
+
+// scriptPath returns the path of a file of the scripts directory
+func (e *Engine) scriptPath(name string) string {
+	dir := e.scriptsDir
+	if dir == "" {
+		dir = "scripts"
+	}
+
+	return filepath.Join(dir, name)
+}
+
+func (o *Options) setDefaults() {
+	if o.Width <= 0 {
+		o.Width = ScreenWidth
+	}
+
+	if o.Height <= 0 {
+		o.Height = ScreenHeight
+	}
+}
+
+// loadConfig loads the scenario, or the scripts, and returns the initial
+// state and the world to create. A world without a size fills the window,
+// unless it grows on demand.
+func (o *Options) loadConfig(e *Engine) (*InitialConfig, WorldConfig, error) {
+	o.setDefaults()
+
+	e.SetScriptsDir(o.ScriptsDir)
+	e.SetMaxRounds(o.MaxRounds)
+	e.SetQuiet(o.Quiet)
+
+	if o.Seed != nil {
+		e.SetSeed(*o.Seed)
+	}
+
+	if o.scenario != nil {
+		e.scenario, e.scenarioPath = o.scenario, o.Scenario
+	} else if err := e.LoadScenario(o.Scenario); err != nil {
+		return nil, WorldConfig{}, err
+	}
+
+	if err := e.LoadScripts(); err != nil {
+		return nil, WorldConfig{}, err
+	}
+
+	if o.ParticleScript != "" {
+		if err := e.SelectScriptByName(o.ParticleScript); err != nil {
+			return nil, WorldConfig{}, err
+		}
+	}
+
+	config, err := e.InitialState()
+	if err != nil {
+		return nil, WorldConfig{}, err
+	}
+
+	if config.World.Geometry == nil {
+		config.World.Geometry = HexGeometry{}
+	}
+
+	worldConfig := config.World
+
+	if (worldConfig.Rows <= 0 || worldConfig.Cols <= 0) && worldConfig.Boundary != GROW {
+		// Distances between the cells of two columns and of two rows
+		halfW, halfH := worldConfig.Geometry.Spacing(config.HexSize)
+
+		worldConfig.Rows = o.Height/halfH + 1
+		worldConfig.Cols = o.Width/halfW + 1
+
+		if worldConfig.Boundary == TORUS {
+			// Keep the size even, as required by some geometries
+			worldConfig.Rows += worldConfig.Rows % 2
+			worldConfig.Cols += worldConfig.Cols % 2
+		}
+	}
+
+	return config, worldConfig, nil
+}
+
+// setupEngine loads the scenario, or the scripts, and creates the world
+func (o *Options) setupEngine(e *Engine) (*InitialConfig, error) {
+	config, worldConfig, err := o.loadConfig(e)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.Init(worldConfig); err != nil {
+		return nil, err
+	}
+
+	if err := e.Bootstrap(config); err != nil {
+		return nil, err
+	}
+
+	if err := e.StartTrace(o.Trace); err != nil {
+		return nil, err
+	}
+
+	e.graphRecorder = nil
+	if o.GEXF != nil {
+		e.StartGraphRecording(o.GraphObstacles)
+	}
+
+	return config, nil
+}
+
+// RunHeadless runs the world of the options without a window, until a stop
+// condition of the scenario or MaxRounds
+func RunHeadless(o Options) error {
+	e := &Engine{}
+	defer e.Close()
+
+	if _, err := o.setupEngine(e); err != nil {
+		return err
+	}
+
+	if err := e.runUntilStopped(o.Tick); err != nil {
+		// A run stopped by an error reports where it stopped too
+		if e.Err() != nil {
+			e.printStopped()
+		}
+
+		return err
+	}
+
+	if o.GEXF != nil {
+		if err := e.WriteGEXF(o.GEXF); err != nil {
+			return err
+		}
+	}
+
+	e.printStopped()
+
+	return nil
+}
+
+func (e *Engine) printStopped() {
+	fmt.Printf("Stopped: %s (round %d, seed %d)\n", e.StopReason(), e.getRound(), e.Seed())
+}
+
+// Validate checks the initial state of the world of the options, without
+// creating it, see Engine.Validate
+func Validate(o Options) ([]Finding, error) {
+	e := &Engine{}
+
+	config, worldConfig, err := o.loadConfig(e)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Validate(config, worldConfig), nil
+}
+
+// runUntilStopped runs the world until a stop condition, with a tick
+// between two updates
+func (e *Engine) runUntilStopped(tick time.Duration) error {
+	if e.stopConditions() == (ScenarioStop{}) {
+		return fmt.Errorf("a headless run needs a stop condition, in the scenario or as max rounds")
+	}
+
+	e.Start()
+
+	for e.IsRunning() {
+		e.Update(nil)
+		time.Sleep(tick)
+	}
+
+	// The last async tasks end before the world is read
+	e.asyncTasks.Wait()
+
+	return e.Err()
+}
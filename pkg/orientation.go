@@ -0,0 +1,111 @@
+package pkg
+
+// frameOf returns the local frame of a particle at [row, column]: the global
+// direction of every local direction. The local directions are rotated
+// clockwise by the particle rotation and, for a mirrored particle, they
+// follow the counterclockwise order.
+func (e *Engine) frameOf(row, column int, p *Particle) []int {
+	clockwise := e.geometry.Clockwise(row, column)
+	n := len(clockwise)
+
+	position := make([]int, n)
+	for i, d := range clockwise {
+		position[d] = i
+	}
+
+	frame := make([]int, n)
+
+	for local := range frame {
+		k := position[local]
+		if p.mirror {
+			k = -k
+		}
+
+		frame[local] = clockwise[mod(k+p.rotation, n)]
+	}
+
+	return frame
+}
+
+// localDirection returns the local direction of a particle pointing to a global one
+func (p *Particle) localDirection(global int) int {
+	for local, d := range p.frame {
+		if d == global {
+			return local
+		}
+	}
+
+	return global
+}
+
+// globalDirection returns the global direction of a local direction of a particle
+func (p *Particle) globalDirection(local int) int {
+	if local < 0 || local >= len(p.frame) {
+		return local
+	}
+
+	return p.frame[local]
+}
+
+// viewN1Cells returns the N1 cells of a particle in its local frame
+func (e *Engine) viewN1Cells(row, column int, p *Particle) []cell {
+	global := e.n1Cells(row, column)
+	cells := make([]cell, len(global))
+
+	for local := range cells {
+		cells[local] = global[p.globalDirection(local)]
+	}
+
+	return cells
+}
+
+// viewN2Cells returns the N2 cells of a particle, walking the paths of the
+// N2 positions in its local frame
+func (e *Engine) viewN2Cells(row, column int, p *Particle) []cell {
+	positions := e.geometry.N2()
+	cells := make([]cell, 0, len(positions))
+
+	for _, pos := range positions {
+		nRow, nCol := row, column
+		for _, d := range pos.Path {
+			nRow, nCol = e.geometry.Neighbor(nRow, nCol, p.globalDirection(d))
+		}
+
+		cells = append(cells, e.wrap(cell{nRow, nCol}))
+	}
+
+	return cells
+}
+
+// localStateS returns the name of a state as seen by a particle, the
+// directions of the expand and move states are in its local frame
+func (p *Particle) localStateS(state State) string {
+	if d, ok := stateDirection(state); ok {
+		if isExpand(state) {
+			state = ExpandState(p.localDirection(d))
+		} else {
+			state = MoveState(p.localDirection(d))
+		}
+	}
+
+	return p.GetStateS(&state)
+}
+
+// globalStateS maps a state computed by a particle in its local frame to the
+// global one, invalid states are returned as they are
+func (p *Particle) globalStateS(s string) string {
+	state, err := p.parseState(s)
+	if err != nil {
+		return s
+	}
+
+	if d, ok := stateDirection(state); ok {
+		if isExpand(state) {
+			state = ExpandState(p.globalDirection(d))
+		} else {
+			state = MoveState(p.globalDirection(d))
+		}
+	}
+
+	return p.GetStateS(&state)
+}
@@ -1,6 +1,9 @@
 package pkg
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type State int
 type InnerState int
@@ -21,6 +24,10 @@ const (
 	MOVELL   // LOWER LEFT
 	MOVELR   // LOWER RIGHT
 	OBSTACLE
+	EXPAND6 // 7th and 8th directions of the square8 geometry
+	EXPAND7
+	MOVE6
+	MOVE7
 )
 
 const (
@@ -38,49 +45,162 @@ type Particle struct {
 	n2         []State
 	n1Deg      []int
 	moveFailed bool
+	rate       float64 // activation rate of the Poisson clock
+	speed      float64 // factor applied to the duration of the async phases
+	light      string
+	nextLight  string
+	n1Lights   []string
+	inbox      []interface{}
+	outbox     map[string]interface{}
+	prevState  State  // state before a move in progress became visible
+	inProgress bool   // the move in progress is visible to the others
+	lookSeq    uint64 // last change seen in the look phase
+	looked     bool
+	awoken     bool     // an async task is running for the particle
+	geometry   Geometry // names the directions of the states, nil is hex
+	rings      [][]State
+	ringDegs   [][]int
+	rotation   int   // local frame: directions rotated clockwise by rotation steps
+	mirror     bool  // local frame: clockwise and counterclockwise are swapped
+	frame      []int // global direction of every local direction
+	id         int   // identifies the particle in the bonds
+	n1Bonds    []bool
+	bondOut    []interface{}
+	unbondOut  []interface{}
+}
+
+// ExpandState returns the state expanding towards a direction
+func ExpandState(d int) State {
+	if d < 6 {
+		return EXPANDL + State(d)
+	}
+
+	return EXPAND6 + State(d-6)
+}
+
+// MoveState returns the state moving towards a direction
+func MoveState(d int) State {
+	if d < 6 {
+		return MOVEL + State(d)
+	}
+
+	return MOVE6 + State(d-6)
+}
+
+// stateDirection returns the direction of an expand or move state
+func stateDirection(state State) (int, bool) {
+	switch {
+	case state >= EXPANDL && state <= EXPANDLR:
+		return int(state - EXPANDL), true
+	case state >= MOVEL && state <= MOVELR:
+		return int(state - MOVEL), true
+	case state == EXPAND6 || state == EXPAND7:
+		return 6 + int(state-EXPAND6), true
+	case state == MOVE6 || state == MOVE7:
+		return 6 + int(state-MOVE6), true
+	}
+
+	return -1, false
+}
+
+func isExpand(state State) bool {
+	return (state >= EXPANDL && state <= EXPANDLR) || state == EXPAND6 || state == EXPAND7
+}
+
+func isMove(state State) bool {
+	return (state >= MOVEL && state <= MOVELR) || state == MOVE6 || state == MOVE7
+}
+
+// directionNames returns the upper case direction names used in the states
+func (p *Particle) directionNames() []string {
+	var geometry Geometry = HexGeometry{}
+	if p.geometry != nil {
+		geometry = p.geometry
+	}
+
+	names := make([]string, 0, maxDirections)
+	for _, name := range geometry.Directions() {
+		names = append(names, strings.ToUpper(name))
+	}
+
+	return names
+}
+
+// parseState reads the name of a state, the directions depend on the geometry
+func (p *Particle) parseState(s string) (State, error) {
+	switch s {
+	case "VOID":
+		return VOID, nil
+	case "CONTRACTED":
+		return CONTRACTED, nil
+	case "OBSTACLE":
+		return OBSTACLE, nil
+	}
+
+	for d, name := range p.directionNames() {
+		switch s {
+		case "EXPAND" + name:
+			return ExpandState(d), nil
+		case "MOVE" + name:
+			return MoveState(d), nil
+		}
+	}
+
+	return VOID, fmt.Errorf("'%s' is not a valid state string", s)
 }
 
 func (p *Particle) Init() *Particle {
-	p.n1 = make([]State, 6)
-	p.n2 = make([]State, 6)
-	p.n1Deg = make([]int, 6)
+	p.n1 = make([]State, 0, maxDirections)
+	p.n2 = make([]State, 0, maxDirections)
+	p.n1Deg = make([]int, 0, maxDirections)
+	p.n1Lights = make([]string, 0, maxDirections)
+	p.inbox = make([]interface{}, 0)
+	p.speed = 1
 
 	return p
 }
 
 func (p *Particle) SetNeighbors(n1, n2 []State) error {
-	n := copy(p.n1, n1)
-	n += copy(p.n2, n2)
-
-	if n != 12 {
+	if len(n1) > maxDirections || len(n2) > maxDirections {
 		return fmt.Errorf("error on copy neighbors")
 	}
 
+	p.n1 = append(p.n1[:0], n1...)
+	p.n2 = append(p.n2[:0], n2...)
+
 	return nil
 }
 
 func (p *Particle) SetNeighborsDeg(n1Deg []int) error {
-	if n := copy(p.n1Deg, n1Deg); n != 6 {
+	if len(n1Deg) > maxDirections {
 		return fmt.Errorf("error on copy neighbors deg")
 	}
 
+	p.n1Deg = append(p.n1Deg[:0], n1Deg...)
+
+	return nil
+}
+
+func (p *Particle) SetNeighborsLights(n1Lights []string) error {
+	if len(n1Lights) > maxDirections {
+		return fmt.Errorf("error on copy neighbors lights")
+	}
+
+	p.n1Lights = append(p.n1Lights[:0], n1Lights...)
+
 	return nil
 }
 
 func (p *Particle) GetNeighborsString() ([]string, []string) {
-	n1 := make([]string, 6)
-	n2 := make([]string, 6)
+	n1 := make([]string, len(p.n1))
+	n2 := make([]string, len(p.n2))
 
 	for i, n := range p.n1 {
-		pState := n
-		curState := p.GetStateS(&pState)
-		n1[i] = curState
+		n1[i] = p.localStateS(n)
 	}
 
 	for i, n := range p.n2 {
-		pState := n
-		curState := p.GetStateS(&pState)
-		n2[i] = curState
+		n2[i] = p.localStateS(n)
 	}
 
 	return n1, n2
@@ -118,6 +238,14 @@ func (p *Particle) SetStateN(n int) error {
 		p.state = MOVELR
 	case 14:
 		p.state = OBSTACLE
+	case 15:
+		p.state = EXPAND6
+	case 16:
+		p.state = EXPAND7
+	case 17:
+		p.state = MOVE6
+	case 18:
+		p.state = MOVE7
 	default:
 		return fmt.Errorf("%d is not a valid state number", n)
 	}
@@ -157,13 +285,21 @@ func (p *Particle) GetStateN() int {
 		return 13
 	case OBSTACLE:
 		return 14
+	case EXPAND6:
+		return 15
+	case EXPAND7:
+		return 16
+	case MOVE6:
+		return 17
+	case MOVE7:
+		return 18
 	}
 
 	return -1
 }
 
 func (p *Particle) SetDeg(n int) error {
-	if n < 0 || n > 6 {
+	if n < 0 || n > maxDirections {
 		return fmt.Errorf("%d is not a valid degree number", n)
 	}
 
@@ -177,41 +313,25 @@ func (p *Particle) GetDeg() int {
 }
 
 func (p *Particle) SetStateS(s string) error {
-	switch s {
-	case "VOID":
-		p.state = VOID
-	case "CONTRACTED":
-		p.state = CONTRACTED
-	case "EXPANDL":
-		p.state = EXPANDL
-	case "EXPANDR":
-		p.state = EXPANDR
-	case "EXPANDUL":
-		p.state = EXPANDUL
-	case "EXPANDUR":
-		p.state = EXPANDUR
-	case "EXPANDLL":
-		p.state = EXPANDLL
-	case "EXPANDLR":
-		p.state = EXPANDLR
-	case "MOVEL":
-		p.state = MOVEL
-	case "MOVER":
-		p.state = MOVER
-	case "MOVEUL":
-		p.state = MOVEUL
-	case "MOVEUR":
-		p.state = MOVEUR
-	case "MOVELL":
-		p.state = MOVELL
-	case "MOVELR":
-		p.state = MOVELR
-	case "OBSTACLE":
-		p.state = OBSTACLE
-	default:
-		return fmt.Errorf("'%s' is not a valid state number", s)
+	state, err := p.parseState(s)
+	if err != nil {
+		return err
+	}
+
+	p.state = state
+
+	return nil
+}
+
+// SetNextStateS sets the state the particle wants to reach after the move phase
+func (p *Particle) SetNextStateS(s string) error {
+	state, err := p.parseState(s)
+	if err != nil || state == OBSTACLE {
+		return fmt.Errorf("'%s' is not a valid state string", s)
 	}
 
+	p.nextState = state
+
 	return nil
 }
 
@@ -228,34 +348,20 @@ func (p *Particle) GetStateS(state *State) string {
 		return "VOID"
 	case CONTRACTED:
 		return "CONTRACTED"
-	case EXPANDL:
-		return "EXPANDL"
-	case EXPANDR:
-		return "EXPANDR"
-	case EXPANDUL:
-		return "EXPANDUL"
-	case EXPANDUR:
-		return "EXPANDUR"
-	case EXPANDLL:
-		return "EXPANDLL"
-	case EXPANDLR:
-		return "EXPANDLR"
-	case MOVEL:
-		return "MOVEL"
-	case MOVER:
-		return "MOVER"
-	case MOVEUL:
-		return "MOVEUL"
-	case MOVEUR:
-		return "MOVEUR"
-	case MOVELL:
-		return "MOVELL"
-	case MOVELR:
-		return "MOVELR"
 	case OBSTACLE:
 		return "OBSTACLE"
 	}
 
+	names := p.directionNames()
+
+	if d, ok := stateDirection(curState); ok && d < len(names) {
+		if isExpand(curState) {
+			return "EXPAND" + names[d]
+		}
+
+		return "MOVE" + names[d]
+	}
+
 	return "UNKNOWN"
 }
 
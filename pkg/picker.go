@@ -0,0 +1,208 @@
+package pkg
+
+import (
+	"fmt"
+	"image/color"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+	"github.com/hajimehoshi/ebiten/v2/text"
+)
+
+// ScenariosDir is the directory of the scenario library
+const ScenariosDir = "scenarios"
+
+const (
+	pickerTop        = 120
+	pickerRowHeight  = 56
+	pickerRows       = 7
+	pickerMaxDescLen = 90
+)
+
+// scenarioPicker is the dialog listing the scenarios of the library
+type scenarioPicker struct {
+	open     bool
+	entries  []ScenarioEntry
+	selected int
+	// First visible entry
+	offset int
+	// Last cursor position, the hover selects only when the cursor moves
+	mx int
+	my int
+}
+
+func (r *Renderer) openPicker() {
+	entries, err := ListScenarios(ScenariosDir)
+	if err != nil {
+		r.statusBarMsgs = append(r.statusBarMsgs, statusBarMsg{fmt.Sprintf("%s", err), 120})
+
+		return
+	}
+
+	if len(entries) == 0 {
+		r.statusBarMsgs = append(r.statusBarMsgs, statusBarMsg{fmt.Sprintf("No scenario in %s/", ScenariosDir), StatusBarDelay})
+
+		return
+	}
+
+	r.picker = scenarioPicker{open: true, entries: entries}
+	r.picker.mx, r.picker.my = ebiten.CursorPosition()
+
+	for i, entry := range entries {
+		if entry.Path == r.Scenario {
+			r.picker.selectEntry(i)
+		}
+	}
+}
+
+// selectEntry selects an entry and scrolls the list to show it
+func (p *scenarioPicker) selectEntry(i int) {
+	if i < 0 {
+		i = 0
+	}
+
+	if i >= len(p.entries) {
+		i = len(p.entries) - 1
+	}
+
+	p.selected = i
+
+	if p.selected < p.offset {
+		p.offset = p.selected
+	}
+
+	if p.selected >= p.offset+pickerRows {
+		p.offset = p.selected - pickerRows + 1
+	}
+}
+
+// entryAt returns the entry drawn at a pixel, -1 if none
+func (p *scenarioPicker) entryAt(x, y, width int) int {
+	if x < 42 || x > width-42 || y < pickerTop {
+		return -1
+	}
+
+	i := p.offset + (y-pickerTop)/pickerRowHeight
+	if i >= p.offset+pickerRows || i >= len(p.entries) {
+		return -1
+	}
+
+	return i
+}
+
+func (r *Renderer) updatePicker() {
+	p := &r.picker
+
+	for _, key := range r.keys {
+		if !inpututil.IsKeyJustPressed(key) {
+			continue
+		}
+
+		switch key.String() {
+		case "ArrowUp":
+			p.selectEntry(p.selected - 1)
+		case "ArrowDown":
+			p.selectEntry(p.selected + 1)
+		case "PageUp":
+			p.selectEntry(p.selected - pickerRows)
+		case "PageDown":
+			p.selectEntry(p.selected + pickerRows)
+		case "Enter":
+			r.pickScenario(p.selected)
+		case "Escape", "S":
+			p.open = false
+		}
+	}
+
+	if _, dy := ebiten.Wheel(); dy > 0 {
+		p.selectEntry(p.selected - 1)
+	} else if dy < 0 {
+		p.selectEntry(p.selected + 1)
+	}
+
+	mx, my := ebiten.CursorPosition()
+	if mx != p.mx || my != p.my {
+		p.mx, p.my = mx, my
+
+		if i := p.entryAt(mx, my, r.Width); i >= 0 {
+			p.selected = i
+		}
+	}
+
+	if inpututil.IsMouseButtonJustPressed(ebiten.MouseButtonLeft) {
+		if i := p.entryAt(mx, my, r.Width); i >= 0 {
+			r.pickScenario(i)
+		}
+	}
+}
+
+// pickScenario stops the running world and starts the scenario of an entry,
+// the previous world is reloaded if it cannot be started
+func (r *Renderer) pickScenario(i int) {
+	entry := r.picker.entries[i]
+	if entry.Err != nil {
+		r.statusBarMsgs = append(r.statusBarMsgs, statusBarMsg{fmt.Sprintf("%s", entry.Err), 120})
+
+		return
+	}
+
+	r.picker.open = false
+	r.engine.Stop()
+
+	previous := r.Scenario
+	r.Scenario = entry.Path
+
+	if err := r.loadWorld(); err != nil {
+		r.Scenario = previous
+
+		msg := fmt.Sprintf("%s", err)
+		if err := r.loadWorld(); err != nil {
+			msg = fmt.Sprintf("%s, reload: %s", msg, err)
+		}
+
+		r.statusBarMsgs = append(r.statusBarMsgs, statusBarMsg{msg, 120})
+
+		return
+	}
+
+	r.statusBarMsgs = append(r.statusBarMsgs, statusBarMsg{fmt.Sprintf("Scenario -> %s", entry.Name), StatusBarDelay})
+}
+
+func (r *Renderer) drawPicker(screen *ebiten.Image) {
+	p := &r.picker
+
+	r.drawDialog(screen, 220)
+
+	text.Draw(screen, "------[Scenarios]------", mplusHelpMenuFont, r.Width/2-160, 90, color.White)
+
+	for row := 0; row < pickerRows && p.offset+row < len(p.entries); row++ {
+		i := p.offset + row
+		entry := p.entries[i]
+		y := pickerTop + row*pickerRowHeight
+
+		if i == p.selected {
+			ebitenutil.DrawRect(screen, 50, float64(y), float64(r.Width-(50*2)), pickerRowHeight-4, color.RGBA{21, 21, 96, 196})
+		}
+
+		title := fmt.Sprintf("%s (%d particles)", entry.Name, entry.Particles)
+		description := entry.Description
+		descriptionColor := color.RGBA{220, 220, 220, 255}
+
+		if entry.Err != nil {
+			title = fmt.Sprintf("%s (cannot be run)", entry.Name)
+			description = entry.Err.Error()
+			descriptionColor = color.RGBA{255, 160, 160, 255}
+		}
+
+		if len(description) > pickerMaxDescLen {
+			description = description[:pickerMaxDescLen-3] + "..."
+		}
+
+		text.Draw(screen, title, mplusHelpMenuFont, 58, y+26, color.White)
+		text.Draw(screen, description, mplusStatusBarFont, 58, y+46, descriptionColor)
+	}
+
+	footer := fmt.Sprintf("%d/%d  [Up/Down/Wheel] Move  [Enter/Click] Load  [Esc] Close", p.selected+1, len(p.entries))
+	text.Draw(screen, footer, mplusStatusBarFont, 58, r.Height-54, color.White)
+}
@@ -0,0 +1,306 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A PNG map is an image of the world: the pixel [x, y] is the cell at row y
+// and column x, in the same offset layout as the grid, and its colour is a
+// state of the palette. The transparent pixels are left out. An optional
+// "origin" text chunk, "row,column", gives the cell of the pixel [0, 0].
+
+// pngOriginKey is the keyword of the text chunk of the origin
+const pngOriginKey = "origin"
+
+// Palette maps the colours of a PNG map to states
+type Palette map[color.RGBA]State
+
+// DefaultPalette maps the colours that need no palette
+func DefaultPalette() Palette {
+	return Palette{
+		{0, 0, 0, 255}:       OBSTACLE,
+		{0, 0, 255, 255}:     CONTRACTED,
+		{255, 255, 255, 255}: VOID,
+	}
+}
+
+// extraPNGColors are given to the states missing from the palette on export
+var extraPNGColors = []color.RGBA{
+	{255, 0, 0, 255}, {0, 160, 0, 255}, {255, 160, 0, 255}, {160, 0, 255, 255},
+	{0, 200, 200, 255}, {255, 0, 200, 255}, {128, 128, 0, 255}, {128, 64, 0, 255},
+	{0, 96, 160, 255}, {160, 160, 160, 255}, {96, 96, 96, 255}, {255, 128, 128, 255},
+	{128, 255, 128, 255}, {128, 128, 255, 255}, {255, 255, 0, 255}, {0, 255, 128, 255},
+	{200, 100, 160, 255}, {64, 0, 96, 255},
+}
+
+// ParsePalette reads "#rrggbb" colours mapped to state numbers or names, on
+// top of the default palette
+func ParsePalette(m map[string]interface{}, geometry Geometry) (Palette, error) {
+	res := DefaultPalette()
+	parser := &Particle{geometry: geometry}
+
+	for key, val := range m {
+		c, err := parseHexColor(key)
+		if err != nil {
+			return nil, err
+		}
+
+		switch v := val.(type) {
+		case int64:
+			if err := parser.SetStateN(int(v)); err != nil {
+				return nil, fmt.Errorf("palette %s: %w", key, err)
+			}
+		case string:
+			if parser.state, err = parser.parseState(strings.ToUpper(v)); err != nil {
+				return nil, fmt.Errorf("palette %s: %w", key, err)
+			}
+		default:
+			return nil, fmt.Errorf("palette %s: '%v' is not a valid state", key, val)
+		}
+
+		res[c] = parser.state
+	}
+
+	return res, nil
+}
+
+func parseHexColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("'%s' is not a #rrggbb colour", s)
+	}
+
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("'%s' is not a #rrggbb colour", s)
+	}
+
+	return color.RGBA{uint8(n >> 16), uint8(n >> 8), uint8(n), 255}, nil
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// DecodePNGMap reads a PNG map into the init_state format, the void cells
+// included
+func DecodePNGMap(r io.Reader, palette Palette) (map[string]interface{}, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	origin := cell{0, 0}
+	if text, ok := pngText(data, pngOriginKey); ok {
+		row, column, err := parseCellKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("origin: %w", err)
+		}
+
+		origin = cell{row, column}
+	}
+
+	bounds := img.Bounds()
+	res := make(map[string]interface{}, bounds.Dx()*bounds.Dy())
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A == 0 {
+				continue
+			}
+
+			rgb := color.RGBA{c.R, c.G, c.B, 255}
+
+			state, ok := palette[rgb]
+			if !ok {
+				return nil, fmt.Errorf("pixel %d,%d: colour %s is not in the palette", x, y, hexColor(rgb))
+			}
+
+			res[fmt.Sprintf("%d,%d", origin.row+y-bounds.Min.Y, origin.column+x-bounds.Min.X)] = int64(state)
+		}
+	}
+
+	return res, nil
+}
+
+// ReadPNGMap reads a PNG map file
+func ReadPNGMap(path string, palette Palette) (map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	state, err := DecodePNGMap(f, palette)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return state, nil
+}
+
+// WritePNGMap draws the world as an indexed PNG map, from its first cell
+// saved as the origin. The states missing from the palette get a new colour.
+func (e *Engine) WritePNGMap(w io.Writer) error {
+	first, last := e.world.Bounds()
+	if e.world.Len() == 0 && !e.world.Bounded() {
+		last = first
+	}
+
+	palette := e.imagePalette
+	if palette == nil {
+		palette = DefaultPalette()
+	}
+
+	// The first colour of a state, in order, is the one it is drawn with
+	colors := make([]color.RGBA, 0, len(palette))
+	for c := range palette {
+		colors = append(colors, c)
+	}
+
+	sort.Slice(colors, func(i, j int) bool { return hexColor(colors[i]) < hexColor(colors[j]) })
+
+	stateColors := make(map[State]color.RGBA, len(colors))
+	for _, c := range colors {
+		if _, ok := stateColors[palette[c]]; !ok {
+			stateColors[palette[c]] = c
+		}
+	}
+
+	img := image.NewPaletted(image.Rect(0, 0, last.column-first.column+1, last.row-first.row+1), nil)
+	indexes := make(map[State]uint8)
+	nextExtra := 0
+
+	for row := first.row; row <= last.row; row++ {
+		for column := first.column; column <= last.column; column++ {
+			state := VOID
+			if p := e.particleAt(row, column); p != nil {
+				state = p.state
+			}
+
+			index, ok := indexes[state]
+			if !ok {
+				c, ok := stateColors[state]
+				if !ok {
+					for nextExtra < len(extraPNGColors) && usedColor(palette, extraPNGColors[nextExtra]) {
+						nextExtra += 1
+					}
+
+					if nextExtra == len(extraPNGColors) {
+						return fmt.Errorf("too many states for a PNG map")
+					}
+
+					c = extraPNGColors[nextExtra]
+					stateColors[state] = c
+					nextExtra += 1
+				}
+
+				index = uint8(len(img.Palette))
+				img.Palette = append(img.Palette, c)
+				indexes[state] = index
+			}
+
+			img.SetColorIndex(column-first.column, row-first.row, index)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+
+	return writePNGText(w, buf.Bytes(), pngOriginKey, fmt.Sprintf("%d,%d", first.row, first.column))
+}
+
+// pngSignatureLen is the length of the signature at the start of a PNG
+const pngSignatureLen = 8
+
+// pngText returns the text of the tEXt chunk with the given keyword
+func pngText(data []byte, keyword string) (string, bool) {
+	for i := pngSignatureLen; i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		kind := string(data[i+4 : i+8])
+
+		if length < 0 || i+12+length > len(data) || kind == "IEND" {
+			break
+		}
+
+		if kind == "tEXt" {
+			chunk := data[i+8 : i+8+length]
+			if sep := bytes.IndexByte(chunk, 0); sep >= 0 && string(chunk[:sep]) == keyword {
+				return string(chunk[sep+1:]), true
+			}
+		}
+
+		i += 12 + length
+	}
+
+	return "", false
+}
+
+// writePNGText writes an encoded PNG with a tEXt chunk added after the header
+// chunk, the first one
+func writePNGText(w io.Writer, data []byte, keyword, text string) error {
+	headerEnd := pngSignatureLen + 12 + int(binary.BigEndian.Uint32(data[pngSignatureLen:]))
+
+	chunk := append([]byte("tEXt"+keyword+"\x00"), text...)
+
+	var length, crc [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(chunk)-4))
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(chunk))
+
+	for _, part := range [][]byte{data[:headerEnd], length[:], chunk, crc[:], data[headerEnd:]} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func usedColor(palette Palette, c color.RGBA) bool {
+	_, ok := palette[c]
+
+	return ok
+}
+
+// ExportPNGMap writes the world to a new timestamped PNG map in dir and
+// returns its path
+func (e *Engine) ExportPNGMap(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("export-%s.png", time.Now().Format("20060102-150405")))
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := e.WritePNGMap(f); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
@@ -0,0 +1,169 @@
+package pkg
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePalette(t *testing.T) {
+	tests := []struct {
+		name    string
+		palette map[string]interface{}
+		color   color.RGBA
+		state   State
+		err     string
+	}{
+		{"default", nil, color.RGBA{0, 0, 255, 255}, CONTRACTED, ""},
+		{"number", map[string]interface{}{"#ff0000": int64(EXPANDR)}, color.RGBA{255, 0, 0, 255}, EXPANDR, ""},
+		{"name", map[string]interface{}{"00a000": "moveul"}, color.RGBA{0, 160, 0, 255}, MOVEUL, ""},
+		{"bad colour", map[string]interface{}{"#ff00": int64(1)}, color.RGBA{}, VOID, "is not a #rrggbb colour"},
+		{"not hex", map[string]interface{}{"#gg0000": int64(1)}, color.RGBA{}, VOID, "is not a #rrggbb colour"},
+		{"bad state", map[string]interface{}{"#ff0000": int64(99)}, color.RGBA{}, VOID, "palette #ff0000"},
+		{"bad value", map[string]interface{}{"#ff0000": 1.5}, color.RGBA{}, VOID, "is not a valid state"},
+	}
+
+	for _, tt := range tests {
+		palette, err := ParsePalette(tt.palette, HexGeometry{})
+
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got %v, want an error with '%s'", tt.name, err, tt.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+
+			continue
+		}
+
+		if state, ok := palette[tt.color]; !ok || state != tt.state {
+			t.Errorf("%s: got %v, want %v", tt.name, state, tt.state)
+		}
+	}
+}
+
+func TestDecodePNGMap(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(0, 0, color.NRGBA{0, 0, 255, 255})
+	img.Set(1, 0, color.NRGBA{0, 0, 0, 255})
+	img.Set(0, 1, color.NRGBA{255, 255, 255, 255})
+	// The pixel 1,1 is transparent
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	var withOrigin bytes.Buffer
+	if err := writePNGText(&withOrigin, buf.Bytes(), pngOriginKey, "-3,4"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		state map[string]interface{}
+	}{
+		{"no origin", buf.Bytes(), map[string]interface{}{"0,0": int64(CONTRACTED), "0,1": int64(OBSTACLE), "1,0": int64(VOID)}},
+		{"origin", withOrigin.Bytes(), map[string]interface{}{"-3,4": int64(CONTRACTED), "-3,5": int64(OBSTACLE), "-2,4": int64(VOID)}},
+	}
+
+	for _, tt := range tests {
+		state, err := DecodePNGMap(bytes.NewReader(tt.data), DefaultPalette())
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+
+			continue
+		}
+
+		if !sameState(state, tt.state) {
+			t.Errorf("%s: got %v, want %v", tt.name, state, tt.state)
+		}
+	}
+
+	img.Set(1, 1, color.NRGBA{1, 2, 3, 255})
+	buf.Reset()
+
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := DecodePNGMap(&buf, DefaultPalette()); err == nil || !strings.Contains(err.Error(), "colour #010203 is not in the palette") {
+		t.Errorf("unknown colour: got %v", err)
+	}
+}
+
+func TestPNGMapRoundTrip(t *testing.T) {
+	state := map[string]interface{}{
+		"1,1": int64(CONTRACTED),
+		"1,2": int64(CONTRACTED),
+		"2,1": int64(OBSTACLE),
+		"3,3": int64(EXPANDUR),
+		"4,0": int64(MOVEL),
+	}
+
+	palette, err := ParsePalette(map[string]interface{}{"#ff0000": "EXPANDUR"}, HexGeometry{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	worlds := []WorldConfig{
+		{Rows: 6, Cols: 5, Boundary: WALL, Geometry: HexGeometry{}},
+		// The image of a growing world starts at its first particle, the
+		// origin chunk puts it back in place
+		{Boundary: GROW, Geometry: HexGeometry{}},
+	}
+
+	for _, world := range worlds {
+		e := &Engine{}
+		e.SetScriptsDir(filepath.Join("..", "scripts"))
+
+		if err := e.LoadScripts(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := e.Init(world); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := e.Bootstrap(&InitialConfig{State: state, ImagePalette: palette}); err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if err := e.WritePNGMap(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		// MOVEL is not in the palette, it is exported with the first free
+		// extra colour
+		imported, err := DecodePNGMap(&b, Palette{
+			{0, 0, 0, 255}:       OBSTACLE,
+			{0, 0, 255, 255}:     CONTRACTED,
+			{255, 255, 255, 255}: VOID,
+			{255, 0, 0, 255}:     EXPANDUR,
+			{0, 160, 0, 255}:     MOVEL,
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", world.Boundary, err)
+		}
+
+		for key, val := range imported {
+			if val == int64(VOID) {
+				delete(imported, key)
+			}
+		}
+
+		if !sameState(imported, state) {
+			t.Errorf("%v: got %v, want %v", world.Boundary, imported, state)
+		}
+	}
+}
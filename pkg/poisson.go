@@ -0,0 +1,168 @@
+package pkg
+
+import (
+	"container/heap"
+	"fmt"
+)
+
+// activation is a pending tick of a particle Poisson clock
+type activation struct {
+	particle    *Particle
+	row, column int
+	time        float64
+}
+
+// activationQueue is a min-heap of activations ordered by virtual time
+type activationQueue []*activation
+
+func (q activationQueue) Len() int { return len(q) }
+
+func (q activationQueue) Less(i, j int) bool { return q[i].time < q[j].time }
+
+func (q activationQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *activationQueue) Push(x interface{}) {
+	*q = append(*q, x.(*activation))
+}
+
+func (q *activationQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+
+	return item
+}
+
+func toFloat(val interface{}) (float64, error) {
+	switch v := val.(type) {
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+
+	return 0, fmt.Errorf("%v is not a valid number", val)
+}
+
+// checkPoissonRates rejects the rates and the time step that would stop the
+// clocks: a particle that is never activated keeps the round from advancing
+func (e *Engine) checkPoissonRates() error {
+	if e.poissonRate <= 0 {
+		return fmt.Errorf("poisson_rate %f is not positive", e.poissonRate)
+	}
+
+	for key, val := range e.poissonRates {
+		rate, err := toFloat(val)
+		if err != nil {
+			return fmt.Errorf("poisson_rates %s: %w", key, err)
+		}
+
+		if rate <= 0 {
+			return fmt.Errorf("poisson_rates %s: %f is not positive", key, rate)
+		}
+	}
+
+	if e.poissonTimeStep <= 0 {
+		return fmt.Errorf("poisson_time_step %f is not positive", e.poissonTimeStep)
+	}
+
+	return nil
+}
+
+// nextClockTick draws the waiting time of the exponential clock of a
+// particle, slow particles have their rate divided by the speed factor.
+func (e *Engine) nextClockTick(p *Particle) float64 {
+	return e.rng.ExpFloat64() * p.speed / p.rate
+}
+
+// initPoissonClocks starts an independent exponential clock for every particle
+func (e *Engine) initPoissonClocks() {
+	e.poissonQueue = make(activationQueue, 0)
+
+	e.world.Each(func(c cell, particle *Particle) {
+		if particle.state != OBSTACLE {
+			heap.Push(&e.poissonQueue, &activation{
+				particle: particle,
+				row:      c.row,
+				column:   c.column,
+				time:     e.virtualTime + e.nextClockTick(particle),
+			})
+		}
+	})
+
+	e.poissonReady = true
+}
+
+// activate runs a whole Look-Compute-Move cycle of the particle at
+// [row, column] atomically and returns the cell where the particle ends up.
+func (e *Engine) activate(row, column int) (int, int, error) {
+	curParticle := e.particleAt(row, column)
+
+	curParticle.Awake()
+	e.updateNeighbors(row, column)
+
+	neighbors1, neighbors2 := curParticle.GetNeighborsString()
+
+	// inputs: state, [l, r, ul, ur, ll, lr], [2l, 2r, u2l, u2r, l2l, l2r], [lDeg, rDeg, ulDeg, urDeg, llDeg, lrDeg]
+	nextState, err := e.Particle(curParticle, neighbors1, neighbors2, curParticle.n1Deg)
+	if err != nil {
+		curParticle.Sleep()
+
+		return row, column, fmt.Errorf("particle %d,%d: %w", row, column, err)
+	}
+
+	if err := curParticle.SetNextStateS(nextState); err != nil {
+		curParticle.Sleep()
+
+		return row, column, fmt.Errorf("particle %d,%d: %w", row, column, err)
+	}
+
+	newRow, newCol := e.moveTarget(row, column, curParticle.nextState)
+	e.applyNextState(row, column)
+	curParticle.Sleep()
+
+	if e.particleAt(newRow, newCol) == curParticle {
+		return newRow, newCol, nil
+	}
+
+	return row, column, nil
+}
+
+// poissonUpdate advances the continuous virtual time by one time step and
+// activates, in time order, all the particles whose clock rang meanwhile.
+func (e *Engine) poissonUpdate() error {
+	if !e.poissonReady {
+		e.initPoissonClocks()
+	}
+
+	e.virtualTime += e.poissonTimeStep
+
+	for e.poissonQueue.Len() > 0 && e.poissonQueue[0].time <= e.virtualTime {
+		next := heap.Pop(&e.poissonQueue).(*activation)
+
+		// A particle dragged by a bond keeps its clock
+		if c, ok := e.draggedTo(next.particle); ok {
+			next.row, next.column = c.row, c.column
+		}
+
+		if e.particleAt(next.row, next.column) != next.particle {
+			continue
+		}
+
+		row, column, err := e.activate(next.row, next.column)
+		if err != nil {
+			return err
+		}
+
+		next.row, next.column = row, column
+		next.time += e.nextClockTick(next.particle)
+
+		heap.Push(&e.poissonQueue, next)
+	}
+
+	return nil
+}
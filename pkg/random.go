@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/stdlib"
+)
+
+// lockedSource is a random source safe for the concurrent async tasks
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.src.Seed(seed)
+}
+
+// newLockedRand returns a random generator safe for concurrent use
+func newLockedRand(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed).(rand.Source64)})
+}
+
+// pickSeed picks the seed of a new run, the one set with SetSeed or the one
+// of the scenario if any, and resets the generators: the shapes of the gen
+// module get their own generator, so that they do not change the draws of
+// the run
+func (e *Engine) pickSeed() {
+	// A seeded scenario replays the same run
+	e.seed = time.Now().UnixNano()
+	if e.scenario != nil && e.scenario.Seed != nil {
+		e.seed = *e.scenario.Seed
+	}
+
+	if e.seedOverride != nil {
+		e.seed = *e.seedOverride
+	}
+
+	e.rng = newLockedRand(e.seed)
+	e.genRng = rand.New(rand.NewSource(e.seed))
+}
+
+// SetSeed fixes the seed of the next runs, over the one of the scenario
+func (e *Engine) SetSeed(seed int64) {
+	e.seedOverride = &seed
+}
+
+// Seed returns the seed of the random generator of the current run
+func (e *Engine) Seed() int64 {
+	return e.seed
+}
+
+// randModule is the tengo rand module drawing from the engine generator, so
+// that the scripts of a seeded run are reproducible too. The seed cannot be
+// changed by the scripts.
+func (e *Engine) randModule() map[string]tengo.Object {
+	return map[string]tengo.Object{
+		"int": &tengo.UserFunction{
+			Name:  "int",
+			Value: stdlib.FuncARI64(func() int64 { return e.rng.Int63() }),
+		},
+		"float": &tengo.UserFunction{
+			Name:  "float",
+			Value: stdlib.FuncARF(func() float64 { return e.rng.Float64() }),
+		},
+		"intn": &tengo.UserFunction{
+			Name:  "intn",
+			Value: stdlib.FuncAI64RI64(func(n int64) int64 { return e.rng.Int63n(n) }),
+		},
+		"exp_float": &tengo.UserFunction{
+			Name:  "exp_float",
+			Value: stdlib.FuncARF(func() float64 { return e.rng.ExpFloat64() }),
+		},
+		"norm_float": &tengo.UserFunction{
+			Name:  "norm_float",
+			Value: stdlib.FuncARF(func() float64 { return e.rng.NormFloat64() }),
+		},
+		"perm": &tengo.UserFunction{
+			Name:  "perm",
+			Value: stdlib.FuncAIRIs(func(n int) []int { return e.rng.Perm(n) }),
+		},
+	}
+}
+
+// scriptModules returns the tengo stdlib with the rand module of the engine
+// and the gen module of the generators, and without the prints when quiet
+func (e *Engine) scriptModules() *tengo.ModuleMap {
+	modules := stdlib.GetModuleMap(stdlib.AllModuleNames()...)
+	modules.AddBuiltinModule("rand", e.randModule())
+	modules.AddBuiltinModule("gen", e.genModule())
+
+	if e.quiet {
+		modules.AddBuiltinModule("fmt", quietFmtModule())
+	}
+
+	return modules
+}
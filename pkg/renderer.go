@@ -3,6 +3,7 @@ package pkg
 import (
 	"bytes"
 	"fmt"
+	"image"
 	"image/color"
 	"image/png"
 	"math"
@@ -22,10 +23,9 @@ import (
 )
 
 const (
-	ScreenWidth    = 800
-	ScreenHeight   = 600
 	StatusBarDelay = 60
 	DefaultDPI     = 96
+	CameraSpeed    = 8
 )
 
 var (
@@ -39,7 +39,14 @@ type statusBarMsg struct {
 	delay int
 }
 
+// stepResult is the outcome of a step, sent back to the game loop
+type stepResult struct {
+	round int
+	err   error
+}
+
 type Renderer struct {
+	Options
 	hexSize  int
 	w        int
 	h        int
@@ -52,14 +59,24 @@ type Renderer struct {
 	c_column int
 	// offset_x     int
 	// offset_y     int
+	geometry       Geometry
+	camX           int
+	camY           int
+	dragging       bool
+	dragX          int
+	dragY          int
 	engine         Engine
 	stateAssets    []*ebiten.Image
+	fillImage      *ebiten.Image
 	keys           []ebiten.Key
 	ticker         *time.Ticker
 	engineTick     chan int
+	stepDone       chan stepResult
+	stepping       bool
 	round          int
 	guiDebug       bool
 	helpDialog     bool
+	picker         scenarioPicker
 	statusBarMsgs  []statusBarMsg
 	statusBarDelay int
 	statusBarMsg   string
@@ -92,18 +109,86 @@ func (r *Renderer) drawCircle(screen *ebiten.Image, x, y, radius int, clr color.
 	}
 }
 
+// center returns the screen coordinates of the center of a cell
+func (r *Renderer) center(row, column int) (int, int) {
+	x, y := r.geometry.Center(row, column, r.hexSize)
+
+	return x - r.camX, y - r.camY
+}
+
+// visibleCells returns the range of rows and columns inside the camera viewport
+func (r *Renderer) visibleCells() (int, int, int, int) {
+	minRow := r.camY/r.half_h - 1
+	maxRow := (r.camY+r.Height)/r.half_h + 1
+	minCol := r.camX/r.half_w - 1
+	maxCol := (r.camX+r.Width)/r.half_w + 1
+
+	if !r.engine.world.Bounded() {
+		return minRow, maxRow, minCol, maxCol
+	}
+
+	first, last := r.engine.world.Bounds()
+
+	if minRow < first.row {
+		minRow = first.row
+	}
+
+	if minCol < first.column {
+		minCol = first.column
+	}
+
+	if maxRow > last.row {
+		maxRow = last.row
+	}
+
+	if maxCol > last.column {
+		maxCol = last.column
+	}
+
+	return minRow, maxRow, minCol, maxCol
+}
+
+// moveCamera pans the viewport, keeping the world (the particles of an
+// unbounded world) at least partially visible
+func (r *Renderer) moveCamera(dx, dy int) {
+	r.camX += dx
+	r.camY += dy
+
+	first, last := r.engine.world.Bounds()
+	minX, minY := r.geometry.Center(first.row, first.column, r.hexSize)
+	maxX, maxY := r.geometry.Center(last.row, last.column, r.hexSize)
+
+	minX -= r.Width / 2
+	minY -= r.Height / 2
+	maxX -= r.Width / 2
+	maxY -= r.Height / 2
+
+	if r.camX > maxX {
+		r.camX = maxX
+	}
+
+	if r.camY > maxY {
+		r.camY = maxY
+	}
+
+	if r.camX < minX {
+		r.camX = minX
+	}
+
+	if r.camY < minY {
+		r.camY = minY
+	}
+}
+
 func (r *Renderer) drawParticles(screen *ebiten.Image) {
-	for row, columns := range r.engine.grid {
-		cur_h := row * r.half_h
-		w_quarter := r.half_w / 2.0
-
-		for column, particle := range columns {
-			cur_w := column * r.half_w
-			if row%2 == 0 {
-				cur_w += w_quarter
-			}
+	minRow, maxRow, minCol, maxCol := r.visibleCells()
+
+	for row := minRow; row <= maxRow; row++ {
+		for column := minCol; column <= maxCol; column++ {
+			particle := r.engine.particleAt(row, column)
+			cur_w, cur_h := r.center(row, column)
 
-			if particle.state != VOID {
+			if particle != nil {
 				op := &ebiten.DrawImageOptions{}
 				scaleFactor := float64(r.hexSize) / 128.
 				center := (128. * scaleFactor) / 2.
@@ -122,6 +207,14 @@ func (r *Renderer) drawParticles(screen *ebiten.Image) {
 
 				if particle.state == CONTRACTED && particle.round > 0 && particle.deg == 0 {
 					screen.DrawImage(r.stateAssets[len(r.stateAssets)-2], op)
+				} else if d, ok := stateDirection(particle.state); ok && r.geometry.Name() != "hex" {
+					// The expanded images are hex only, elsewhere a line shows the direction
+					screen.DrawImage(r.stateAssets[0], op)
+
+					n_w, n_h := r.center(r.geometry.Neighbor(row, column, d))
+					ebitenutil.DrawLine(screen,
+						float64(cur_w), float64(cur_h), float64(cur_w+n_w)/2, float64(cur_h+n_h)/2,
+						color.RGBA{21, 21, 21, 255})
 				} else {
 					screen.DrawImage(r.stateAssets[particle.GetStateN()-1], op)
 				}
@@ -130,29 +223,148 @@ func (r *Renderer) drawParticles(screen *ebiten.Image) {
 	}
 }
 
+// terrainColors are the fills of the terrain types, the floor is not filled
+var terrainColors = map[Terrain]color.RGBA{
+	SOLID:  {64, 64, 64, 255},
+	HOLE:   {21, 21, 21, 255},
+	SLOW:   {222, 196, 140, 255},
+	STICKY: {150, 200, 120, 255},
+}
+
+// fillCell fills the shape of a cell with a color
+func (r *Renderer) fillCell(screen *ebiten.Image, row, column int, clr color.RGBA) {
+	corners := r.geometry.Corners(row, column, r.hexSize)
+	vertices := make([]ebiten.Vertex, len(corners))
+	indices := make([]uint16, 0, 3*(len(corners)-2))
+
+	for i, c := range corners {
+		vertices[i] = ebiten.Vertex{
+			DstX:   float32(c[0] - float64(r.camX)),
+			DstY:   float32(c[1] - float64(r.camY)),
+			SrcX:   1,
+			SrcY:   1,
+			ColorR: float32(clr.R) / 255,
+			ColorG: float32(clr.G) / 255,
+			ColorB: float32(clr.B) / 255,
+			ColorA: float32(clr.A) / 255,
+		}
+
+		if i >= 2 {
+			indices = append(indices, 0, uint16(i-1), uint16(i))
+		}
+	}
+
+	src := r.fillImage.SubImage(image.Rect(1, 1, 2, 2)).(*ebiten.Image)
+	screen.DrawTriangles(vertices, indices, src, nil)
+}
+
+// drawTerrain fills the visible cells that are not floor with their terrain color
+func (r *Renderer) drawTerrain(screen *ebiten.Image) {
+	minRow, maxRow, minCol, maxCol := r.visibleCells()
+
+	for c, terrain := range r.engine.terrain {
+		if c.row >= minRow && c.row <= maxRow && c.column >= minCol && c.column <= maxCol {
+			r.fillCell(screen, c.row, c.column, terrainColors[terrain])
+		}
+	}
+}
+
+// drawBonds draws a line between every pair of bonded particles
+func (r *Renderer) drawBonds(screen *ebiten.Image) {
+	minRow, maxRow, minCol, maxCol := r.visibleCells()
+
+	for row := minRow; row <= maxRow; row++ {
+		for column := minCol; column <= maxCol; column++ {
+			particle := r.engine.particleAt(row, column)
+			if particle == nil {
+				continue
+			}
+
+			cur_w, cur_h := r.center(row, column)
+
+			for _, n := range r.engine.bondedNeighbors(row, column) {
+				// Every bond once, on a torus towards the cell beyond the edge
+				if other := r.engine.particleAt(n.row, n.column); other == nil || other.id < particle.id {
+					continue
+				}
+
+				for d := range r.geometry.Directions() {
+					nRow, nCol := r.geometry.Neighbor(row, column, d)
+					if r.engine.wrap(cell{nRow, nCol}) != n {
+						continue
+					}
+
+					n_w, n_h := r.center(nRow, nCol)
+					for _, offset := range []float64{-1, 0, 1} {
+						ebitenutil.DrawLine(screen,
+							float64(cur_w)+offset, float64(cur_h)+offset, float64(n_w)+offset, float64(n_h)+offset,
+							color.RGBA{242, 121, 0, 255})
+					}
+				}
+			}
+		}
+	}
+}
+
+// drawDialog draws the background of a dialog covering the window
+func (r *Renderer) drawDialog(screen *ebiten.Image, alpha uint8) {
+	width, height := float64(r.Width-(42*2)), float64(r.Height-(42*2))
+
+	ebitenutil.DrawRect(screen, 48, 48, width, height, color.RGBA{21, 21, 21, 196})
+	ebitenutil.DrawRect(screen, 42, 42, width, height, color.RGBA{96, 96, 96, alpha})
+}
+
 func (r *Renderer) drawHelp(screen *ebiten.Image) {
-	ebitenutil.DrawRect(screen, 48, 48, ScreenWidth-(42*2), ScreenHeight-(42*2), color.RGBA{21, 21, 21, 196})
-	ebitenutil.DrawRect(screen, 42, 42, ScreenWidth-(42*2), ScreenHeight-(42*2), color.RGBA{96, 96, 96, 196})
-
-	text.Draw(screen, "------[Help dialog]------", mplusHelpMenuFont, ScreenWidth/2-196, ScreenHeight/2-196, color.White)
-
-	text.Draw(screen, "[Keys] -> Action", mplusHelpMenuFont, 55, ScreenHeight/3, color.White)
-	text.Draw(screen, " - [H] -> Show/Hide this dialog", mplusHelpMenuFont, 55, ScreenHeight/3+48, color.White)
-	text.Draw(screen, " - [R] -> Reload all engine", mplusHelpMenuFont, 55, ScreenHeight/3+48+42, color.White)
-	text.Draw(screen, " - [L] -> Reload scripts", mplusHelpMenuFont, 55, ScreenHeight/3+48+42+42, color.White)
-	text.Draw(screen, " - [Space] -> Start/Stop simulation", mplusHelpMenuFont, 55, ScreenHeight/3+48+42+42+42, color.White)
-	text.Draw(screen, " - [F] -> Enter/Exit fullscreen", mplusHelpMenuFont, 55, ScreenHeight/3+48+42+42+42+42, color.White)
-	text.Draw(screen, " - [0..9] -> Select a particle script", mplusHelpMenuFont, 55, ScreenHeight/3+48+42+42+42+42+42, color.White)
+	r.drawDialog(screen, 196)
+
+	text.Draw(screen, "------[Help dialog]------", mplusHelpMenuFont, r.Width/2-196, r.Height/2-196, color.White)
+
+	text.Draw(screen, "[Keys] -> Action", mplusHelpMenuFont, 55, r.Height/3-42, color.White)
+
+	lines := []string{
+		" - [H] -> Show/Hide this dialog",
+		" - [R] -> Reload all engine",
+		" - [L] -> Reload scripts",
+		" - [Space] -> Start/Stop simulation",
+		" - [F] -> Enter/Exit fullscreen",
+		" - [0..9] -> Select a particle script",
+		" - [S] -> Pick a scenario of scenarios/",
+		" - [C]/[Shift+C] -> Save the world as a scenario",
+		" - [P]/[A]/[N] -> Step phase/activation/round",
+		" - [Arrows]/[Right drag]/[Home] -> Move camera",
+		" - [M] -> Export the world as an ASCII map",
+		" - [I] -> Export the world as a PNG map",
+		" - [G]/[Shift+G] -> Export the graph as DOT/GraphML",
+	}
+
+	for i, line := range lines {
+		text.Draw(screen, line, mplusHelpMenuFont, 55, r.Height/3+28*i, color.White)
+	}
 }
 
 func (r *Renderer) drawStatusBar(screen *ebiten.Image) {
-	ebitenutil.DrawRect(screen, 0, ScreenHeight-28, ScreenWidth, ScreenHeight, color.RGBA{21, 21, 21, 196})
-	ebitenutil.DrawRect(screen, 0, ScreenHeight-24, ScreenWidth, ScreenHeight, color.RGBA{96, 96, 96, 196})
+	width, height := float64(r.Width), float64(r.Height)
+
+	ebitenutil.DrawRect(screen, 0, height-28, width, height, color.RGBA{21, 21, 21, 196})
+	ebitenutil.DrawRect(screen, 0, height-24, width, height, color.RGBA{96, 96, 96, 196})
 
 	if r.statusBarMsg != "" {
-		text.Draw(screen, r.statusBarMsg, mplusStatusBarFont, 6, ScreenHeight-6, color.White)
+		text.Draw(screen, r.statusBarMsg, mplusStatusBarFont, 6, r.Height-6, color.White)
 	} else {
-		text.Draw(screen, fmt.Sprintf("Round: %d", r.round), mplusStatusBarFont, 6, ScreenHeight-6, color.White)
+		status := fmt.Sprintf("Round: %d | Next: %s", r.round, r.engine.NextStep())
+		if lost := r.engine.LostParticles(); lost > 0 {
+			status += fmt.Sprintf(" | Lost: %d", lost)
+		}
+
+		if stale := r.engine.StaleActivations(); stale > 0 {
+			status += fmt.Sprintf(" | Stale: %d", stale)
+		}
+
+		if reason := r.engine.StopReason(); reason != "" {
+			status += fmt.Sprintf(" | Stopped: %s", reason)
+		}
+
+		text.Draw(screen, status, mplusStatusBarFont, 6, r.Height-6, color.White)
 	}
 
 	if len(r.statusBarMsgs) > 0 && r.statusBarMsg == "" {
@@ -171,28 +383,25 @@ func (r *Renderer) drawStatusBar(screen *ebiten.Image) {
 }
 
 func (r *Renderer) drawGrid(screen *ebiten.Image) {
-	for row, columns := range r.engine.grid {
-		cur_h := row * r.half_h
-		next_h := cur_h + r.half_h
-		w_quarter := r.half_w / 2.0
-
-		ebitenutil.DrawLine(screen,
-			0., float64(cur_h), ScreenWidth, float64(cur_h),
-			color.RGBA{142, 142, 142, 255},
-		)
-
-		for column := range columns {
-			cur_w := column * r.half_w
-			if row%2 == 0 {
-				cur_w += w_quarter
-			}
+	minRow, maxRow, minCol, maxCol := r.visibleCells()
+
+	for row := minRow; row <= maxRow; row++ {
+		for column := minCol; column <= maxCol; column++ {
+			cur_w, cur_h := r.center(row, column)
 
-			ebitenutil.DrawLine(screen,
-				float64(cur_w), float64(cur_h), float64(cur_w-w_quarter), float64(next_h),
-				color.RGBA{142, 142, 142, 255})
-			ebitenutil.DrawLine(screen,
-				float64(cur_w), float64(cur_h), float64(cur_w+w_quarter), float64(next_h),
-				color.RGBA{142, 142, 142, 255})
+			for _, d := range r.geometry.GridDirections() {
+				nRow, nCol := r.geometry.Neighbor(row, column, d)
+				if r.engine.world.Bounded() && !r.engine.world.Inside(cell{nRow, nCol}) {
+					// Nothing beyond the border
+					continue
+				}
+
+				n_w, n_h := r.center(nRow, nCol)
+
+				ebitenutil.DrawLine(screen,
+					float64(cur_w), float64(cur_h), float64(n_w), float64(n_h),
+					color.RGBA{142, 142, 142, 255})
+			}
 
 			if r.guiDebug {
 				msg := fmt.Sprintf("(%d,%d)", row, column)
@@ -285,6 +494,10 @@ func (r *Renderer) InitImages() error {
 
 	r.stateAssets = append(r.stateAssets, ebiten.NewImageFromImage(img))
 
+	// Source of the polygons filled with a color
+	r.fillImage = ebiten.NewImage(3, 3)
+	r.fillImage.Fill(color.White)
+
 	return nil
 }
 
@@ -321,45 +534,53 @@ func (r *Renderer) Init() error {
 		return err
 	}
 
-	r.ticker = time.NewTicker(250 * time.Millisecond)
+	if r.Tick <= 0 {
+		r.Tick = DefaultTick
+	}
+
+	r.ticker = time.NewTicker(r.Tick)
 	r.engineTick = make(chan int)
-	r.round = 0
 
-	err = r.InitImages()
-	if err != nil {
-		panic(err)
+	// A step in progress reports to the same channel after a reload
+	if r.stepDone == nil {
+		r.stepDone = make(chan stepResult, 1)
 	}
 
-	err = r.engine.LoadScripts()
+	err = r.InitImages()
 	if err != nil {
 		panic(err)
 	}
 
-	hexSize, initialState, ppWakeup, ppLook, ppCompute, ppMove, err := r.engine.InitialState()
-	if err != nil {
-		panic(err)
+	if err := r.loadWorld(); err != nil {
+		return err
 	}
 
-	r.hexSize = hexSize
-
-	// Ref: https://www.redblobgames.com/grids/hexagons/#distances
-	r.w = 2 * r.hexSize
-	r.h = int(math.Sqrt(3) * float64(r.hexSize))
+	if r.Run {
+		r.engine.Start()
+		go r.engine.Update(&r.engineTick)
+	}
 
-	r.half_w = int(r.w) / 2
-	r.half_h = int(r.h) / 2
+	return nil
+}
 
-	numRows := int(ScreenHeight/r.half_h) + 1
-	numCols := int(ScreenWidth/r.half_w) + 1
+// loadWorld loads the scenario, or the scripts, and creates its world
+func (r *Renderer) loadWorld() error {
+	r.round = 0
 
-	if err := r.engine.Init(numRows, numCols); err != nil {
-		panic(err)
+	initialConfig, err := r.setupEngine(&r.engine)
+	if err != nil {
+		return err
 	}
 
-	if err := r.engine.Bootstrap(initialState, ppWakeup, ppLook, ppCompute, ppMove); err != nil {
-		panic(err)
-	}
+	r.hexSize = initialConfig.HexSize
+	r.geometry = initialConfig.World.Geometry
 
+	// Distances between the cells of two columns and of two rows
+	r.half_w, r.half_h = r.geometry.Spacing(r.hexSize)
+	r.w = 2 * r.half_w
+	r.h = 2 * r.half_h
+
+	r.camX, r.camY = 0, 0
 	r.max_dist = r.hexSize / 2
 
 	r.statusBarMsgs = make([]statusBarMsg, 0)
@@ -377,136 +598,45 @@ func (r *Renderer) drawCursor(screen *ebiten.Image) {
 }
 
 func (r *Renderer) drawNeighbors(screen *ebiten.Image) {
-	// L
-	curRow := r.c_row * r.half_h
-	curCol := r.c_column - 1
-	if curRow%2 == 0 {
-		curCol = curCol*r.half_w + r.half_w/2
-	} else {
-		curCol = curCol * r.half_w
-	}
-	r.drawCircle(screen, curCol, curRow, 16, color.RGBA{0, 242, 0, 10}, true)
-
-	// R
-	curCol = r.c_column + 1
-	if curRow%2 == 0 {
-		curCol = curCol*r.half_w + r.half_w/2
-	} else {
-		curCol = curCol * r.half_w
+	// [L, R, UL, UR, LL, LR] on hex
+	n1Colors := []color.RGBA{
+		{0, 242, 0, 10}, {0, 242, 0, 10},
+		{242, 0, 0, 10}, {0, 0, 242, 10},
+		{242, 0, 0, 96}, {0, 0, 242, 96},
+		{242, 242, 0, 96}, {0, 242, 242, 96},
 	}
-	r.drawCircle(screen, curCol, curRow, 16, color.RGBA{0, 242, 0, 10}, true)
 
-	// UL
-	curRow = r.c_row - 1
-	curCol = r.c_column
-	if curRow%2 == 0 {
-		curCol -= 1
-		curCol = curCol*r.half_w + r.half_w/2
-	} else {
-		curCol = curCol * r.half_w
-	}
-	curRow *= r.half_h
-	r.drawCircle(screen, curCol, curRow, 16, color.RGBA{242, 0, 0, 10}, true)
-
-	// UR
-	curRow = r.c_row - 1
-	curCol = r.c_column + 1
-	if curRow%2 == 0 {
-		curCol -= 1
-		curCol = curCol*r.half_w + r.half_w/2
-	} else {
-		curCol = curCol * r.half_w
-	}
-	curRow *= r.half_h
-	r.drawCircle(screen, curCol, curRow, 16, color.RGBA{0, 0, 242, 10}, true)
-
-	// LL
-	curRow = r.c_row + 1
-	curCol = r.c_column
-	if curRow%2 == 0 {
-		curCol -= 1
-		curCol = curCol*r.half_w + r.half_w/2
-	} else {
-		curCol = curCol * r.half_w
-	}
-	curRow *= r.half_h
-	r.drawCircle(screen, curCol, curRow, 16, color.RGBA{242, 0, 0, 96}, true)
-
-	// LR
-	curRow = r.c_row + 1
-	curCol = r.c_column + 1
-	if curRow%2 == 0 {
-		curCol -= 1
-		curCol = curCol*r.half_w + r.half_w/2
-	} else {
-		curCol = curCol * r.half_w
-	}
-	curRow *= r.half_h
-	r.drawCircle(screen, curCol, curRow, 16, color.RGBA{0, 0, 242, 96}, true)
-
-	// 2L
-	curRow = r.c_row * r.half_h
-	curCol = r.c_column - 2
-	if curRow%2 == 0 {
-		curCol = curCol*r.half_w + r.half_w/2
-	} else {
-		curCol = curCol * r.half_w
+	for d := range r.geometry.Directions() {
+		x, y := r.center(r.geometry.Neighbor(r.c_row, r.c_column, d))
+		r.drawCircle(screen, x, y, 16, n1Colors[d], true)
 	}
-	r.drawCircle(screen, curCol, curRow, 16, color.RGBA{0, 242, 0, 10}, true)
 
-	// 2R
-	curCol = r.c_column + 2
-	if curRow%2 == 0 {
-		curCol = curCol*r.half_w + r.half_w/2
-	} else {
-		curCol = curCol * r.half_w
-	}
-	r.drawCircle(screen, curCol, curRow, 16, color.RGBA{0, 242, 0, 10}, true)
+	// [2L, 2R, U2L, U2R, L2L, L2R] on hex
+	for i, pos := range r.geometry.N2() {
+		row, column := r.c_row, r.c_column
+		for _, d := range pos.Path {
+			row, column = r.geometry.Neighbor(row, column, d)
+		}
 
-	// U2L
-	curRow = r.c_row - 2
-	curCol = r.c_column - 1
-	if curRow%2 == 0 {
-		curCol = curCol*r.half_w + r.half_w/2
-	} else {
-		curCol = curCol * r.half_w
+		x, y := r.center(row, column)
+		r.drawCircle(screen, x, y, 16, n1Colors[i], true)
 	}
-	curRow *= r.half_h
-	r.drawCircle(screen, curCol, curRow, 16, color.RGBA{242, 0, 0, 10}, true)
+}
 
-	// U2R
-	curRow = r.c_row - 2
-	curCol = r.c_column + 1
-	if curRow%2 == 0 {
-		curCol = curCol*r.half_w + r.half_w/2
-	} else {
-		curCol = curCol * r.half_w
-	}
-	curRow *= r.half_h
-	r.drawCircle(screen, curCol, curRow, 16, color.RGBA{0, 0, 242, 10}, true)
+// step advances the engine of a single step and sends the new round and the
+// error back to the game loop
+func (r *Renderer) step(granularity StepGranularity) {
+	stepTick := make(chan int, 1)
+	res := stepResult{round: -1}
 
-	// L2L
-	curRow = r.c_row + 2
-	curCol = r.c_column - 1
-	if curRow%2 == 0 {
-		curCol = curCol*r.half_w + r.half_w/2
-	} else {
-		curCol = curCol * r.half_w
-	}
-	curRow *= r.half_h
-	r.drawCircle(screen, curCol, curRow, 16, color.RGBA{242, 0, 0, 96}, true)
+	res.err = r.engine.Step(granularity, &stepTick)
 
-	// L2R
-	curRow = r.c_row + 2
-	curCol = r.c_column + 1
-	if curRow%2 == 0 {
-		curCol = curCol*r.half_w + r.half_w/2
-	} else {
-		curCol = curCol * r.half_w
+	select {
+	case res.round = <-stepTick:
+	default:
 	}
-	curRow *= r.half_h
-	r.drawCircle(screen, curCol, curRow, 16, color.RGBA{0, 0, 242, 96}, true)
 
+	r.stepDone <- res
 }
 
 func (r *Renderer) Update() error {
@@ -524,8 +654,29 @@ func (r *Renderer) Update() error {
 	default:
 	}
 
+	select {
+	case res := <-r.stepDone:
+		r.stepping = false
+
+		if res.round >= 0 {
+			r.round = res.round
+		}
+
+		if res.err != nil {
+			r.statusBarMsgs = append(r.statusBarMsgs, statusBarMsg{fmt.Sprintf("%s", res.err), 120})
+		}
+	default:
+	}
+
 	r.keys = inpututil.AppendPressedKeys(r.keys[:0])
 
+	// The scenario picker takes the keys and the mouse while open
+	if r.picker.open {
+		r.updatePicker()
+
+		return nil
+	}
+
 	for _, p := range r.keys {
 		switch p.String() {
 		case "Space":
@@ -539,6 +690,19 @@ func (r *Renderer) Update() error {
 					r.statusBarMsgs = append(r.statusBarMsgs, statusBarMsg{"Simulation start!", 21})
 				}
 			}
+		case "P", "A", "N":
+			// The keys pressed during a step are ignored
+			if inpututil.IsKeyJustPressed(p) && !r.stepping {
+				granularity := map[string]StepGranularity{"P": STEPPHASE, "A": STEPACTIVATION, "N": STEPROUND}[p.String()]
+
+				if r.engine.IsRunning() {
+					r.engine.Stop()
+					r.statusBarMsgs = append(r.statusBarMsgs, statusBarMsg{"Simulation stop!", 21})
+				}
+
+				r.stepping = true
+				go r.step(granularity)
+			}
 		case "L":
 			if inpututil.IsKeyJustPressed(p) {
 				if err := r.engine.LoadScripts(); err != nil {
@@ -555,14 +719,71 @@ func (r *Renderer) Update() error {
 					r.statusBarMsgs = append(r.statusBarMsgs, statusBarMsg{"Engine reloaded...", StatusBarDelay})
 				}
 			}
+		case "M":
+			if inpututil.IsKeyJustPressed(p) {
+				if path, err := r.engine.ExportASCIIMap("maps"); err != nil {
+					r.statusBarMsgs = append(r.statusBarMsgs, statusBarMsg{fmt.Sprintf("%s", err), 120})
+				} else {
+					r.statusBarMsgs = append(r.statusBarMsgs, statusBarMsg{fmt.Sprintf("Exported -> %s", path), StatusBarDelay})
+				}
+			}
+		case "I":
+			if inpututil.IsKeyJustPressed(p) {
+				if path, err := r.engine.ExportPNGMap("maps"); err != nil {
+					r.statusBarMsgs = append(r.statusBarMsgs, statusBarMsg{fmt.Sprintf("%s", err), 120})
+				} else {
+					r.statusBarMsgs = append(r.statusBarMsgs, statusBarMsg{fmt.Sprintf("Exported -> %s", path), StatusBarDelay})
+				}
+			}
+		case "G":
+			if inpututil.IsKeyJustPressed(p) {
+				// With shift the graph is written as GraphML
+				format := DOT
+				if ebiten.IsKeyPressed(ebiten.KeyShift) {
+					format = GRAPHML
+				}
+
+				if path, err := r.engine.ExportGraph("graphs", format, r.GraphObstacles); err != nil {
+					r.statusBarMsgs = append(r.statusBarMsgs, statusBarMsg{fmt.Sprintf("%s", err), 120})
+				} else {
+					r.statusBarMsgs = append(r.statusBarMsgs, statusBarMsg{fmt.Sprintf("Exported -> %s", path), StatusBarDelay})
+				}
+			}
+		case "C":
+			if inpututil.IsKeyJustPressed(p) {
+				// With shift only the cells are saved
+				particles := !ebiten.IsKeyPressed(ebiten.KeyShift)
+
+				if path, err := r.engine.SaveScenario(ScenariosDir, particles); err != nil {
+					r.statusBarMsgs = append(r.statusBarMsgs, statusBarMsg{fmt.Sprintf("%s", err), 120})
+				} else {
+					r.statusBarMsgs = append(r.statusBarMsgs, statusBarMsg{fmt.Sprintf("Saved -> %s", path), StatusBarDelay})
+				}
+			}
 		case "D":
 			if inpututil.IsKeyJustPressed(p) {
 				r.guiDebug = !r.guiDebug
 			}
+		case "ArrowUp":
+			r.moveCamera(0, -CameraSpeed)
+		case "ArrowDown":
+			r.moveCamera(0, CameraSpeed)
+		case "ArrowLeft":
+			r.moveCamera(-CameraSpeed, 0)
+		case "ArrowRight":
+			r.moveCamera(CameraSpeed, 0)
+		case "Home":
+			if inpututil.IsKeyJustPressed(p) {
+				r.camX, r.camY = 0, 0
+			}
 		case "H":
 			if inpututil.IsKeyJustPressed(p) {
 				r.helpDialog = !r.helpDialog
 			}
+		case "S":
+			if inpututil.IsKeyJustPressed(p) {
+				r.openPicker()
+			}
 		case "F":
 			if inpututil.IsKeyJustPressed(p) {
 				ebiten.SetFullscreen(!ebiten.IsFullscreen())
@@ -585,30 +806,28 @@ func (r *Renderer) Update() error {
 
 	mx, my := ebiten.CursorPosition()
 
-	max_row := my / int(r.half_h)
-	max_column := mx / int(r.half_w)
-
-	for row := max_row - 1; row < max_row+2; row++ {
-		cur_h := row * r.half_h
-		w_quarter := r.half_w / 2
+	// Drag the camera with the right mouse button
+	if ebiten.IsMouseButtonPressed(ebiten.MouseButtonRight) {
+		if r.dragging {
+			r.moveCamera(r.dragX-mx, r.dragY-my)
+		}
 
-		for column := max_column - 1; column < max_column+2; column++ {
-			cur_w := column * r.half_w
-			if row%2 == 0 {
-				cur_w += w_quarter
-			}
-			diff_x := cur_w - mx
-			diff_y := cur_h - my
+		r.dragging = true
+		r.dragX, r.dragY = mx, my
+	} else {
+		r.dragging = false
+	}
 
-			if diff_x*diff_x+diff_y*diff_y <= r.max_dist*r.max_dist {
-				r.mx = cur_w
-				r.my = cur_h
-				r.c_row = row
-				r.c_column = column
+	cursorRow, cursorCol := r.geometry.FromPixel(mx+r.camX, my+r.camY, r.hexSize)
+	cur_w, cur_h := r.center(cursorRow, cursorCol)
+	diff_x := cur_w - mx
+	diff_y := cur_h - my
 
-				return nil
-			}
-		}
+	if diff_x*diff_x+diff_y*diff_y <= r.max_dist*r.max_dist {
+		r.mx = cur_w
+		r.my = cur_h
+		r.c_row = cursorRow
+		r.c_column = cursorCol
 	}
 
 	return nil
@@ -616,6 +835,7 @@ func (r *Renderer) Update() error {
 
 func (r *Renderer) Draw(screen *ebiten.Image) {
 	screen.Fill(color.White)
+	r.drawTerrain(screen)
 	r.drawGrid(screen)
 
 	// drawEbitenText(screen)
@@ -626,6 +846,7 @@ func (r *Renderer) Draw(screen *ebiten.Image) {
 		r.drawCursor(screen)
 		r.drawNeighbors(screen)
 	}
+	r.drawBonds(screen)
 	r.drawParticles(screen)
 
 	for _, p := range r.keys {
@@ -658,8 +879,26 @@ func (r *Renderer) Draw(screen *ebiten.Image) {
 		r.drawHelp(screen)
 	}
 
+	if r.picker.open {
+		r.drawPicker(screen)
+	}
+
+}
+
+// Close stops the simulation, writes the particle graph of the run to the
+// GEXF writer of the options, if any, and releases the engine
+func (r *Renderer) Close() error {
+	r.engine.Stop()
+
+	if r.GEXF != nil {
+		if err := r.engine.WriteGEXF(r.GEXF); err != nil {
+			return err
+		}
+	}
+
+	return r.engine.Close()
 }
 
 func (r *Renderer) Layout(outsideWidth, outsideHeight int) (int, int) {
-	return ScreenWidth, ScreenHeight
+	return r.Width, r.Height
 }
@@ -0,0 +1,605 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/d5/tengo/v2"
+)
+
+// Scenario is a whole run in a single JSON file: the world, the initial
+// particles, the scripts and their parameters, the seed and when to stop.
+// The scripts are given by path, relative to the directory of the scenario
+// file, or inline as source code, so that a scenario can be shared as one file.
+type Scenario struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Seed of the random generator, a random seed if missing
+	Seed  *int64        `json:"seed,omitempty"`
+	World ScenarioWorld `json:"world"`
+	// Initial states by "row,column", as numbers or names
+	State map[string]interface{} `json:"init_state"`
+	// ASCII map drawing the initial cells, inline or in a file, its cells
+	// replace the ones of init_state
+	Map     string `json:"map,omitempty"`
+	MapFile string `json:"map_file,omitempty"`
+	// PNG map of the initial cells, its cells replace the ones of the ASCII map
+	ImageFile    string                 `json:"image_file,omitempty"`
+	ImagePalette map[string]interface{} `json:"image_palette,omitempty"`
+	// Generator specs, run in order after the maps, their cells replace the
+	// previous ones
+	Generators               []map[string]interface{} `json:"generators,omitempty"`
+	Terrain                  map[string]interface{}   `json:"terrain,omitempty"`
+	TerrainSlowFactor        *float64                 `json:"terrain_slow_factor,omitempty"`
+	TerrainStickyProbability *float64                 `json:"terrain_sticky_probability,omitempty"`
+	Scheduler                ScenarioScheduler        `json:"scheduler"`
+	Phases                   map[string]interface{}   `json:"phases,omitempty"`
+	SpeedClasses             map[string]interface{}   `json:"speed_classes,omitempty"`
+	SpeedClassOf             map[string]interface{}   `json:"particle_speed_class,omitempty"`
+	Particle                 ScenarioParticle         `json:"particle"`
+	Trigger                  ScenarioScript           `json:"trigger"`
+	Environment              ScenarioScript           `json:"environment"`
+	VisibilityRadius         int                      `json:"visibility_radius,omitempty"`
+	RandomOrientation        bool                     `json:"random_orientation,omitempty"`
+	RandomChirality          bool                     `json:"random_chirality,omitempty"`
+	BondMode                 string                   `json:"bond_mode,omitempty"`
+	Stop                     ScenarioStop             `json:"stop"`
+	// Saved state of the particles by "row,column", see Snapshot
+	Particles map[string]ParticleSnapshot `json:"particles,omitempty"`
+
+	// dir is the directory of the scenario file, the relative paths of the
+	// scripts and of the maps start from it
+	dir string
+}
+
+type ScenarioWorld struct {
+	Rows     int    `json:"rows,omitempty"`
+	Cols     int    `json:"cols,omitempty"`
+	Storage  string `json:"storage,omitempty"`
+	Boundary string `json:"boundary,omitempty"`
+	Geometry string `json:"geometry,omitempty"`
+	HexSize  int    `json:"hex_size,omitempty"`
+}
+
+// ScenarioScript is a tengo script given by path or by source
+type ScenarioScript struct {
+	Script string `json:"script,omitempty"`
+	Source string `json:"source,omitempty"`
+}
+
+// ScenarioScheduler is the scheduler script and the parameters overriding
+// the ones it sets
+type ScenarioScheduler struct {
+	ScenarioScript
+	Type                  *string                `json:"type,omitempty"`
+	EventDriven           *bool                  `json:"event_driven,omitempty"`
+	EventDrivenWithBlocks *bool                  `json:"event_driven_with_blocks,omitempty"`
+	Triggers              []string               `json:"triggers,omitempty"`
+	MoveVisibility        *string                `json:"move_visibility,omitempty"`
+	StaleLog              *string                `json:"stale_log,omitempty"`
+	PoissonRate           *float64               `json:"poisson_rate,omitempty"`
+	PoissonRates          map[string]interface{} `json:"poisson_rates,omitempty"`
+	PoissonTimeStep       *float64               `json:"poisson_time_step,omitempty"`
+	// Params is the params input of the scheduler script
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+// ScenarioParticle is the particle algorithm, its parameters are the params
+// input of the script
+type ScenarioParticle struct {
+	ScenarioScript
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+// ScenarioStop are the conditions ending a run, 0 disables a condition
+type ScenarioStop struct {
+	MaxRounds      int     `json:"max_rounds,omitempty"`
+	MaxVirtualTime float64 `json:"max_virtual_time,omitempty"`
+	// Rounds in a row without any particle moving or changing state
+	IdleRounds int `json:"idle_rounds,omitempty"`
+}
+
+// ParseScenario reads a JSON scenario, the unknown fields are errors
+func ParseScenario(r io.Reader) (*Scenario, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	decoder.UseNumber()
+
+	s := &Scenario{}
+	if err := decoder.Decode(s); err != nil {
+		return nil, err
+	}
+
+	s.State = jsonMap(s.State)
+	s.Terrain = jsonMap(s.Terrain)
+	s.ImagePalette = jsonMap(s.ImagePalette)
+	s.Phases = jsonMap(s.Phases)
+	s.SpeedClasses = jsonMap(s.SpeedClasses)
+	s.SpeedClassOf = jsonMap(s.SpeedClassOf)
+	s.Particle.Params = jsonMap(s.Particle.Params)
+	s.Scheduler.Params = jsonMap(s.Scheduler.Params)
+
+	for key, p := range s.Particles {
+		if p.Inbox != nil {
+			p.Inbox = jsonValue(p.Inbox).([]interface{})
+			s.Particles[key] = p
+		}
+	}
+
+	for i, spec := range s.Generators {
+		s.Generators[i] = jsonMap(spec)
+	}
+
+	if s.Scheduler.PoissonRates != nil {
+		s.Scheduler.PoissonRates = jsonMap(s.Scheduler.PoissonRates)
+	}
+
+	return s, nil
+}
+
+// ReadScenario reads a JSON scenario file
+func ReadScenario(path string) (*Scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s, err := ParseScenario(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	s.dir = filepath.Dir(path)
+
+	return s, nil
+}
+
+// resolvePath returns a path relative to dir, the absolute ones as they are
+func resolvePath(dir, p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+
+	return filepath.Join(dir, p)
+}
+
+// LoadScenario makes the engine run a scenario file instead of the scripts
+// in the scripts directory, an empty path goes back to the scripts
+func (e *Engine) LoadScenario(path string) error {
+	if path == "" {
+		e.scenario = nil
+		e.scenarioPath = ""
+
+		return nil
+	}
+
+	s, err := ReadScenario(path)
+	if err != nil {
+		return err
+	}
+
+	e.scenario = s
+	e.scenarioPath = path
+
+	return nil
+}
+
+// load returns the source of a script, nil if there is none. A relative
+// path starts from dir.
+func (s ScenarioScript) load(dir string) ([]byte, error) {
+	if s.Source != "" {
+		return []byte(s.Source), nil
+	}
+
+	if s.Script != "" {
+		return ioutil.ReadFile(resolvePath(dir, s.Script))
+	}
+
+	return nil, nil
+}
+
+// loadScenarioScripts loads the scripts of the scenario, the scheduler and
+// the particle scripts default to the ones in the scripts directory
+func (e *Engine) loadScenarioScripts(modules *tengo.ModuleMap) error {
+	s := e.scenario
+
+	scheduler, err := s.Scheduler.load(s.dir)
+	if err != nil {
+		return err
+	}
+
+	if scheduler == nil {
+		if scheduler, err = ioutil.ReadFile(e.scriptPath("scheduler.tengo")); err != nil {
+			return err
+		}
+	}
+
+	e.schedulerScript = tengo.NewScript(scheduler)
+	e.schedulerScript.SetImports(modules)
+
+	e.triggerScript = nil
+	if trigger, err := s.Trigger.load(s.dir); err != nil {
+		return err
+	} else if trigger != nil {
+		e.triggerScript = tengo.NewScript(trigger)
+		e.triggerScript.SetImports(modules)
+	}
+
+	e.environmentScript = nil
+	if environment, err := s.Environment.load(s.dir); err != nil {
+		return err
+	} else if environment != nil {
+		e.environmentScript = tengo.NewScript(environment)
+		e.environmentScript.SetImports(modules)
+	}
+
+	particle, err := s.Particle.load(s.dir)
+	if err != nil {
+		return err
+	}
+
+	if particle == nil {
+		return e.loadParticleScripts(modules)
+	}
+
+	name := s.Name
+	if s.Particle.Script != "" {
+		name = path.Base(s.Particle.Script)
+	}
+
+	curScript := tengo.NewScript(particle)
+	curScript.SetImports(modules)
+
+	e.particleScript = []*tengo.Script{curScript}
+	e.particleScriptNames = []string{name}
+	e.particleScriptSelected = 0
+
+	return nil
+}
+
+// jsonValue converts the numbers of a decoded JSON value to int64 or
+// float64, the types of the numbers in the tengo maps
+func jsonValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+
+		f, _ := v.Float64()
+
+		return f
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			res[key] = jsonValue(item)
+		}
+
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, item := range v {
+			res[i] = jsonValue(item)
+		}
+
+		return res
+	}
+
+	return val
+}
+
+func jsonMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return make(map[string]interface{})
+	}
+
+	return jsonValue(m).(map[string]interface{})
+}
+
+// initialConfig converts the scenario to the configuration of the init script
+func (s *Scenario) initialConfig(rng *rand.Rand) (*InitialConfig, error) {
+	config := &InitialConfig{
+		HexSize: s.World.HexSize,
+		World: WorldConfig{
+			Rows: s.World.Rows,
+			Cols: s.World.Cols,
+		},
+		State:             make(map[string]interface{}),
+		SpeedClasses:      make(map[string]SpeedClass),
+		SpeedClassOf:      s.SpeedClassOf,
+		Terrain:           make(map[cell]Terrain),
+		TerrainSlowFactor: 2.0,
+		TerrainStickiness: 0.5,
+		VisibilityRadius:  s.VisibilityRadius,
+		RandomOrientation: s.RandomOrientation,
+		RandomChirality:   s.RandomChirality,
+		Particles:         s.Particles,
+	}
+
+	if config.HexSize <= 0 {
+		config.HexSize = 32
+	}
+
+	var err error
+
+	if config.World.Storage, err = ParseWorldStorage(s.World.Storage); err != nil {
+		return nil, err
+	}
+
+	if config.World.Boundary, err = ParseBoundary(s.World.Boundary); err != nil {
+		return nil, err
+	}
+
+	if config.World.Geometry, err = ParseGeometry(s.World.Geometry); err != nil {
+		return nil, err
+	}
+
+	if config.BondMode, err = ParseBondMode(s.BondMode); err != nil {
+		return nil, err
+	}
+
+	if config.VisibilityRadius < 0 {
+		return nil, fmt.Errorf("visibility_radius %d is negative", config.VisibilityRadius)
+	}
+
+	// The states are numbers, as in init_state, or names
+	parser := &Particle{geometry: config.World.Geometry}
+
+	for key, val := range s.State {
+		switch v := val.(type) {
+		case int64:
+			config.State[key] = v
+		case string:
+			state, err := parser.parseState(strings.ToUpper(v))
+			if err != nil {
+				return nil, fmt.Errorf("init_state %s: %w", key, err)
+			}
+
+			config.State[key] = int64(state)
+		default:
+			return nil, fmt.Errorf("init_state %s: '%v' is not a valid state", key, val)
+		}
+	}
+
+	mapState := make(map[string]interface{})
+
+	switch {
+	case s.Map != "":
+		mapState, err = ParseASCIIMap(strings.NewReader(s.Map), config.World.Geometry)
+	case s.MapFile != "":
+		mapState, err = ReadASCIIMap(resolvePath(s.dir, s.MapFile), config.World.Geometry)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for key, val := range mapState {
+		config.State[key] = val
+	}
+
+	if config.ImagePalette, err = ParsePalette(s.ImagePalette, config.World.Geometry); err != nil {
+		return nil, err
+	}
+
+	if s.ImageFile != "" {
+		imageState, err := ReadPNGMap(resolvePath(s.dir, s.ImageFile), config.ImagePalette)
+		if err != nil {
+			return nil, err
+		}
+
+		for key, val := range imageState {
+			config.State[key] = val
+		}
+	}
+
+	for _, spec := range s.Generators {
+		cells, err := Generate(spec, config.World, rng)
+		if err != nil {
+			return nil, err
+		}
+
+		for key, val := range cells {
+			config.State[key] = val
+		}
+	}
+
+	if config.Terrain, err = ParseTerrainMap(s.Terrain); err != nil {
+		return nil, err
+	}
+
+	if s.TerrainSlowFactor != nil {
+		if config.TerrainSlowFactor = *s.TerrainSlowFactor; config.TerrainSlowFactor < 1 {
+			return nil, fmt.Errorf("terrain_slow_factor %f is less than 1", config.TerrainSlowFactor)
+		}
+	}
+
+	if s.TerrainStickyProbability != nil {
+		if config.TerrainStickiness = *s.TerrainStickyProbability; config.TerrainStickiness < 0 || config.TerrainStickiness > 1 {
+			return nil, fmt.Errorf("terrain_sticky_probability %f is not in [0, 1]", config.TerrainStickiness)
+		}
+	}
+
+	for name, phase := range map[string]*PhaseDuration{
+		"wakeup":  &config.PhaseWakeup,
+		"look":    &config.PhaseLook,
+		"compute": &config.PhaseCompute,
+		"move":    &config.PhaseMove,
+	} {
+		*phase = UniformDuration(1000)
+
+		if val, ok := s.Phases[name]; ok {
+			if *phase, err = ParsePhaseDuration(val); err != nil {
+				return nil, fmt.Errorf("phase %s: %w", name, err)
+			}
+		}
+	}
+
+	if config.SpeedClasses, err = ParseSpeedClasses(s.SpeedClasses); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// applySchedulerOverrides sets the scheduler parameters of the scenario,
+// over the ones set by the scheduler script
+func (e *Engine) applySchedulerOverrides() error {
+	if e.scenario == nil {
+		return nil
+	}
+
+	s := e.scenario.Scheduler
+
+	if s.Type != nil {
+		switch strings.ToLower(*s.Type) {
+		case "async":
+			e.SetAsyncSheduler()
+		case "sync":
+			e.SetSyncSheduler()
+		case "poisson":
+			e.SetPoissonSheduler()
+		default:
+			return fmt.Errorf("'%s' is not a valid scheduler type", *s.Type)
+		}
+	}
+
+	if s.EventDriven != nil {
+		e.schedulerEventDriven = *s.EventDriven
+	}
+
+	if s.EventDrivenWithBlocks != nil {
+		e.schedulerEventDrivenWithBlocks = *s.EventDrivenWithBlocks
+	}
+
+	if s.Triggers != nil {
+		e.schedulerTriggers = make([]Trigger, 0, len(s.Triggers))
+
+		for _, t := range s.Triggers {
+			trigger, err := parseTrigger(t)
+			if err != nil {
+				return err
+			}
+
+			e.schedulerTriggers = append(e.schedulerTriggers, trigger)
+		}
+	}
+
+	if s.MoveVisibility != nil {
+		visibility, err := parseMoveVisibility(*s.MoveVisibility)
+		if err != nil {
+			return err
+		}
+
+		e.moveVisibility = visibility
+	}
+
+	if s.StaleLog != nil {
+		e.staleLog = *s.StaleLog
+	}
+
+	if s.PoissonRate != nil {
+		e.poissonRate = *s.PoissonRate
+	}
+
+	if s.PoissonRates != nil {
+		e.poissonRates = s.PoissonRates
+	}
+
+	if s.PoissonTimeStep != nil {
+		e.poissonTimeStep = *s.PoissonTimeStep
+	}
+
+	return nil
+}
+
+// particleParams returns the params input of the particle scripts
+func (e *Engine) particleParams() map[string]interface{} {
+	if e.scenario == nil {
+		return make(map[string]interface{})
+	}
+
+	return e.scenario.Particle.Params
+}
+
+// schedulerParams returns the params input of the scheduler script
+func (e *Engine) schedulerParams() map[string]interface{} {
+	if e.scenario == nil || e.scenario.Scheduler.Params == nil {
+		return make(map[string]interface{})
+	}
+
+	return e.scenario.Scheduler.Params
+}
+
+// stopReached checks the stop conditions of the scenario between two
+// updates, it returns the reason to stop or an empty string
+func (e *Engine) stopReached() string {
+	stop := e.stopConditions()
+	if stop == (ScenarioStop{}) {
+		return ""
+	}
+	round := e.getRound()
+
+	if round != e.stopRound {
+		e.staleMu.Lock()
+		changeSeq := e.changeSeq
+		e.staleMu.Unlock()
+
+		if changeSeq == e.stopChangeSeq {
+			e.idleRounds += 1
+		} else {
+			e.idleRounds = 0
+		}
+
+		e.stopRound, e.stopChangeSeq = round, changeSeq
+	}
+
+	switch {
+	case stop.MaxRounds > 0 && round >= stop.MaxRounds && round != math.MaxInt:
+		return fmt.Sprintf("round %d reached", stop.MaxRounds)
+	case stop.MaxVirtualTime > 0 && e.virtualTime >= stop.MaxVirtualTime:
+		return fmt.Sprintf("virtual time %.2f reached", stop.MaxVirtualTime)
+	case stop.IdleRounds > 0 && e.idleRounds >= stop.IdleRounds:
+		return fmt.Sprintf("idle for %d rounds", stop.IdleRounds)
+	}
+
+	return ""
+}
+
+// stopConditions returns the stop conditions of the scenario, the max
+// rounds set with SetMaxRounds take precedence
+func (e *Engine) stopConditions() ScenarioStop {
+	stop := ScenarioStop{}
+	if e.scenario != nil {
+		stop = e.scenario.Stop
+	}
+
+	if e.maxRounds > 0 {
+		stop.MaxRounds = e.maxRounds
+	}
+
+	return stop
+}
+
+// SetMaxRounds stops the runs at a round, also without a scenario, 0 keeps
+// the stop conditions of the scenario
+func (e *Engine) SetMaxRounds(rounds int) {
+	e.maxRounds = rounds
+}
+
+// StopReason returns why the scenario stopped, empty if it did not
+func (e *Engine) StopReason() string {
+	e.asyncMu.RLock()
+	defer e.asyncMu.RUnlock()
+
+	return e.stopReason
+}
@@ -0,0 +1,282 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ParticleSnapshot is the state of a particle beyond its state, to resume a
+// configuration where it was saved
+type ParticleSnapshot struct {
+	Round int           `json:"round"`
+	Light string        `json:"light,omitempty"`
+	Inbox []interface{} `json:"inbox,omitempty"`
+	// Bonded N1 directions, global
+	Bonds []string `json:"bonds,omitempty"`
+	// Local frame of the particle
+	Rotation int  `json:"rotation,omitempty"`
+	Mirror   bool `json:"mirror,omitempty"`
+}
+
+// restoreParticles applies the saved state of the particles, the particles
+// are already in the world
+func (e *Engine) restoreParticles(snapshots map[string]ParticleSnapshot) error {
+	directions := e.geometry.Directions()
+
+	for key, snapshot := range snapshots {
+		row, column, err := parseCellKey(key)
+		if err != nil {
+			return fmt.Errorf("particles: %w", err)
+		}
+
+		p := e.particleAt(row, column)
+		if p == nil || p.state == OBSTACLE {
+			return fmt.Errorf("particles: no particle in cell %s", key)
+		}
+
+		if snapshot.Rotation < 0 || snapshot.Rotation >= len(directions) {
+			return fmt.Errorf("particles %s: rotation %d is not in [0, %d)", key, snapshot.Rotation, len(directions))
+		}
+
+		p.round = snapshot.Round
+		p.light = snapshot.Light
+		p.nextLight = snapshot.Light
+		p.rotation = snapshot.Rotation
+		p.mirror = snapshot.Mirror
+		p.frame = e.frameOf(row, column, p)
+
+		if snapshot.Inbox != nil {
+			p.inbox = snapshot.Inbox
+		}
+
+		for _, name := range snapshot.Bonds {
+			d := indexOf(directions, name)
+			if d < 0 {
+				return fmt.Errorf("particles %s: '%s' is not a direction", key, name)
+			}
+
+			nRow, nCol := e.geometry.Neighbor(row, column, d)
+
+			n := e.particleAt(nRow, nCol)
+			if n == nil || n.state == OBSTACLE {
+				return fmt.Errorf("particles %s: no particle to bond with in direction %s", key, name)
+			}
+
+			e.bond(p, n)
+		}
+	}
+
+	return nil
+}
+
+func indexOf(items []string, item string) int {
+	for i, cur := range items {
+		if cur == item {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Snapshot returns the live configuration as a scenario: the world, the
+// states of the cells, the terrain and the settings of the run, the ones of
+// the running scenario or of the scripts. With particles, the round, the
+// light, the pending messages, the bonds and the local frame of every
+// particle are saved too. The script paths stay relative, to the directory
+// of the running scenario or to the working directory.
+func (e *Engine) Snapshot(particles bool) *Scenario {
+	s := &Scenario{dir: "."}
+	name := "the scripts"
+
+	if e.scenario != nil {
+		*s = *e.scenario
+		if s.Name != "" {
+			name = s.Name
+		}
+
+		// The scripts shared by all the particles stay, the selected one is saved
+		if s.Particle.Script == "" && s.Particle.Source == "" {
+			s.Particle.Script = relativePath(s.dir, e.scriptPath(e.particleScriptNames[e.particleScriptSelected]))
+		}
+	} else {
+		s.Scheduler.Script = e.scriptPath("scheduler.tengo")
+		s.Particle.Script = e.scriptPath(e.particleScriptNames[e.particleScriptSelected])
+
+		if e.triggerScript != nil {
+			s.Trigger.Script = e.scriptPath("trigger.tengo")
+		}
+
+		if e.environmentScript != nil {
+			s.Environment.Script = e.scriptPath("environment.tengo")
+		}
+
+		s.Phases = map[string]interface{}{
+			"wakeup":  e.asyncInitPhase.Value(),
+			"look":    e.asyncLookPhase.Value(),
+			"compute": e.asyncComputePhase.Value(),
+			"move":    e.asyncMovePhase.Value(),
+		}
+
+		s.SpeedClasses = make(map[string]interface{}, len(e.speedClasses))
+		for className, class := range e.speedClasses {
+			s.SpeedClasses[className] = map[string]interface{}{"factor": class.Factor, "share": class.Share}
+		}
+
+		s.SpeedClassOf = e.speedClassOf
+		s.VisibilityRadius = e.visibilityRadius
+		s.RandomOrientation = e.randomOrientation
+		s.RandomChirality = e.randomChirality
+		s.BondMode = e.bondMode.String()
+	}
+
+	round := e.getRound()
+	if round == math.MaxInt {
+		round = 0
+	}
+
+	seed := e.seed
+	s.Seed = &seed
+	s.Name = fmt.Sprintf("Snapshot of %s", name)
+	s.Description = fmt.Sprintf("Round %d of %s, saved on %s", round, name, time.Now().Format("2006-01-02 15:04:05"))
+
+	s.World = ScenarioWorld{
+		Rows:     e.worldConfig.Rows,
+		Cols:     e.worldConfig.Cols,
+		Storage:  e.worldConfig.Storage.String(),
+		Boundary: e.worldConfig.Boundary.String(),
+		Geometry: e.geometry.Name(),
+		HexSize:  e.hexSize,
+	}
+
+	// The cells replace the maps and the generators
+	s.Map, s.MapFile, s.ImageFile, s.ImagePalette, s.Generators = "", "", "", nil, nil
+
+	s.State = make(map[string]interface{})
+	s.Particles = nil
+
+	if particles {
+		s.Particles = make(map[string]ParticleSnapshot)
+	}
+
+	directions := e.geometry.Directions()
+
+	e.world.Each(func(c cell, p *Particle) {
+		key := fmt.Sprintf("%d,%d", c.row, c.column)
+		s.State[key] = p.GetStateS(nil)
+
+		if !particles || p.state == OBSTACLE {
+			return
+		}
+
+		snapshot := ParticleSnapshot{
+			Round:    p.round,
+			Light:    p.light,
+			Rotation: p.rotation,
+			Mirror:   p.mirror,
+		}
+
+		if len(p.inbox) > 0 {
+			snapshot.Inbox = p.inbox
+		}
+
+		for d, name := range directions {
+			row, column := e.geometry.Neighbor(c.row, c.column, d)
+			if n := e.particleAt(row, column); n != nil && e.bonded(p, n) {
+				snapshot.Bonds = append(snapshot.Bonds, name)
+			}
+		}
+
+		s.Particles[key] = snapshot
+	})
+
+	s.Terrain = make(map[string]interface{}, len(e.terrain))
+	for c, t := range e.terrain {
+		s.Terrain[fmt.Sprintf("%d,%d", c.row, c.column)] = t.String()
+	}
+
+	slowFactor, stickiness := e.terrainSlowFactor, e.terrainStickiness
+	s.TerrainSlowFactor = &slowFactor
+	s.TerrainStickyProbability = &stickiness
+
+	return s
+}
+
+// relativePath returns the path of target from dir, the relative ones start
+// from the working directory. A path that cannot be made relative stays as it is.
+func relativePath(dir, target string) string {
+	if target == "" {
+		return target
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return target
+	}
+
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return target
+	}
+
+	rel, err := filepath.Rel(absDir, absTarget)
+	if err != nil {
+		return target
+	}
+
+	return rel
+}
+
+// moveTo makes the relative paths of the scenario start from dir, where it is
+// going to be saved, the absolute ones stay
+func (s *Scenario) moveTo(dir string) {
+	for _, p := range []*string{
+		&s.Scheduler.Script, &s.Particle.Script, &s.Trigger.Script, &s.Environment.Script,
+		&s.MapFile, &s.ImageFile,
+	} {
+		if !filepath.IsAbs(*p) {
+			*p = relativePath(dir, resolvePath(s.dir, *p))
+		}
+	}
+
+	s.dir = dir
+}
+
+// Write writes the scenario as indented JSON
+func (s *Scenario) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(s)
+}
+
+// SaveScenario writes the live configuration to a new timestamped scenario
+// file in dir and returns its path
+func (e *Engine) SaveScenario(dir string, particles bool) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("snapshot-%s.json", time.Now().Format("20060102-150405")))
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// The scripts are found from the directory of the snapshot
+	s := e.Snapshot(particles)
+	s.moveTo(dir)
+
+	if err := s.Write(f); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
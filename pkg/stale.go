@@ -0,0 +1,203 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+type MoveVisibility int
+
+const (
+	ATOMIC MoveVisibility = iota
+	INPROGRESS
+)
+
+func parseMoveVisibility(s string) (MoveVisibility, error) {
+	switch strings.ToLower(s) {
+	case "atomic":
+		return ATOMIC, nil
+	case "in_progress":
+		return INPROGRESS, nil
+	}
+
+	return -1, fmt.Errorf("'%s' is not a valid move visibility", s)
+}
+
+// cellChanged records that the content of a cell changed
+func (e *Engine) cellChanged(row, column int) {
+	e.staleMu.Lock()
+	e.changeSeq += 1
+	e.cellVersions[cell{row, column}] = e.changeSeq
+	e.staleMu.Unlock()
+
+	e.markTouched(row, column)
+}
+
+// takeSnapshot marks the moment a particle looks at its neighborhood
+func (e *Engine) takeSnapshot(p *Particle) {
+	e.staleMu.Lock()
+	defer e.staleMu.Unlock()
+
+	p.lookSeq = e.changeSeq
+	p.looked = true
+}
+
+// showMoveInProgress makes the move computed by a particle visible to the
+// others until it is applied, as the state the particle is moving to.
+func (e *Engine) showMoveInProgress(row, column int) {
+	curParticle := e.particleAt(row, column)
+
+	if _, ok := stateDirection(curParticle.nextState); ok && curParticle.nextState != curParticle.state {
+		curParticle.prevState = curParticle.state
+		curParticle.state = curParticle.nextState
+		curParticle.inProgress = true
+
+		e.cellChanged(row, column)
+	}
+}
+
+// hideMoveInProgress restores the state of a particle before applying its move
+func (e *Engine) hideMoveInProgress(row, column int) {
+	curParticle := e.particleAt(row, column)
+
+	if curParticle.inProgress {
+		curParticle.state = curParticle.prevState
+		curParticle.inProgress = false
+
+		e.cellChanged(row, column)
+	}
+}
+
+// staleCells returns the cells in the view of a particle changed after its look
+func (e *Engine) staleCells(row, column int) []cell {
+	curParticle := e.particleAt(row, column)
+	stale := make([]cell, 0)
+
+	if !curParticle.looked {
+		return stale
+	}
+
+	// The view is made of the rings seen by the look phase, the N1 and N2
+	// cells (and the degrees of N1) lie within the second one
+	radius := e.visibilityRadius
+	if radius < 2 {
+		radius = 2
+	}
+
+	view := e.ringCells(row, column, radius, curParticle)
+	seen := make(map[cell]bool)
+
+	e.staleMu.Lock()
+	defer e.staleMu.Unlock()
+
+	for _, ring := range view {
+		for _, c := range ring {
+			// A small torus wraps a ring onto the others
+			if seen[c] {
+				continue
+			}
+
+			seen[c] = true
+
+			if e.cellVersions[c] > curParticle.lookSeq {
+				stale = append(stale, c)
+			}
+		}
+	}
+
+	return stale
+}
+
+// openStaleLog opens the log of the stale activations set by the scheduler
+// script, once for a log file
+func (e *Engine) openStaleLog() error {
+	e.staleMu.Lock()
+	defer e.staleMu.Unlock()
+
+	if e.staleFile != nil && e.staleFile.Name() == e.staleLog {
+		return nil
+	}
+
+	if e.staleFile != nil {
+		e.staleFile.Close()
+		e.staleFile = nil
+	}
+
+	if e.staleLog == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(e.staleLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("stale_log: %w", err)
+	}
+
+	e.staleFile = f
+
+	return nil
+}
+
+// closeStaleLog closes the log of the stale activations
+func (e *Engine) closeStaleLog() error {
+	e.staleMu.Lock()
+	defer e.staleMu.Unlock()
+
+	if e.staleFile == nil {
+		return nil
+	}
+
+	err := e.staleFile.Close()
+	e.staleFile = nil
+
+	return err
+}
+
+// StaleActivations returns the number of activations applied on a stale view
+// since Init
+func (e *Engine) StaleActivations() int {
+	e.staleMu.Lock()
+	defer e.staleMu.Unlock()
+
+	return e.staleActivations
+}
+
+// checkStale counts, and logs, the activation of the particle at
+// [row, column] if it computed its next state on a view changed before its
+// move is applied.
+func (e *Engine) checkStale(row, column int) error {
+	curParticle := e.particleAt(row, column)
+	stale := e.staleCells(row, column)
+
+	curParticle.looked = false
+
+	if len(stale) == 0 {
+		return nil
+	}
+
+	e.staleMu.Lock()
+	defer e.staleMu.Unlock()
+
+	e.staleActivations += 1
+
+	if e.staleFile == nil {
+		return nil
+	}
+
+	cells := make([]string, 0, len(stale))
+	for _, c := range stale {
+		cells = append(cells, fmt.Sprintf("%d,%d", c.row, c.column))
+	}
+
+	// round;row;column;state;next state;changed cells
+	_, err := fmt.Fprintf(e.staleFile, "%d;%d;%d;%s;%s;%s\n",
+		curParticle.round, row, column,
+		curParticle.GetStateS(nil), curParticle.GetStateS(&curParticle.nextState),
+		strings.Join(cells, " "),
+	)
+	if err != nil {
+		return fmt.Errorf("stale_log: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,322 @@
+package pkg
+
+import (
+	"container/heap"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type StepGranularity int
+
+const (
+	STEPPHASE StepGranularity = iota
+	STEPACTIVATION
+	STEPROUND
+)
+
+// maxStepUpdates bounds the updates done to complete a round step
+const maxStepUpdates = 10000
+
+// maxIdleTicks bounds the scheduler ticks in a row that activate none of the
+// particles left behind in the round, before a round step gives up
+const maxIdleTicks = 20
+
+func (p Phases) String() string {
+	switch p {
+	case SCHEDULER:
+		return "SCHEDULER"
+	case LOOK:
+		return "LOOK"
+	case COMPUTE:
+		return "COMPUTE"
+	case MOVE:
+		return "MOVE"
+	}
+
+	return "UNKNOWN"
+}
+
+// parseCellKey parses a "row,column" key
+func parseCellKey(key string) (int, int, error) {
+	parts := strings.Split(key, ",")
+	if len(parts) != 2 {
+		return -1, -1, fmt.Errorf("'%s' is not a valid cell", key)
+	}
+
+	row, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 0)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	column, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 0)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	return int(row), int(column), nil
+}
+
+// NextStep describes what the next step will execute
+func (e *Engine) NextStep() string {
+	switch e.schedulerType {
+	case SYNC:
+		return e.phase.String()
+	case ASYNC:
+		return "ASYNC SCHEDULER"
+	case POISSON:
+		return fmt.Sprintf("POISSON t=%.2f", e.virtualTime)
+	}
+
+	return ""
+}
+
+// Step advances the simulation of exactly one phase, one activation or one
+// round and sends the new round to eTick. The engine has to be stopped.
+func (e *Engine) Step(granularity StepGranularity, eTick *chan int) error {
+	if e.IsRunning() {
+		return fmt.Errorf("stop the simulation before stepping")
+	}
+
+	e.asyncMu.Lock()
+	if e.stepping {
+		e.asyncMu.Unlock()
+
+		return fmt.Errorf("a step is already in progress")
+	}
+
+	e.stepping = true
+	e.asyncMu.Unlock()
+
+	defer func() {
+		e.asyncMu.Lock()
+		e.stepping = false
+		e.asyncMu.Unlock()
+	}()
+
+	err := e.step(granularity)
+
+	if eTick != nil {
+		*eTick <- e.getRound()
+	}
+
+	return err
+}
+
+// step runs a step with the update lock held, a script that panics fails the
+// step instead of the caller
+func (e *Engine) step(granularity StepGranularity) (err error) {
+	e.updateMu.Lock()
+	defer e.updateMu.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	switch granularity {
+	case STEPPHASE:
+		err = e.stepPhase()
+	case STEPACTIVATION:
+		err = e.stepActivation()
+	case STEPROUND:
+		err = e.stepRound()
+	}
+
+	if err == nil {
+		err = e.updateEnvironment()
+	}
+
+	if err == nil {
+		err = e.recordTrace()
+		e.recordGraph()
+	}
+
+	return err
+}
+
+// stepPhase runs a single update: a sync phase, an async scheduler tick
+// or a Poisson time step
+func (e *Engine) stepPhase() error {
+	switch e.schedulerType {
+	case SYNC:
+		return e.syncUpdate()
+	case ASYNC:
+		if err := e.asyncUpdate(); err != nil {
+			return err
+		}
+
+		// The tasks that failed stopped the engine
+		e.asyncTasks.Wait()
+
+		return e.Err()
+	case POISSON:
+		return e.poissonUpdate()
+	}
+
+	return nil
+}
+
+// stepActivation runs atomically the Look-Compute-Move cycle of the next
+// particle: the next clock to ring for the Poisson scheduler, otherwise the
+// next one picked by the scheduler script.
+func (e *Engine) stepActivation() error {
+	if e.schedulerType == POISSON {
+		if !e.poissonReady {
+			e.initPoissonClocks()
+		}
+
+		for e.poissonQueue.Len() > 0 {
+			next := heap.Pop(&e.poissonQueue).(*activation)
+
+			// A particle dragged by a bond keeps its clock
+			if c, ok := e.draggedTo(next.particle); ok {
+				next.row, next.column = c.row, c.column
+			}
+
+			if e.particleAt(next.row, next.column) != next.particle {
+				continue
+			}
+
+			e.virtualTime = next.time
+
+			row, column, err := e.activate(next.row, next.column)
+			if err != nil {
+				return err
+			}
+
+			next.row, next.column = row, column
+			next.time += e.nextClockTick(next.particle)
+
+			heap.Push(&e.poissonQueue, next)
+
+			return nil
+		}
+
+		return fmt.Errorf("no particle to activate")
+	}
+
+	if e.schedulerType == SYNC && e.phase != SCHEDULER {
+		return fmt.Errorf("complete the synchronous round before stepping an activation")
+	}
+
+	e.asyncTasks.Wait()
+
+	if len(e.stepQueue) == 0 {
+		particles, states := e.activeParticles()
+
+		res, err := e.Scheduler(particles, states)
+		if err != nil {
+			return err
+		}
+
+		e.rng.Shuffle(len(res), func(i, j int) { res[i], res[j] = res[j], res[i] })
+
+		e.stepQueue = res
+	}
+
+	for len(e.stepQueue) > 0 {
+		key := fmt.Sprintf("%v", e.stepQueue[0])
+		e.stepQueue = e.stepQueue[1:]
+
+		row, column, err := parseCellKey(key)
+		if err != nil {
+			return err
+		}
+
+		curParticle := e.particleAt(row, column)
+		if curParticle == nil || curParticle.state == OBSTACLE {
+			continue
+		}
+
+		_, _, err = e.activate(row, column)
+
+		return err
+	}
+
+	return fmt.Errorf("the scheduler did not pick any particle")
+}
+
+// stepRound runs updates until the current round is completed. A sync round
+// already in progress is completed, otherwise a new one is executed.
+func (e *Engine) stepRound() error {
+	startRound := e.getRound()
+	targetRound := startRound + 1
+
+	if e.schedulerType == SYNC && e.phase != SCHEDULER {
+		targetRound = startRound
+	}
+
+	laggards := e.roundLaggards()
+	idle, empty := 0, 0
+
+	for i := 0; i < maxStepUpdates; i++ {
+		if err := e.stepPhase(); err != nil {
+			return err
+		}
+
+		if e.getRound() >= targetRound && (e.schedulerType != SYNC || e.phase == SCHEDULER) {
+			return nil
+		}
+
+		// The Poisson clocks of the particles all ring, sooner or later
+		if e.schedulerType == POISSON {
+			continue
+		}
+
+		// A sync round is checked once its particles moved
+		if e.schedulerType == SYNC && e.phase != SCHEDULER {
+			continue
+		}
+
+		if len(e.schedulerRes) == 0 {
+			empty += 1
+		}
+
+		if left := e.roundLaggards(); left < laggards {
+			laggards, idle, empty = left, 0, 0
+		} else if idle += 1; idle >= maxIdleTicks {
+			if empty == idle {
+				return fmt.Errorf("round %d not completed, the scheduler did not pick any particle in %d ticks", startRound, idle)
+			}
+
+			return fmt.Errorf("round %d not completed, %d particles not activated in %d scheduler ticks", startRound, left, idle)
+		}
+	}
+
+	return fmt.Errorf("round %d not completed after %d updates", startRound, maxStepUpdates)
+}
+
+// roundLaggards returns the number of particles still in the current round
+func (e *Engine) roundLaggards() int {
+	round := e.getRound()
+
+	e.asyncMu.RLock()
+	defer e.asyncMu.RUnlock()
+
+	laggards := 0
+
+	e.world.Each(func(_ cell, particle *Particle) {
+		if particle.state != OBSTACLE && particle.Round() == round {
+			laggards += 1
+		}
+	})
+
+	return laggards
+}
+
+// activeParticles returns the keys and the states of all the particles
+func (e *Engine) activeParticles() ([]interface{}, []interface{}) {
+	particles := make([]interface{}, 0)
+	states := make([]interface{}, 0)
+
+	e.world.Each(func(c cell, particle *Particle) {
+		if particle.state != OBSTACLE {
+			particles = append(particles, fmt.Sprintf("%d,%d", c.row, c.column))
+			states = append(states, particle.GetStateS(nil))
+		}
+	})
+
+	return particles, states
+}
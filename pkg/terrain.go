@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Terrain is the static type of a cell, independent of the particle on it
+type Terrain int
+
+const (
+	FLOOR Terrain = iota
+	// SOLID is the wall terrain: it cannot be entered, the particles see it as an obstacle
+	SOLID
+	// HOLE swallows the particles moving into it
+	HOLE
+	// SLOW makes the async moves from or into it last longer
+	SLOW
+	// STICKY makes the moves out of it fail with some probability
+	STICKY
+)
+
+func ParseTerrain(s string) (Terrain, error) {
+	switch strings.ToLower(s) {
+	case "", "floor":
+		return FLOOR, nil
+	case "wall":
+		return SOLID, nil
+	case "hole":
+		return HOLE, nil
+	case "slow":
+		return SLOW, nil
+	case "sticky":
+		return STICKY, nil
+	}
+
+	return -1, fmt.Errorf("'%s' is not a valid terrain", s)
+}
+
+func (t Terrain) String() string {
+	return [...]string{"floor", "wall", "hole", "slow", "sticky"}[t]
+}
+
+// ParseTerrainMap reads the terrain of the cells from a map of "row,column"
+// keys, the cells not in the map are floor
+func ParseTerrainMap(m map[string]interface{}) (map[cell]Terrain, error) {
+	res := make(map[cell]Terrain, len(m))
+
+	for key, val := range m {
+		parts := strings.Split(key, ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("terrain cell '%s' is not row,column", key)
+		}
+
+		row, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, fmt.Errorf("terrain cell '%s': %w", key, err)
+		}
+
+		column, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("terrain cell '%s': %w", key, err)
+		}
+
+		terrain, err := ParseTerrain(fmt.Sprintf("%v", val))
+		if err != nil {
+			return nil, fmt.Errorf("terrain cell '%s': %w", key, err)
+		}
+
+		if terrain != FLOOR {
+			res[cell{row, column}] = terrain
+		}
+	}
+
+	return res, nil
+}
+
+// terrainAt returns the terrain of a cell
+func (e *Engine) terrainAt(row, column int) Terrain {
+	return e.terrain[e.wrap(cell{row, column})]
+}
+
+// impassable is true for the cells beyond the wall and the wall terrain
+func (e *Engine) impassable(row, column int) bool {
+	return e.outOfWorld(row, column) || e.terrainAt(row, column) == SOLID
+}
+
+// stuck is true when a move out of a sticky cell fails
+func (e *Engine) stuck(row, column int) bool {
+	return e.terrainAt(row, column) == STICKY && e.rng.Float64() < e.terrainStickiness
+}
+
+// moveDuration returns the duration of the async move phase of the particle
+// at [row, column], longer when it moves from or into a slow cell
+func (e *Engine) moveDuration(row, column int, p *Particle) time.Duration {
+	duration := e.phaseDuration(e.asyncMovePhase, p)
+
+	newRow, newCol := e.moveTarget(row, column, p.nextState)
+	if e.terrainAt(row, column) == SLOW || e.terrainAt(newRow, newCol) == SLOW {
+		duration = time.Duration(float64(duration) * e.terrainSlowFactor)
+	}
+
+	return duration
+}
+
+// fallInHole removes the particle at [row, column] if the cell is a hole
+func (e *Engine) fallInHole(row, column int) {
+	if e.particleAt(row, column) == nil || e.terrainAt(row, column) != HOLE {
+		return
+	}
+
+	e.removeParticle(row, column)
+
+	e.lostMu.Lock()
+	e.lostParticles += 1
+	e.lostMu.Unlock()
+}
+
+// LostParticles returns the number of particles fallen in a hole
+func (e *Engine) LostParticles() int {
+	e.lostMu.Lock()
+	defer e.lostMu.Unlock()
+
+	return e.lostParticles
+}
@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A trace records a run as JSON lines, one per engine update: the round,
+// the virtual time of the Poisson scheduler and the cells changed since the
+// previous line, by "row,column" with VOID for the emptied cells. The first
+// line of a world has all its cells and "full" set.
+
+type traceLine struct {
+	Round       int               `json:"round"`
+	VirtualTime float64           `json:"virtual_time"`
+	Full        bool              `json:"full,omitempty"`
+	Stopped     string            `json:"stopped,omitempty"`
+	Cells       map[string]string `json:"cells"`
+}
+
+type tracer struct {
+	encoder *json.Encoder
+	cells   map[string]string
+}
+
+// StartTrace records the world, and then its updates, to w, nil stops
+// recording
+func (e *Engine) StartTrace(w io.Writer) error {
+	e.trace = nil
+	if w == nil {
+		return nil
+	}
+
+	e.trace = &tracer{encoder: json.NewEncoder(w)}
+
+	return e.recordTrace()
+}
+
+// recordTrace writes the cells changed since the last line of the trace
+func (e *Engine) recordTrace() error {
+	if e.trace == nil {
+		return nil
+	}
+
+	cells := make(map[string]string)
+	e.world.Each(func(c cell, p *Particle) {
+		cells[fmt.Sprintf("%d,%d", c.row, c.column)] = p.GetStateS(nil)
+	})
+
+	round := e.getRound()
+	if round == math.MaxInt {
+		round = 0
+	}
+
+	line := traceLine{
+		Round:       round,
+		VirtualTime: e.virtualTime,
+		Full:        e.trace.cells == nil,
+		Stopped:     e.stopReason,
+		Cells:       cells,
+	}
+
+	if !line.Full {
+		line.Cells = make(map[string]string)
+
+		for key, state := range cells {
+			if e.trace.cells[key] != state {
+				line.Cells[key] = state
+			}
+		}
+
+		for key := range e.trace.cells {
+			if _, ok := cells[key]; !ok {
+				line.Cells[key] = "VOID"
+			}
+		}
+	}
+
+	e.trace.cells = cells
+
+	if err := e.trace.encoder.Encode(line); err != nil {
+		return fmt.Errorf("trace: %w", err)
+	}
+
+	return nil
+}
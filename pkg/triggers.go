@@ -0,0 +1,285 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Trigger int
+
+const (
+	N1CHANGE Trigger = iota
+	LIGHTCHANGE
+	MESSAGE
+	PREDICATE
+)
+
+type cell struct {
+	row, column int
+}
+
+// sortedCells returns the cells of a set by row and column, for an order
+// that does not depend on the map order
+func sortedCells(set map[cell]bool) []cell {
+	cells := make([]cell, 0, len(set))
+	for c := range set {
+		cells = append(cells, c)
+	}
+
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].row != cells[j].row {
+			return cells[i].row < cells[j].row
+		}
+
+		return cells[i].column < cells[j].column
+	})
+
+	return cells
+}
+
+func parseTrigger(s string) (Trigger, error) {
+	switch strings.ToLower(s) {
+	case "n1_change":
+		return N1CHANGE, nil
+	case "light_change":
+		return LIGHTCHANGE, nil
+	case "message":
+		return MESSAGE, nil
+	case "predicate":
+		return PREDICATE, nil
+	}
+
+	return -1, fmt.Errorf("'%s' is not a valid trigger", s)
+}
+
+// n1Cells returns the N1 cells of [row, column] in the order of the geometry
+// directions (l, r, ul, ur, ll, lr on hex)
+func (e *Engine) n1Cells(row, column int) []cell {
+	directions := e.geometry.Directions()
+	cells := make([]cell, 0, len(directions))
+
+	for d := range directions {
+		nRow, nCol := e.geometry.Neighbor(row, column, d)
+		cells = append(cells, e.wrap(cell{nRow, nCol}))
+	}
+
+	return cells
+}
+
+// n2Cells returns the N2 cells of [row, column] in the order of the geometry
+// N2 positions (l2, r2, u2l, u2r, l2l, l2r on hex)
+func (e *Engine) n2Cells(row, column int) []cell {
+	positions := e.geometry.N2()
+	cells := make([]cell, 0, len(positions))
+
+	for _, pos := range positions {
+		nRow, nCol := row, column
+		for _, d := range pos.Path {
+			nRow, nCol = e.geometry.Neighbor(nRow, nCol, d)
+		}
+
+		cells = append(cells, e.wrap(cell{nRow, nCol}))
+	}
+
+	return cells
+}
+
+func (e *Engine) inGrid(c cell) bool {
+	return e.world.Inside(c)
+}
+
+// triggersEnabled is true when the async scheduler wakes particles with the triggers
+func (e *Engine) triggersEnabled() bool {
+	return e.schedulerType == ASYNC && e.schedulerEventDriven && len(e.schedulerTriggers) > 0
+}
+
+// markTouched records a cell changed by a move, to be used by the triggers
+func (e *Engine) markTouched(row, column int) {
+	if !e.triggersEnabled() {
+		return
+	}
+
+	e.triggerMu.Lock()
+	defer e.triggerMu.Unlock()
+
+	e.touchedCells[cell{row, column}] = true
+}
+
+// updateLight switches on the next light of a particle and records the change
+func (e *Engine) updateLight(row, column int) {
+	curParticle := e.particleAt(row, column)
+
+	if curParticle.nextLight == curParticle.light {
+		return
+	}
+
+	curParticle.light = curParticle.nextLight
+
+	if !e.triggersEnabled() {
+		return
+	}
+
+	e.triggerMu.Lock()
+	defer e.triggerMu.Unlock()
+
+	e.lightCells[cell{row, column}] = true
+}
+
+// deliverMessages sends the outgoing messages of a particle to its N1 neighbors
+func (e *Engine) deliverMessages(row, column int) {
+	curParticle := e.particleAt(row, column)
+
+	if len(curParticle.outbox) == 0 {
+		return
+	}
+
+	e.triggerMu.Lock()
+	defer e.triggerMu.Unlock()
+
+	directions := e.geometry.Directions()
+
+	for i, target := range e.n1Cells(row, column) {
+		// The messages are sent towards the local directions of the sender
+		msg, ok := curParticle.outbox[directions[curParticle.localDirection(i)]]
+		if !ok || !e.inGrid(target) {
+			continue
+		}
+
+		recipient := e.world.At(target)
+		if recipient == nil || recipient.state == OBSTACLE {
+			continue
+		}
+
+		recipient.inbox = append(recipient.inbox, map[string]interface{}{
+			"from": directions[recipient.localDirection(e.geometry.Opposite(i))],
+			"msg":  msg,
+		})
+
+		if e.triggersEnabled() {
+			e.messageCells[target] = true
+		}
+	}
+
+	curParticle.outbox = nil
+}
+
+// wakesOnPredicate runs the trigger script over the current view of a particle
+func (e *Engine) wakesOnPredicate(row, column int) (bool, error) {
+	if e.triggerScript == nil {
+		return false, nil
+	}
+
+	curParticle := e.particleAt(row, column)
+	if curParticle == nil {
+		return false, nil
+	}
+
+	// The view is read under the lock of the states, as by the async tasks
+	e.updateNeighbors(row, column)
+
+	neighbors1, neighbors2 := curParticle.GetNeighborsString()
+
+	e.asyncMu.Lock()
+
+	err := e.addParticleInputs(e.triggerScript, curParticle, neighbors1, neighbors2, curParticle.n1Deg)
+	if err != nil {
+		e.asyncMu.Unlock()
+
+		return false, err
+	}
+
+	triggerScriptCompiled, err := e.triggerScript.Compile()
+
+	e.asyncMu.Unlock()
+
+	if err != nil {
+		return false, err
+	}
+
+	if err := triggerScriptCompiled.Run(); err != nil {
+		return false, err
+	}
+
+	return triggerScriptCompiled.Get("wake").Bool(), nil
+}
+
+// triggeredParticles returns the particles woken by the configured triggers.
+// Only the cells around the ones changed since the last call are checked.
+func (e *Engine) triggeredParticles() ([]interface{}, error) {
+	e.triggerMu.Lock()
+	touched, lights, messages := e.touchedCells, e.lightCells, e.messageCells
+	e.touchedCells = make(map[cell]bool)
+	e.lightCells = make(map[cell]bool)
+	e.messageCells = make(map[cell]bool)
+	e.triggerMu.Unlock()
+
+	candidates := make(map[cell]bool)
+	woken := make(map[cell]bool)
+
+	for _, trigger := range e.schedulerTriggers {
+		switch trigger {
+		case N1CHANGE:
+			for c := range touched {
+				for _, n := range e.n1Cells(c.row, c.column) {
+					woken[n] = true
+				}
+			}
+		case LIGHTCHANGE:
+			for c := range lights {
+				for _, n := range e.n1Cells(c.row, c.column) {
+					woken[n] = true
+				}
+			}
+		case MESSAGE:
+			for c := range messages {
+				woken[c] = true
+			}
+		case PREDICATE:
+			for c := range touched {
+				candidates[c] = true
+
+				for _, n := range e.n1Cells(c.row, c.column) {
+					candidates[n] = true
+				}
+
+				for _, n := range e.n2Cells(c.row, c.column) {
+					candidates[n] = true
+				}
+			}
+		}
+	}
+
+	res := make([]interface{}, 0)
+
+	// Sorted cells keep the launch order of a seeded run
+	for _, c := range sortedCells(woken) {
+		if p := e.world.At(c); p != nil && p.state == CONTRACTED {
+			res = append(res, fmt.Sprintf("%d,%d", c.row, c.column))
+			delete(candidates, c)
+		}
+	}
+
+	for _, c := range sortedCells(candidates) {
+		if p := e.world.At(c); p != nil && p.state == CONTRACTED && !e.isAwoken(p) {
+			wake, err := e.wakesOnPredicate(c.row, c.column)
+			if err != nil {
+				return nil, fmt.Errorf("trigger %d,%d: %w", c.row, c.column, err)
+			}
+
+			if wake {
+				res = append(res, fmt.Sprintf("%d,%d", c.row, c.column))
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// isAwoken is true for a particle with a running async task
+func (e *Engine) isAwoken(p *Particle) bool {
+	e.asyncMu.RLock()
+	defer e.asyncMu.RUnlock()
+
+	return p.awoken
+}
@@ -0,0 +1,497 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/d5/tengo/v2/parser"
+	"github.com/d5/tengo/v2/token"
+)
+
+// Severity tells whether a finding stops the world from running
+type Severity int
+
+const (
+	// ERROR findings make Bootstrap fail or pick a state arbitrarily
+	ERROR Severity = iota
+	// WARNING findings run, but probably not as intended
+	WARNING
+)
+
+func (s Severity) String() string {
+	return [...]string{"error", "warning"}[s]
+}
+
+// Location is where a finding is: the position of the key in the file of
+// the initial state, when known, and the cell
+type Location struct {
+	File   string
+	Line   int
+	Column int
+	Cell   string
+}
+
+func (l Location) String() string {
+	res := make([]string, 0, 2)
+
+	switch {
+	case l.File != "" && l.Line > 0:
+		res = append(res, fmt.Sprintf("%s:%d:%d", l.File, l.Line, l.Column))
+	case l.File != "":
+		res = append(res, l.File)
+	}
+
+	if l.Cell != "" {
+		res = append(res, fmt.Sprintf("cell %s", l.Cell))
+	}
+
+	return strings.Join(res, ": ")
+}
+
+// Finding is a problem of the initial state found by Validate
+type Finding struct {
+	Severity Severity
+	Location Location
+	Msg      string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s: %s", f.Location, f.Severity, f.Msg)
+}
+
+// validator checks the cells of an initial state against a world
+type validator struct {
+	world    WorldConfig
+	terrain  map[cell]Terrain
+	file     string
+	keys     map[string]Location
+	cells    map[cell]State
+	findings []Finding
+}
+
+func (v *validator) add(severity Severity, key string, format string, a ...interface{}) {
+	loc, ok := v.keys[key]
+	if !ok {
+		loc = Location{File: v.file, Cell: key}
+	}
+
+	v.findings = append(v.findings, Finding{severity, loc, fmt.Sprintf(format, a...)})
+}
+
+// Validate checks the initial state of a configuration for the world it is
+// bootstrapped in: malformed and out of bounds cells, invalid states and
+// duplicate keys are errors, transient states, disconnected swarms and
+// swarms enclosed by obstacles are warnings.
+// The findings are located in the scenario file or in init.tengo.
+func (e *Engine) Validate(config *InitialConfig, world WorldConfig) []Finding {
+	if world.Geometry == nil {
+		world.Geometry = HexGeometry{}
+	}
+
+	v := &validator{
+		world:   world,
+		terrain: config.Terrain,
+		cells:   make(map[cell]State),
+	}
+
+	if e.scenario != nil {
+		v.file = e.scenarioPath
+	} else {
+		v.file = e.scriptPath("init.tengo")
+	}
+
+	// Without the source the findings are located by cell only
+	if src, err := ioutil.ReadFile(v.file); err == nil {
+		if e.scenario != nil {
+			v.keys, v.findings = jsonStateKeys(v.file, src)
+		} else {
+			v.keys, v.findings = tengoStateKeys(v.file, src)
+		}
+	}
+
+	keys := make([]string, 0, len(config.State))
+	for key := range config.State {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v.checkCell(key, config.State[key])
+	}
+
+	v.checkSwarms()
+
+	// In the order of the file, the findings without a position last
+	sort.SliceStable(v.findings, func(i, j int) bool {
+		a, b := v.findings[i].Location, v.findings[j].Location
+		if a.line() != b.line() {
+			return a.line() < b.line()
+		}
+
+		return a.Column < b.Column
+	})
+
+	return v.findings
+}
+
+func (l Location) line() int {
+	if l.Line <= 0 {
+		return math.MaxInt
+	}
+
+	return l.Line
+}
+
+// checkCell checks the key and the state of a cell, and records its
+// particle for checkSwarms
+func (v *validator) checkCell(key string, val interface{}) {
+	row, column, err := parseCellKey(key)
+	if err != nil {
+		v.add(ERROR, key, "'%s' is not a row,column key", key)
+
+		return
+	}
+
+	c := cell{row, column}
+	bounded := v.bounded()
+
+	if bounded && !v.inside(c) {
+		v.add(ERROR, key, "outside the world of %dx%d cells", v.world.Rows, v.world.Cols)
+
+		return
+	}
+
+	n, ok := val.(int64)
+	if !ok {
+		v.add(ERROR, key, "'%v' is not a state number", val)
+
+		return
+	}
+
+	p := &Particle{geometry: v.world.Geometry}
+	if err := p.SetStateN(int(n)); err != nil {
+		v.add(ERROR, key, "%d is not a valid state", n)
+
+		return
+	}
+
+	if d, ok := stateDirection(p.state); ok && d >= len(v.world.Geometry.Directions()) {
+		v.add(ERROR, key, "state %d has no direction in the %s geometry", n, v.world.Geometry.Name())
+
+		return
+	}
+
+	if p.state == VOID {
+		return
+	}
+
+	if terrain := v.terrain[c]; terrain == SOLID || terrain == HOLE {
+		v.add(ERROR, key, "%s is on a %s", p.GetStateS(nil), terrain)
+
+		return
+	}
+
+	switch {
+	case isMove(p.state):
+		v.add(WARNING, key, "%s is a transient state, the particle starts in the middle of a move", p.GetStateS(nil))
+	case isExpand(p.state):
+		v.add(WARNING, key, "%s is a transient state, the particle starts expanded", p.GetStateS(nil))
+	}
+
+	v.cells[c] = p.state
+}
+
+func (v *validator) bounded() bool {
+	return v.world.Boundary != GROW && v.world.Rows > 0 && v.world.Cols > 0
+}
+
+func (v *validator) inside(c cell) bool {
+	return c.row >= 0 && c.column >= 0 && c.row < v.world.Rows && c.column < v.world.Cols
+}
+
+// neighbor returns the cell in direction d, wrapped on a torus
+func (v *validator) neighbor(c cell, d int) cell {
+	row, column := v.world.Geometry.Neighbor(c.row, c.column, d)
+	if v.world.Boundary == TORUS && v.bounded() {
+		return cell{mod(row, v.world.Rows), mod(column, v.world.Cols)}
+	}
+
+	return cell{row, column}
+}
+
+// free is true for the empty cells a particle can move into
+func (v *validator) free(c cell) bool {
+	if _, ok := v.cells[c]; ok {
+		return false
+	}
+
+	if v.world.Boundary == WALL && v.bounded() && !v.inside(c) {
+		return false
+	}
+
+	return v.terrain[c] != SOLID
+}
+
+// checkSwarms finds the connected groups of particles: the groups beside
+// the largest one are disconnected, and a group without a free neighbor
+// cell is enclosed and cannot move
+func (v *validator) checkSwarms() {
+	particles := make([]cell, 0, len(v.cells))
+	for c, state := range v.cells {
+		if state != OBSTACLE {
+			particles = append(particles, c)
+		}
+	}
+
+	sort.Slice(particles, func(i, j int) bool {
+		if particles[i].row != particles[j].row {
+			return particles[i].row < particles[j].row
+		}
+
+		return particles[i].column < particles[j].column
+	})
+
+	seen := make(map[cell]bool, len(particles))
+	swarms := make([][]cell, 0)
+	largest := 0
+
+	for _, start := range particles {
+		if seen[start] {
+			continue
+		}
+
+		seen[start] = true
+		swarm := []cell{start}
+
+		for i := 0; i < len(swarm); i++ {
+			for d := range v.world.Geometry.Directions() {
+				n := v.neighbor(swarm[i], d)
+				if state, ok := v.cells[n]; ok && state != OBSTACLE && !seen[n] {
+					seen[n] = true
+					swarm = append(swarm, n)
+				}
+			}
+		}
+
+		if len(swarms) > 0 && len(swarm) > len(swarms[largest]) {
+			largest = len(swarms)
+		}
+
+		swarms = append(swarms, swarm)
+	}
+
+	for i, swarm := range swarms {
+		key := fmt.Sprintf("%d,%d", swarm[0].row, swarm[0].column)
+
+		if i != largest {
+			v.add(WARNING, key, "%s disconnected from the largest swarm, of %d particles at %d,%d",
+				swarmName(swarm), len(swarms[largest]), swarms[largest][0].row, swarms[largest][0].column)
+		}
+
+		if !v.canMove(swarm) {
+			v.add(WARNING, key, "%s enclosed by obstacles and cannot move", swarmName(swarm))
+		}
+	}
+}
+
+func swarmName(swarm []cell) string {
+	if len(swarm) == 1 {
+		return "the particle is"
+	}
+
+	return fmt.Sprintf("a swarm of %d particles is", len(swarm))
+}
+
+func (v *validator) canMove(swarm []cell) bool {
+	for _, c := range swarm {
+		for d := range v.world.Geometry.Directions() {
+			if v.free(v.neighbor(c, d)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// jsonStateKeys returns the positions of the keys of the init_state object
+// of a scenario, and the keys repeated in any of its objects
+func jsonStateKeys(file string, src []byte) (map[string]Location, []Finding) {
+	type frame struct {
+		object bool
+		// The next token is a key
+		key  bool
+		name string
+		keys map[string]Location
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(src)))
+	stack := make([]*frame, 0)
+	positions := make(map[string]Location)
+	findings := make([]Finding, 0)
+	name := ""
+
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		var top *frame
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+
+		if s, ok := tok.(string); ok && top != nil && top.object && top.key {
+			end := int(decoder.InputOffset())
+			loc := Location{File: file}
+			loc.Line, loc.Column = offsetPosition(src, end-len(strconv.Quote(s)))
+
+			// The keys of these objects are cells
+			if top.name == "init_state" || top.name == "terrain" || top.name == "particles" {
+				loc.Cell = s
+			}
+
+			if prev, ok := top.keys[s]; ok {
+				findings = append(findings, Finding{ERROR, loc, fmt.Sprintf("'%s' is repeated in %s, first at %d:%d, the last one wins", s, top.name, prev.Line, prev.Column)})
+			}
+
+			top.keys[s] = loc
+			if len(stack) == 2 && top.name == "init_state" {
+				positions[s] = loc
+			}
+
+			top.key = false
+			name = s
+
+			continue
+		}
+
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			f := &frame{object: tok == json.Delim('{'), name: name, keys: make(map[string]Location)}
+			f.key = f.object
+
+			if top == nil {
+				f.name = "the scenario"
+			}
+
+			stack = append(stack, f)
+
+			continue
+		case json.Delim('}'), json.Delim(']'):
+			stack = stack[:len(stack)-1]
+			if len(stack) > 0 {
+				top = stack[len(stack)-1]
+			}
+		}
+
+		if top != nil && top.object {
+			top.key = true
+		}
+	}
+
+	return positions, findings
+}
+
+// offsetPosition returns the line and the column of a byte of src
+func offsetPosition(src []byte, offset int) (int, int) {
+	if offset < 0 {
+		offset = 0
+	}
+
+	line, column := 1, 1
+
+	for _, b := range src[:offset] {
+		if b == '\n' {
+			line += 1
+			column = 1
+		} else {
+			column += 1
+		}
+	}
+
+	return line, column
+}
+
+// tengoStateKeys returns the positions of the keys of the map literal
+// assigned to init_state in the init script, and the keys repeated in any
+// of its map literals, where the last one wins
+func tengoStateKeys(file string, src []byte) (map[string]Location, []Finding) {
+	fileSet := parser.NewFileSet()
+	sourceFile := fileSet.AddFile(file, -1, len(src))
+	scanner := parser.NewScanner(sourceFile, src, nil, parser.DontInsertSemis)
+
+	// The keys of the braces, nil for the brackets and the parentheses
+	type brace struct {
+		state bool
+		keys  map[string]Location
+	}
+
+	stack := make([]*brace, 0)
+	positions := make(map[string]Location)
+	findings := make([]Finding, 0)
+
+	// A string after '{' or ',' is a key when a ':' follows it
+	var prev, prev2 token.Token
+	var ident string
+	var key *Location
+
+	for {
+		tok, literal, pos := scanner.Scan()
+		if tok == token.EOF {
+			break
+		}
+
+		var top *brace
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+
+		if key != nil && tok == token.Colon {
+			if first, ok := top.keys[key.Cell]; ok {
+				findings = append(findings, Finding{ERROR, *key, fmt.Sprintf("'%s' is repeated in the map, first at %d:%d, the last one wins", key.Cell, first.Line, first.Column)})
+			}
+
+			top.keys[key.Cell] = *key
+			if top.state {
+				positions[key.Cell] = *key
+			}
+		}
+
+		key = nil
+
+		switch tok {
+		case token.LBrace:
+			state := (prev == token.Define || prev == token.Assign) && prev2 == token.Ident && ident == "init_state"
+			stack = append(stack, &brace{state: state, keys: make(map[string]Location)})
+		case token.LBrack, token.LParen:
+			stack = append(stack, &brace{})
+		case token.RBrace, token.RBrack, token.RParen:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case token.String:
+			if top == nil || top.keys == nil || (prev != token.LBrace && prev != token.Comma) {
+				break
+			}
+
+			if cellKey, err := strconv.Unquote(literal); err == nil {
+				position := sourceFile.Position(pos)
+				key = &Location{File: file, Line: position.Line, Column: position.Column, Cell: cellKey}
+			}
+		case token.Ident:
+			ident = literal
+		}
+
+		prev, prev2 = tok, prev
+	}
+
+	return positions, findings
+}
@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	hexWorld := WorldConfig{Rows: 10, Cols: 10, Boundary: WALL, Geometry: HexGeometry{}}
+
+	// The particle at 5,5 surrounded by obstacles
+	hex := HexGeometry{}
+	enclosed := map[string]interface{}{"5,5": int64(CONTRACTED)}
+	for d := range hex.Directions() {
+		row, column := hex.Neighbor(5, 5, d)
+		enclosed[fmt.Sprintf("%d,%d", row, column)] = int64(14)
+	}
+
+	tests := []struct {
+		name    string
+		world   WorldConfig
+		state   map[string]interface{}
+		terrain map[cell]Terrain
+		// Severity and part of the message of the only finding, none if empty
+		severity Severity
+		msg      string
+	}{
+		{"connected", hexWorld, map[string]interface{}{"5,5": int64(1), "5,6": int64(1)}, nil, ERROR, ""},
+		{"malformed key", hexWorld, map[string]interface{}{"5;5": int64(1)}, nil, ERROR, "is not a row,column key"},
+		{"outside", hexWorld, map[string]interface{}{"10,5": int64(1)}, nil, ERROR, "outside the world of 10x10 cells"},
+		{"not a number", hexWorld, map[string]interface{}{"5,5": "CONTRACTED"}, nil, ERROR, "is not a state number"},
+		{"invalid state", hexWorld, map[string]interface{}{"5,5": int64(99)}, nil, ERROR, "99 is not a valid state"},
+		{"missing direction", hexWorld, map[string]interface{}{"5,5": int64(15)}, nil, ERROR, "has no direction in the hex geometry"},
+		{"on a wall", hexWorld, map[string]interface{}{"5,5": int64(1)}, map[cell]Terrain{{5, 5}: SOLID}, ERROR, "is on a"},
+		{"on a hole", hexWorld, map[string]interface{}{"5,5": int64(1)}, map[cell]Terrain{{5, 5}: HOLE}, ERROR, "is on a"},
+		{"moving", hexWorld, map[string]interface{}{"5,5": int64(8)}, nil, WARNING, "the particle starts in the middle of a move"},
+		{"expanded", hexWorld, map[string]interface{}{"5,5": int64(2)}, nil, WARNING, "the particle starts expanded"},
+		{"disconnected", hexWorld, map[string]interface{}{"1,1": int64(1), "1,2": int64(1), "8,8": int64(1)}, nil, WARNING, "disconnected from the largest swarm, of 2 particles at 1,1"},
+		{"enclosed", hexWorld, enclosed, nil, WARNING, "enclosed by obstacles and cannot move"},
+		{"walled in a corner", WorldConfig{Rows: 1, Cols: 1, Boundary: WALL, Geometry: HexGeometry{}}, map[string]interface{}{"0,0": int64(1)}, nil, WARNING, "enclosed by obstacles"},
+		{"square8 direction", WorldConfig{Rows: 10, Cols: 10, Boundary: WALL, Geometry: SquareGeometry{Diagonals: true}}, map[string]interface{}{"5,5": int64(15)}, nil, WARNING, "the particle starts expanded"},
+		{"growing world", WorldConfig{Boundary: GROW, Geometry: HexGeometry{}}, map[string]interface{}{"-50,500": int64(1)}, nil, ERROR, ""},
+		{"torus wraps the swarm", WorldConfig{Rows: 10, Cols: 10, Boundary: TORUS, Geometry: HexGeometry{}}, map[string]interface{}{"0,0": int64(1), "0,9": int64(1)}, nil, ERROR, ""},
+	}
+
+	for _, tt := range tests {
+		// No init.tengo in the scripts directory: the findings are located by cell
+		e := &Engine{scriptsDir: t.TempDir()}
+		config := &InitialConfig{State: tt.state, Terrain: tt.terrain}
+
+		findings := e.Validate(config, tt.world)
+
+		if tt.msg == "" {
+			if len(findings) != 0 {
+				t.Errorf("%s: got %v, want no findings", tt.name, findings)
+			}
+
+			continue
+		}
+
+		if len(findings) != 1 {
+			t.Errorf("%s: got %v, want one finding", tt.name, findings)
+
+			continue
+		}
+
+		if f := findings[0]; f.Severity != tt.severity || !strings.Contains(f.Msg, tt.msg) {
+			t.Errorf("%s: got %s, want %s with '%s'", tt.name, f, tt.severity, tt.msg)
+		}
+	}
+}
+
+func TestRepeatedKeys(t *testing.T) {
+	json := `{
+  "name": "repeated",
+  "init_state": {
+    "1,1": "CONTRACTED",
+    "1,2": "CONTRACTED",
+    "1,1": "OBSTACLE"
+  }
+}`
+
+	positions, findings := jsonStateKeys("x.json", []byte(json))
+
+	if loc := positions["1,2"]; loc.Line != 5 || loc.Column != 5 {
+		t.Errorf("1,2: got %d:%d, want 5:5", loc.Line, loc.Column)
+	}
+
+	if len(findings) != 1 || findings[0].Location.Line != 6 || !strings.Contains(findings[0].Msg, "first at 4:5") {
+		t.Errorf("json: got %v, want '1,1' repeated at 6:5", findings)
+	}
+
+	tengo := `init_state := {
+    "1,1": 1,
+    "1,2": 1,
+    "1,1": 14
+}
+other := {"1,1": 1}
+`
+
+	positions, findings = tengoStateKeys("init.tengo", []byte(tengo))
+
+	if loc := positions["1,2"]; loc.Line != 3 || loc.Column != 5 {
+		t.Errorf("1,2: got %d:%d, want 3:5", loc.Line, loc.Column)
+	}
+
+	if _, ok := positions["1,1"]; !ok {
+		t.Errorf("1,1: not located")
+	}
+
+	// The other map is not the initial state, its key is not repeated
+	if len(findings) != 1 || findings[0].Location.Line != 4 || !strings.Contains(findings[0].Msg, "first at 2:5") {
+		t.Errorf("tengo: got %v, want '1,1' repeated at 4:5", findings)
+	}
+}
@@ -0,0 +1,153 @@
+package pkg
+
+import (
+	"math"
+	"sort"
+)
+
+// ringCells returns the rings of cells at distance 1..radius from a particle
+// at [row, column], the distance is the number of N1 steps. Every ring is in
+// clockwise order starting from the left in the local frame of the particle,
+// e.g. from the L corner on hex.
+func (e *Engine) ringCells(row, column, radius int, p *Particle) [][]cell {
+	rings := make([][]cell, 0, radius)
+	seen := map[cell]bool{{row, column}: true}
+	frontier := []cell{{row, column}}
+
+	// Breadth-first visit on the unwrapped coordinates, so that the angles
+	// are measured on the lattice and not across the wrap
+	for k := 1; k <= radius; k++ {
+		ring := make([]cell, 0)
+
+		for _, c := range frontier {
+			for d := range e.geometry.Directions() {
+				nRow, nCol := e.geometry.Neighbor(c.row, c.column, d)
+				if n := (cell{nRow, nCol}); !seen[n] {
+					seen[n] = true
+					ring = append(ring, n)
+				}
+			}
+		}
+
+		e.sortClockwise(row, column, ring, p)
+
+		frontier = ring
+		rings = append(rings, ring)
+	}
+
+	for _, ring := range rings {
+		for i, c := range ring {
+			ring[i] = e.wrap(c)
+		}
+	}
+
+	return rings
+}
+
+// sortClockwise sorts the cells by their angle around a particle at
+// [row, column] on the screen, clockwise from the left of its local frame
+func (e *Engine) sortClockwise(row, column int, cells []cell, p *Particle) {
+	const size = 64
+
+	x, y := e.geometry.Center(row, column, size)
+
+	// Clockwise angle from the global left
+	angleOf := func(cRow, cCol int) float64 {
+		cx, cy := e.geometry.Center(cRow, cCol, size)
+		// Screen y grows downwards
+		theta := math.Atan2(float64(y-cy), float64(cx-x))
+
+		return math.Mod(math.Pi-theta+2*math.Pi, 2*math.Pi)
+	}
+
+	start := angleOf(e.geometry.Neighbor(row, column, p.globalDirection(0)))
+
+	angle := func(c cell) float64 {
+		a := angleOf(c.row, c.column) - start
+		if p.mirror {
+			a = -a
+		}
+
+		// The cells in the start direction may be off by a rounding error
+		if a = math.Mod(a+4*math.Pi, 2*math.Pi); a > 2*math.Pi-1e-9 {
+			a = 0
+		}
+
+		return a
+	}
+
+	angles := make(map[cell]float64, len(cells))
+	for _, c := range cells {
+		angles[c] = angle(c)
+	}
+
+	sort.SliceStable(cells, func(i, j int) bool {
+		return angles[cells[i]] < angles[cells[j]]
+	})
+}
+
+// cellDegree returns the number of particles around a cell, the cells
+// outside the world and the walls have the max degree
+func (e *Engine) cellDegree(c cell) int {
+	if e.impassable(c.row, c.column) {
+		return len(e.geometry.Directions())
+	}
+
+	deg := 0
+
+	for _, n := range e.n1Cells(c.row, c.column) {
+		if state := e.getSafeState(n.row, n.column); state != VOID && state != OBSTACLE {
+			deg += 1
+		}
+	}
+
+	return deg
+}
+
+// updateRings updates the rings seen by a particle within the visibility radius
+func (e *Engine) updateRings(row, column int, particle *Particle) {
+	if e.visibilityRadius <= 0 {
+		particle.rings = nil
+		particle.ringDegs = nil
+
+		return
+	}
+
+	cells := e.ringCells(row, column, e.visibilityRadius, particle)
+	rings := make([][]State, len(cells))
+	ringDegs := make([][]int, len(cells))
+
+	for k, ring := range cells {
+		rings[k] = make([]State, len(ring))
+		ringDegs[k] = make([]int, len(ring))
+
+		for i, c := range ring {
+			rings[k][i] = e.getSafeState(c.row, c.column)
+			ringDegs[k][i] = e.cellDegree(c)
+		}
+	}
+
+	particle.rings = rings
+	particle.ringDegs = ringDegs
+}
+
+// ringInputs converts the rings of a particle to the rings and ring_degs script inputs
+func (p *Particle) ringInputs() ([]interface{}, []interface{}) {
+	rings := make([]interface{}, len(p.rings))
+	ringDegs := make([]interface{}, len(p.ringDegs))
+
+	for k, ring := range p.rings {
+		states := make([]interface{}, len(ring))
+		degs := make([]interface{}, len(ring))
+
+		for i := range ring {
+			states[i] = p.localStateS(ring[i])
+			degs[i] = p.ringDegs[k][i]
+		}
+
+		rings[k] = states
+		ringDegs[k] = degs
+	}
+
+	return rings, ringDegs
+}
@@ -0,0 +1,291 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+type WorldStorage int
+
+const (
+	DENSE WorldStorage = iota
+	SPARSE
+)
+
+func ParseWorldStorage(s string) (WorldStorage, error) {
+	switch strings.ToLower(s) {
+	case "", "dense":
+		return DENSE, nil
+	case "sparse":
+		return SPARSE, nil
+	}
+
+	return -1, fmt.Errorf("'%s' is not a valid world storage", s)
+}
+
+func (s WorldStorage) String() string {
+	return [...]string{"dense", "sparse"}[s]
+}
+
+// world stores the particles by cell, the empty cells hold no particle
+type world interface {
+	// At returns the particle in a cell, nil if the cell is empty
+	At(c cell) *Particle
+	// Put places a particle in a cell, a nil particle empties the cell
+	Put(c cell, p *Particle)
+	// Move moves the particle in from to the empty cell to
+	Move(from, to cell)
+	// Inside is true for the cells that can hold a particle
+	Inside(c cell) bool
+	// Bounded is false when the world grows in any direction
+	Bounded() bool
+	// Bounds returns the first and the last cell of the world, for an
+	// unbounded world the extent of the cells occupied so far
+	Bounds() (cell, cell)
+	// Each calls fn for every particle
+	Each(fn func(c cell, p *Particle))
+	// Len returns the number of particles
+	Len() int
+}
+
+// WorldConfig is the size, the storage, the boundary and the geometry of the world
+type WorldConfig struct {
+	Rows     int
+	Cols     int
+	Storage  WorldStorage
+	Boundary Boundary
+	Geometry Geometry // nil is the hex geometry
+}
+
+// newWorld creates an empty world, a growing world is sparse and unbounded
+func newWorld(config WorldConfig) (world, error) {
+	if err := checkBoundary(config); err != nil {
+		return nil, err
+	}
+
+	if config.Boundary == GROW {
+		return newSparseWorld(0, 0), nil
+	}
+
+	switch config.Storage {
+	case DENSE:
+		return newDenseWorld(config.Rows, config.Cols), nil
+	case SPARSE:
+		return newSparseWorld(config.Rows, config.Cols), nil
+	}
+
+	return nil, fmt.Errorf("unknown world storage %d", config.Storage)
+}
+
+// denseWorld is a fixed size grid, iterating it costs the number of cells
+type denseWorld struct {
+	cells [][]*Particle
+	count int
+}
+
+func newDenseWorld(numRows, numCols int) *denseWorld {
+	w := &denseWorld{cells: make([][]*Particle, numRows)}
+
+	for i := range w.cells {
+		w.cells[i] = make([]*Particle, numCols)
+	}
+
+	return w
+}
+
+func (w *denseWorld) At(c cell) *Particle {
+	if !w.Inside(c) {
+		return nil
+	}
+
+	return w.cells[c.row][c.column]
+}
+
+func (w *denseWorld) Put(c cell, p *Particle) {
+	if w.cells[c.row][c.column] != nil {
+		w.count -= 1
+	}
+
+	if p != nil {
+		w.count += 1
+	}
+
+	w.cells[c.row][c.column] = p
+}
+
+func (w *denseWorld) Move(from, to cell) {
+	w.cells[to.row][to.column], w.cells[from.row][from.column] = w.cells[from.row][from.column], nil
+}
+
+func (w *denseWorld) Inside(c cell) bool {
+	return c.row >= 0 && c.column >= 0 && c.row < len(w.cells) && c.column < len(w.cells[c.row])
+}
+
+func (w *denseWorld) Bounded() bool {
+	return true
+}
+
+func (w *denseWorld) Bounds() (cell, cell) {
+	return cell{0, 0}, cell{len(w.cells) - 1, len(w.cells[0]) - 1}
+}
+
+func (w *denseWorld) Each(fn func(c cell, p *Particle)) {
+	for row, columns := range w.cells {
+		for column, particle := range columns {
+			if particle != nil {
+				fn(cell{row, column}, particle)
+			}
+		}
+	}
+}
+
+func (w *denseWorld) Len() int {
+	return w.count
+}
+
+// sparseWorld keeps only the occupied cells, iterating it costs the number
+// of particles. The particles are kept in a slice indexed by a map from the
+// cells, so that the iteration order does not depend on the map order.
+type sparseWorld struct {
+	mu        sync.RWMutex
+	index     map[cell]int
+	cells     []cell
+	particles []*Particle
+	numRows   int
+	numCols   int
+	min, max  cell
+}
+
+func newSparseWorld(numRows, numCols int) *sparseWorld {
+	return &sparseWorld{
+		index:     make(map[cell]int),
+		cells:     make([]cell, 0),
+		particles: make([]*Particle, 0),
+		numRows:   numRows,
+		numCols:   numCols,
+	}
+}
+
+func (w *sparseWorld) At(c cell) *Particle {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if i, ok := w.index[c]; ok {
+		return w.particles[i]
+	}
+
+	return nil
+}
+
+func (w *sparseWorld) Put(c cell, p *Particle) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	i, ok := w.index[c]
+
+	switch {
+	case ok && p != nil:
+		w.particles[i] = p
+	case ok:
+		// Swap with the last particle to keep the slices compact
+		last := len(w.cells) - 1
+		w.cells[i], w.particles[i] = w.cells[last], w.particles[last]
+		w.index[w.cells[i]] = i
+		w.cells, w.particles = w.cells[:last], w.particles[:last]
+		delete(w.index, c)
+	case p != nil:
+		w.index[c] = len(w.cells)
+		w.cells = append(w.cells, c)
+		w.particles = append(w.particles, p)
+		w.extend(c)
+	}
+}
+
+func (w *sparseWorld) Move(from, to cell) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	i, ok := w.index[from]
+	if !ok {
+		return
+	}
+
+	delete(w.index, from)
+	w.index[to] = i
+	w.cells[i] = to
+	w.extend(to)
+}
+
+// extend grows the extent of an unbounded world to include a cell
+func (w *sparseWorld) extend(c cell) {
+	if w.Bounded() {
+		return
+	}
+
+	if len(w.cells) == 1 {
+		w.min, w.max = c, c
+
+		return
+	}
+
+	if c.row < w.min.row {
+		w.min.row = c.row
+	}
+
+	if c.column < w.min.column {
+		w.min.column = c.column
+	}
+
+	if c.row > w.max.row {
+		w.max.row = c.row
+	}
+
+	if c.column > w.max.column {
+		w.max.column = c.column
+	}
+}
+
+func (w *sparseWorld) Inside(c cell) bool {
+	if !w.Bounded() {
+		return true
+	}
+
+	return c.row >= 0 && c.column >= 0 && c.row < w.numRows && c.column < w.numCols
+}
+
+func (w *sparseWorld) Bounded() bool {
+	return w.numRows > 0 && w.numCols > 0
+}
+
+func (w *sparseWorld) Bounds() (cell, cell) {
+	if w.Bounded() {
+		return cell{0, 0}, cell{w.numRows - 1, w.numCols - 1}
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.min, w.max
+}
+
+// Each iterates over a copy of the particles, so fn can change the world
+func (w *sparseWorld) Each(fn func(c cell, p *Particle)) {
+	w.mu.RLock()
+	cells := make([]cell, len(w.cells))
+	particles := make([]*Particle, len(w.particles))
+	copy(cells, w.cells)
+	copy(particles, w.particles)
+	w.mu.RUnlock()
+
+	for i, c := range cells {
+		fn(c, particles[i])
+	}
+}
+
+func (w *sparseWorld) Len() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return len(w.cells)
+}